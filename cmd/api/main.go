@@ -135,6 +135,7 @@ func main() {
 		t.Type = ""
 		t.Value = 0
 		t.Description = ""
+		t.Metadata = nil
 		err := gctx.ShouldBindJSON(t)
 		if err != nil {
 			slog.Error("Error binding json", "error", err, "id", id)
@@ -142,6 +143,14 @@ func main() {
 			return
 		}
 
+		// chave de idempotência opcional, levada ao store no metadado
+		// reservado
+		err = setIdempotencyKey(t, gctx.GetHeader("Idempotency-Key"))
+		if err != nil {
+			gctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+			return
+		}
+
 		err = t.Validate()
 		if err != nil {
 			slog.Error("Error validating json", "error", err, "id", id)
@@ -159,10 +168,16 @@ func main() {
 		}
 		if err != nil {
 			switch err {
-			case repository.ErrLimitExceeded:
+			case repository.ErrLimitExceeded, repository.ErrOverflow:
 				gctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
 			case repository.ErrClientNotInitialized:
 				gctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			case repository.ErrDebitFrozen:
+				gctx.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+			case repository.ErrAccountFrozen:
+				gctx.JSON(http.StatusLocked, gin.H{"message": err.Error()})
+			case repository.ErrAccountClosed:
+				gctx.JSON(http.StatusGone, gin.H{"message": err.Error()})
 			default:
 				gctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 			}
@@ -190,6 +205,7 @@ func main() {
 		}
 		for _, t := range resume.Transactions {
 			t.Date = time.UnixMilli(t.Timestamp).Format(time.RFC3339Nano)
+			hideReservedMetadata(t)
 		}
 		h := resumePool.Get().(gin.H)
 		defer resumePool.Put(h)
@@ -201,6 +217,32 @@ func main() {
 		gctx.JSON(200, h)
 	})
 
+	// GET /clientes/[id]/saldo?data=[RFC3339 ou unix millis]
+	r.GET("/clientes/:id/saldo", func(gctx *gin.Context) {
+		id := gctx.Param("id")
+		at, err := parseDate(gctx.Query("data"))
+		if err != nil {
+			gctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid date"})
+			return
+		}
+		balance, err := getBalanceAt(ctx, id, at.UnixMilli())
+		if err != nil {
+			switch err {
+			case repository.ErrClientNotInitialized:
+				gctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			case errBalanceAtUnsupported:
+				gctx.JSON(http.StatusNotImplemented, gin.H{"message": err.Error()})
+			case repository.ErrOverflow:
+				gctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+			default:
+				slog.Error("Error getting balance", "error", err, "id", id)
+				gctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			}
+			return
+		}
+		gctx.JSON(http.StatusOK, gin.H{"total": balance, "data_saldo": at.Format(time.RFC3339Nano)})
+	})
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "9999"
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"strconv"
+	"time"
 
 	"github.com/ricardovhz/rinha2/model"
 	"github.com/ricardovhz/rinha2/repository"
@@ -10,20 +13,64 @@ import (
 
 var (
 	repo repository.Repository
+
+	errBalanceAtUnsupported = errors.New("balance history not supported")
+	errReservedMetadata     = errors.New("reserved metadata " + model.IdempotencyKey)
 )
 
 func getRepository() repository.Repository {
 	return repo
 }
 
-func saveTransaction(ctx context.Context, id string, t *model.Transaction) (int, int, error) {
+func saveTransaction(ctx context.Context, id string, t *model.Transaction) (int64, int64, error) {
 	repo := getRepository()
 
 	slog.Debug("Saving transaction for client", "description", t.Description, "client", id, "value", t.Value, "type", t.Type)
 	return repo.SaveTransaction(ctx, id, t)
 }
 
+// setIdempotencyKey guarda a chave no metadado reservado da transação. O
+// metadado não pode vir no corpo da requisição
+func setIdempotencyKey(t *model.Transaction, key string) error {
+	if _, ok := t.Metadata[model.IdempotencyKey]; ok {
+		return errReservedMetadata
+	}
+	if key == "" {
+		return nil
+	}
+	if t.Metadata == nil {
+		t.Metadata = make(map[string]string, 1)
+	}
+	t.Metadata[model.IdempotencyKey] = key
+	return nil
+}
+
+// hideReservedMetadata remove do extrato os metadados reservados, que são do
+// store e não vieram no corpo da transação
+func hideReservedMetadata(t *model.Transaction) {
+	delete(t.Metadata, model.IdempotencyKey)
+	if len(t.Metadata) == 0 {
+		t.Metadata = nil
+	}
+}
+
 func getResume(ctx context.Context, id string) (*model.Resume, error) {
 	repo := getRepository()
 	return repo.GetResume(ctx, id)
 }
+
+func getBalanceAt(ctx context.Context, id string, ts int64) (int64, error) {
+	b, ok := getRepository().(repository.BalanceAtReader)
+	if !ok {
+		return -1, errBalanceAtUnsupported
+	}
+	return b.BalanceAt(ctx, id, ts)
+}
+
+// parseDate aceita uma data RFC3339 ou um timestamp em unix millis
+func parseDate(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+// flushPause é enviado pelo canal de flush, depois das transações já
+// enfileiradas. O serviço de flush grava os buffers, guarda o erro em err,
+// fecha flushed e espera resume
+type flushPause struct {
+	flushed chan struct{}
+	resume  chan struct{}
+	err     error
+}
+
+// backupPath resolve dentro de root o diretório de backup pedido pelo
+// protocolo. Caminhos absolutos ou que saiam de root são recusados, assim
+// como qualquer pedido quando root não está configurado
+func backupPath(root, name string) (string, error) {
+	if root == "" {
+		return "", repository.ErrInvalidBackupPath
+	}
+	name = filepath.Clean(name)
+	if name == "." || !filepath.IsLocal(name) {
+		return "", repository.ErrInvalidBackupPath
+	}
+	return filepath.Join(root, name), nil
+}
+
+// Backup copia para dst os dados de todos os clientes junto com os seus
+// saldos em memória. As gravações são bloqueadas até o serviço de flush
+// esvaziar os buffers, então os chunks passam a conter exatamente o estado em
+// memória. O serviço de flush fica parado durante a cópia dos arquivos; as
+// novas transações continuam sendo aceitas (WAL) e são gravadas depois
+func (s *storeService) Backup(dst string) (*db.BackupInfo, error) {
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dst, db.BackupFile)); err == nil {
+		return nil, os.ErrExist
+	}
+
+	t1 := time.Now()
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.clientInfos))
+	locks := make(map[string]*sync.Mutex, len(s.clientInfos))
+	clients := make(map[string]*clientInfo, len(s.clientInfos))
+	for id, infos := range s.clientInfos {
+		ids = append(ids, id)
+		locks[id] = s.l[id]
+		clients[id] = infos
+	}
+	s.mu.RUnlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		locks[id].Lock()
+	}
+	p := &flushPause{flushed: make(chan struct{}), resume: make(chan struct{})}
+	s.c <- &saveContext{pause: p}
+	<-p.flushed
+	defer close(p.resume)
+	if p.err != nil {
+		for _, id := range ids {
+			locks[id].Unlock()
+		}
+		return nil, p.err
+	}
+
+	info := &db.BackupInfo{Created: time.Now()}
+	for _, id := range ids {
+		infos := clients[id]
+		c := db.BackupClient{
+			ID:      id,
+			Limit:   infos.limit,
+			Balance: infos.balance,
+			Count:   infos.count,
+		}
+		if infos.state != repository.StateActive {
+			c.State = infos.state.String()
+		}
+		info.Clients = append(info.Clients, c)
+		// chaves das transações do backup, para a restauração
+		for _, key := range infos.keyOrder {
+			k, ok := infos.keys[key]
+			if !ok {
+				continue
+			}
+			info.Keys = append(info.Keys, db.IdempotencyEntry{Client: id, Key: key, Timestamp: k.ts, Limit: k.lim, Balance: k.bal})
+		}
+		locks[id].Unlock()
+	}
+
+	for i := range info.Clients {
+		c := &info.Clients[i]
+		c.Files, err = s.db.Snapshot(c.ID, filepath.Join(dst, c.ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = db.WriteBackupInfo(dst, info)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("backup done", "dst", dst, "clients", len(ids), "time", time.Since(t1).Milliseconds())
+	return info, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreBackup(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.NoError(t, s.InitializeClient("1", 1000, 0))
+	require.NoError(t, s.InitializeClient("2", 1000, 0))
+	require.NoError(t, s.InitializeClient("3", 1000, 50))
+
+	ctx := context.Background()
+	save := func(id string, n int) {
+		for i := 0; i < n; i++ {
+			_, _, err := s.Save(ctx, record(id, &model.Transaction{Type: "c", Description: "bkp", Value: int64(i + 1), Timestamp: int64(i)}))
+			require.NoError(t, err)
+		}
+	}
+	save("1", 250)
+
+	// gravações concorrentes com o backup
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		save("2", 300)
+	}()
+	bkp := filepath.Join(t.TempDir(), "bkp")
+	info, err := s.Backup(bkp)
+	require.NoError(t, err)
+	wg.Wait()
+
+	_, err = s.Backup(bkp)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	require.Len(t, info.Clients, 3)
+	require.Equal(t, int64(250), info.Clients[0].Count)
+	require.Equal(t, int64(250*251/2), info.Clients[0].Balance)
+	require.Equal(t, int64(50), info.Clients[2].Balance)
+	_, err = db.VerifyBackup(bkp)
+	require.NoError(t, err)
+
+	// restauração em outro diretório
+	restored := t.TempDir()
+	_, err = db.RestoreBackup(bkp, restored)
+	require.NoError(t, err)
+	dbr := db.NewDB(db.NewFileWriterFactoryFromPath(restored), db.NewFileRegReader(restored))
+	walr, err := db.OpenWAL(filepath.Join(restored, "wal"))
+	require.NoError(t, err)
+	defer walr.Close()
+	sr := NewStoreService(context.Background(), dbr, walr)
+	defer sr.Close()
+	for _, c := range info.Clients {
+		require.NoError(t, sr.InitializeClient(c.ID, c.Limit, c.Balance))
+		_, bal, _, err := sr.GetExtract(ctx, c.ID)
+		require.NoError(t, err)
+		require.Equal(t, c.Balance, bal)
+	}
+
+	// backup alterado não é restaurado
+	chunks, err := db.LoadManifest(filepath.Join(bkp, "1"))
+	require.NoError(t, err)
+	path := filepath.Join(bkp, "1", chunks[0].Name)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[len(b)-1]++
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	_, err = db.RestoreBackup(bkp, t.TempDir())
+	require.ErrorIs(t, err, db.ErrInvalidBackup)
+
+	require.NoError(t, os.Remove(filepath.Join(bkp, db.BackupFile)))
+	_, err = db.VerifyBackup(bkp)
+	require.ErrorIs(t, err, db.ErrInvalidBackup)
+}
+
+func TestBackupPath(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"", ".", "..", "../x", "a/../../x", "/tmp/x", root} {
+		_, err := backupPath(root, name)
+		require.ErrorIs(t, err, repository.ErrInvalidBackupPath, name)
+	}
+	for name, want := range map[string]string{
+		"daily":          filepath.Join(root, "daily"),
+		"2026/10/18":     filepath.Join(root, "2026", "10", "18"),
+		"a/../daily/./x": filepath.Join(root, "daily", "x"),
+	} {
+		got, err := backupPath(root, name)
+		require.NoError(t, err, name)
+		require.Equal(t, want, got)
+	}
+
+	// sem BACKUP_PATH o backup pelo protocolo fica desabilitado
+	_, err := backupPath("", "daily")
+	require.ErrorIs(t, err, repository.ErrInvalidBackupPath)
+}
+
+func TestStoreRestoreIdempotency(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	open := func() *storeService {
+		wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+		require.NoError(t, err)
+		t.Cleanup(func() { wal.Close() })
+		s := NewStoreService(context.Background(), dba, wal)
+		require.NoError(t, s.EnableIdempotency(dir, time.Hour))
+		require.NoError(t, s.LoadClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+		return s
+	}
+	ctx := context.Background()
+	save := func(s *storeService, key string) int64 {
+		tr := &model.Transaction{Type: "c", Description: "idem", Value: 10, Timestamp: time.Now().UnixMilli(), Metadata: map[string]string{model.IdempotencyKey: key}}
+		_, bal, err := s.Save(ctx, record("1", tr))
+		require.NoError(t, err)
+		return bal
+	}
+
+	s := open()
+	require.Equal(t, int64(10), save(s, "a"))
+	bkp := filepath.Join(t.TempDir(), "bkp")
+	info, err := s.Backup(bkp)
+	require.NoError(t, err)
+	require.Len(t, info.Keys, 1)
+	require.Equal(t, int64(20), save(s, "b"))
+	s.Close()
+
+	// a transação "b" foi desfeita pela restauração: a repetição é aplicada
+	_, err = db.RestoreBackup(bkp, dir)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "wal")))
+	s = open()
+	defer s.Close()
+	require.Equal(t, int64(10), save(s, "a"))
+	require.Equal(t, int64(20), save(s, "b"))
+	require.Equal(t, int64(20), save(s, "b"))
+	c, err := s.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), c.Count)
+}
+
+func TestStoreRestoreState(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	open := func() *storeService {
+		wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+		require.NoError(t, err)
+		t.Cleanup(func() { wal.Close() })
+		s := NewStoreService(context.Background(), dba, wal)
+		require.NoError(t, s.LoadClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}, {ID: "2", Limit: 100}}))
+		return s
+	}
+
+	s := open()
+	require.NoError(t, s.SetState("2", repository.StateFrozen, ""))
+	bkp := filepath.Join(t.TempDir(), "bkp")
+	info, err := s.Backup(bkp)
+	require.NoError(t, err)
+	require.Equal(t, "", info.Clients[0].State)
+	require.Equal(t, "frozen", info.Clients[1].State)
+
+	// alterações depois do backup são desfeitas pela restauração
+	_, _, err = s.SetLimit("1", 300, limitReject, "")
+	require.NoError(t, err)
+	require.NoError(t, s.SetState("1", repository.StateFrozen, ""))
+	s.Close()
+
+	_, err = db.RestoreBackup(bkp, dir)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "wal")))
+	clients, err := db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), clients[0].Limit)
+	require.Equal(t, "", clients[0].State)
+	require.Equal(t, "frozen", clients[1].State)
+
+	s = open()
+	defer s.Close()
+	c, err := s.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), c.Limit)
+	require.Equal(t, repository.StateActive, c.State)
+	c, err = s.DescribeClient("2")
+	require.NoError(t, err)
+	require.Equal(t, repository.StateFrozen, c.State)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+// clientes registrados quando o diretório de dados não tem registro
+var defaultClients = []db.ClientConfig{
+	{ID: "1", Limit: 100000},
+	{ID: "2", Limit: 80000},
+	{ID: "3", Limit: 1000000},
+	{ID: "4", Limit: 10000000},
+	{ID: "5", Limit: 500000},
+}
+
+// LoadClients inicializa os clientes do registro em path, registrando os
+// clientes de defaults se ele não existir. Os clientes criados depois são
+// gravados no mesmo registro
+func (s *storeService) LoadClients(path string, defaults []db.ClientConfig) error {
+	clients, err := db.ReadClients(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		now := time.Now()
+		clients = make([]db.ClientConfig, len(defaults))
+		for i, c := range defaults {
+			c.Created = now
+			clients[i] = c
+		}
+		err = db.WriteClients(path, clients)
+	}
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, c := range clients {
+		state, err := repository.ParseClientState(c.State)
+		if err != nil {
+			return fmt.Errorf("client %s: %w", c.ID, err)
+		}
+		err = s.initializeClient(c.ID, c.Limit, 0, state, c.Created)
+		if err != nil {
+			return fmt.Errorf("client %s: %w", c.ID, err)
+		}
+		if d, err := s.DescribeClient(c.ID); err == nil && (d.Limit != c.Limit || d.State != state) {
+			// alteração de limite ou de estado do WAL ainda fora do registro
+			changed = true
+		}
+	}
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+	s.registry = path
+	if changed {
+		return db.WriteClients(path, s.configs())
+	}
+	return nil
+}
+
+// syncRegistry regrava o registro de clientes depois de uma alteração já
+// confirmada no WAL. O limite e o estado são refeitos a partir do ledger no
+// start, então uma falha aqui só é logada
+func (s *storeService) syncRegistry() {
+	if s.registry == "" {
+		return
+	}
+	if err := db.WriteClients(s.registry, s.configs()); err != nil {
+		slog.Error("error writing client registry", "err", err)
+	}
+}
+
+// CreateClient registra o cliente e o coloca em operação. O registro é
+// gravado antes, para que o cliente continue existindo no próximo start. Um
+// diretório com dados do cliente (importação) é carregado normalmente
+func (s *storeService) CreateClient(id string, limit int64) error {
+	if _, err := db.ParseClientID(id); err != nil {
+		return repository.ErrClientNotInitialized
+	}
+	if limit < 0 {
+		return repository.ErrInvalidLimit
+	}
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+	return s.createClient(id, limit, 0)
+}
+
+// createClient cria o cliente com o saldo inicial, com createMu travado
+func (s *storeService) createClient(id string, limit, balance int64) error {
+	if _, _, ok := s.client(id); ok {
+		return repository.ErrClientExists
+	}
+	created := time.Now()
+	if s.registry != "" {
+		clients := s.configs()
+		clients = append(clients, db.ClientConfig{ID: id, Limit: limit, Created: created})
+		err := db.WriteClients(s.registry, clients)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.initializeClient(id, limit, balance, repository.StateActive, created)
+	if err != nil {
+		// o cliente não entra em operação nem fica no registro
+		if s.registry != "" {
+			if werr := db.WriteClients(s.registry, s.configs()); werr != nil {
+				slog.Error("error writing client registry", "err", werr)
+			}
+		}
+		return err
+	}
+	slog.Info("client created", "id", id, "limit", limit)
+	return nil
+}
+
+// configs retorna a configuração dos clientes em operação
+func (s *storeService) configs() []db.ClientConfig {
+	clients := make([]db.ClientConfig, 0)
+	for _, c := range s.ListClients() {
+		cfg := db.ClientConfig{ID: c.ID, Limit: c.Limit, Created: c.Created}
+		if c.State != repository.StateActive {
+			cfg.State = c.State.String()
+		}
+		clients = append(clients, cfg)
+	}
+	return clients
+}
+
+// removeClient tira de operação um cliente sem transações
+func (s *storeService) removeClient(id string) error {
+	clientLock, infos, ok := s.client(id)
+	if !ok {
+		return repository.ErrClientNotInitialized
+	}
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if infos.count > 0 {
+		return errClientHasHistory
+	}
+	infos.removed = true
+	s.mu.Lock()
+	delete(s.l, id)
+	delete(s.clientInfos, id)
+	s.mu.Unlock()
+	slog.Info("client removed", "id", id)
+	return nil
+}
+
+// DescribeClient retorna o limite, o saldo, a quantidade de transações e o
+// estado do cliente
+func (s *storeService) DescribeClient(id string) (*repository.Client, error) {
+	clientLock, infos, ok := s.client(id)
+	if !ok {
+		return nil, repository.ErrClientNotInitialized
+	}
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	return &repository.Client{
+		ID:      id,
+		Limit:   infos.limit,
+		Balance: infos.balance,
+		Count:   infos.count,
+		State:   infos.state,
+		Created: infos.created,
+	}, nil
+}
+
+// ListClients descreve os clientes em operação, ordenados pelo id
+func (s *storeService) ListClients() []repository.Client {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.clientInfos))
+	for id := range s.clientInfos {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := db.ParseClientID(ids[i])
+		b, _ := db.ParseClientID(ids[j])
+		return a < b
+	})
+	clients := make([]repository.Client, 0, len(ids))
+	for _, id := range ids {
+		c, err := s.DescribeClient(id)
+		if err == nil {
+			clients = append(clients, *c)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/repository"
+	"gopkg.in/yaml.v3"
+)
+
+// arquivo de configuração dos clientes (CLIENTS_CONFIG), em JSON ou YAML
+// (extensão .yaml ou .yml):
+//
+//	limit_policy: reject
+//	clients:
+//	  - id: "1"
+//	    limit: 100000
+//	    balance: 0
+//
+// o saldo inicial só vale para clientes sem histórico. limit_policy (reject
+// ou allow) define se um limite pode ficar abaixo do saldo negativo atual
+var (
+	errInvalidConfig    = errors.New("invalid client config")
+	errClientHasHistory = errors.New("client has history")
+)
+
+type clientsConfig struct {
+	LimitPolicy string         `json:"limit_policy" yaml:"limit_policy"`
+	Clients     []clientConfig `json:"clients" yaml:"clients"`
+}
+
+type clientConfig struct {
+	ID      string `json:"id" yaml:"id"`
+	Limit   int64  `json:"limit" yaml:"limit"`
+	Balance int64  `json:"balance" yaml:"balance"`
+}
+
+// loadClientsConfig lê e valida o arquivo de configuração
+func loadClientsConfig(path string) (*clientsConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &clientsConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidConfig, err)
+	}
+	if _, err := parseLimitPolicy(cfg.LimitPolicy); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidConfig, err)
+	}
+	seen := make(map[string]bool, len(cfg.Clients))
+	for _, c := range cfg.Clients {
+		if _, err := db.ParseClientID(c.ID); err != nil {
+			return nil, fmt.Errorf("%w: client %q", errInvalidConfig, c.ID)
+		}
+		if seen[c.ID] {
+			return nil, fmt.Errorf("%w: client %s: duplicated", errInvalidConfig, c.ID)
+		}
+		seen[c.ID] = true
+		if c.Limit < 0 {
+			return nil, fmt.Errorf("%w: client %s: negative limit", errInvalidConfig, c.ID)
+		}
+		if c.Balance < -c.Limit {
+			return nil, fmt.Errorf("%w: client %s: balance %d below limit %d", errInvalidConfig, c.ID, c.Balance, c.Limit)
+		}
+	}
+	return cfg, nil
+}
+
+// clientChange é uma diferença entre a configuração e os clientes em operação
+type clientChange struct {
+	id  string
+	op  string // added, limit ou removed
+	old int64
+	new int64
+}
+
+// ApplyConfig leva os clientes em operação ao estado da configuração:
+// cria os clientes novos, altera os limites e remove os clientes ausentes.
+// Nada é alterado se um cliente removido tiver histórico, se um limite
+// ficar abaixo do saldo contra a política ou mudar em uma conta encerrada.
+// As alterações são gravadas no registro e registradas no log
+func (s *storeService) ApplyConfig(cfg *clientsConfig) ([]clientChange, error) {
+	policy, err := parseLimitPolicy(cfg.LimitPolicy)
+	if err != nil {
+		return nil, err
+	}
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+
+	current := make(map[string]repository.Client)
+	for _, c := range s.ListClients() {
+		current[c.ID] = c
+	}
+	changes := make([]clientChange, 0)
+	for _, c := range cfg.Clients {
+		cur, ok := current[c.ID]
+		if !ok {
+			changes = append(changes, clientChange{id: c.ID, op: "added", new: c.Limit})
+			continue
+		}
+		delete(current, c.ID)
+		if cur.Limit != c.Limit {
+			if cur.State == repository.StateClosed {
+				return nil, fmt.Errorf("client %s: %w", c.ID, repository.ErrAccountClosed)
+			}
+			if policy != limitAllow && cur.Balance < -c.Limit {
+				return nil, fmt.Errorf("client %s: %w", c.ID, repository.ErrLimitBelowBalance)
+			}
+			changes = append(changes, clientChange{id: c.ID, op: "limit", old: cur.Limit, new: c.Limit})
+		}
+	}
+	for id, cur := range current {
+		if cur.Count > 0 {
+			return nil, fmt.Errorf("removing client %s: %w", id, errClientHasHistory)
+		}
+		changes = append(changes, clientChange{id: id, op: "removed", old: cur.Limit})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, _ := db.ParseClientID(changes[i].id)
+		b, _ := db.ParseClientID(changes[j].id)
+		return a < b
+	})
+
+	balances := make(map[string]int64, len(cfg.Clients))
+	for _, c := range cfg.Clients {
+		balances[c.ID] = c.Balance
+	}
+	applied := changes[:0]
+	for _, ch := range changes {
+		switch ch.op {
+		case "added":
+			err = s.createClient(ch.id, ch.new, balances[ch.id])
+		case "limit":
+			_, err = s.setLimit(ch.id, ch.new, policy, "config")
+		case "removed":
+			// o cliente pode ter recebido uma transação depois da validação
+			err = s.removeClient(ch.id)
+		}
+		if err != nil {
+			err = fmt.Errorf("client %s: %w", ch.id, err)
+			break
+		}
+		slog.Warn("client config changed", "id", ch.id, "change", ch.op, "old", ch.old, "new", ch.new)
+		applied = append(applied, ch)
+	}
+	if len(applied) > 0 && s.registry != "" {
+		if werr := db.WriteClients(s.registry, s.configs()); err == nil {
+			err = werr
+		}
+	}
+	return applied, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientsConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		return p
+	}
+
+	cfg, err := loadClientsConfig(write("clients.yaml", "clients:\n  - id: 1\n    limit: 1000\n  - id: \"2\"\n    limit: 500\n    balance: -50\n"))
+	require.NoError(t, err)
+	require.Equal(t, []clientConfig{{ID: "1", Limit: 1000}, {ID: "2", Limit: 500, Balance: -50}}, cfg.Clients)
+	cfg2, err := loadClientsConfig(write("clients.json", `{"clients":[{"id":"1","limit":1000},{"id":"2","limit":500,"balance":-50}]}`))
+	require.NoError(t, err)
+	require.Equal(t, cfg, cfg2)
+
+	for name, content := range map[string]string{
+		"a.json": `{"clients":[{"id":"x","limit":1}]}`,
+		"b.json": `{"clients":[{"id":"1","limit":-1}]}`,
+		"c.json": `{"clients":[{"id":"1","limit":1},{"id":"1","limit":2}]}`,
+		"d.json": `{"clients":[{"id":"1","limit":10,"balance":-11}]}`,
+		"e.yaml": "clients:\n  - id: 1\n    limite: 10\n",
+		"f.json": `{"limit_policy":"never","clients":[]}`,
+	} {
+		_, err := loadClientsConfig(write(name, content))
+		require.ErrorIs(t, err, errInvalidConfig, name)
+	}
+}
+
+func TestStoreApplyConfig(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	s := NewStoreService(context.Background(), dba, wal)
+	require.NoError(t, s.LoadClients(dir, nil))
+
+	changes, err := s.ApplyConfig(&clientsConfig{Clients: []clientConfig{
+		{ID: "1", Limit: 1000},
+		{ID: "2", Limit: 500, Balance: -50},
+		{ID: "3", Limit: 10},
+	}})
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	c, err := s.DescribeClient("2")
+	require.NoError(t, err)
+	require.Equal(t, int64(-50), c.Balance)
+	require.Equal(t, int64(1), c.Count)
+
+	ctx := context.Background()
+	_, _, err = s.Save(ctx, record("1", &model.Transaction{Type: "d", Description: "a", Value: 800}))
+	require.NoError(t, err)
+
+	// cliente com histórico não é removido e nada muda
+	_, err = s.ApplyConfig(&clientsConfig{Clients: []clientConfig{{ID: "1", Limit: 2000}}})
+	require.ErrorIs(t, err, errClientHasHistory)
+	c, err = s.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), c.Limit)
+
+	_, err = s.ApplyConfig(&clientsConfig{Clients: []clientConfig{
+		{ID: "1", Limit: 500},
+		{ID: "2", Limit: 500},
+		{ID: "3", Limit: 10},
+	}})
+	require.ErrorIs(t, err, repository.ErrLimitBelowBalance)
+
+	changes, err = s.ApplyConfig(&clientsConfig{LimitPolicy: "allow", Clients: []clientConfig{
+		{ID: "1", Limit: 500},
+		{ID: "2", Limit: 500, Balance: 10},
+		{ID: "4", Limit: 20},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []clientChange{
+		{id: "1", op: "limit", old: 1000, new: 500},
+		{id: "3", op: "removed", old: 10},
+		{id: "4", op: "added", new: 20},
+	}, changes)
+	_, _, err = s.Save(ctx, record("3", &model.Transaction{Type: "c", Description: "a", Value: 1}))
+	require.ErrorIs(t, err, repository.ErrClientNotInitialized)
+	_, _, err = s.Save(ctx, record("1", &model.Transaction{Type: "d", Description: "a", Value: 1}))
+	require.ErrorIs(t, err, repository.ErrLimitExceeded)
+	s.Close()
+	wal.Close()
+
+	// o registro e o saldo inicial continuam depois do restart
+	wal, err = db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s = NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.NoError(t, s.LoadClients(dir, defaultClients))
+	clients := s.ListClients()
+	require.Len(t, clients, 3)
+	require.Equal(t, repository.Client{ID: "1", Limit: 500, Balance: -800, Count: 1, State: repository.StateActive, Created: clients[0].Created}, clients[0])
+	require.Equal(t, int64(-50), clients[1].Balance)
+	require.Equal(t, "4", clients[2].ID)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+)
+
+// janela padrão das chaves de idempotência (IDEMPOTENCY_WINDOW)
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotency guarda as chaves de idempotência vistas dentro da janela
+type idempotency struct {
+	window time.Duration
+	log    *db.IdempotencyLog
+	// chaves lidas do log, por cliente, até a inicialização do cliente
+	loaded map[string][]db.IdempotencyEntry
+}
+
+// keyResult é a resposta original de uma transação com chave de idempotência
+type keyResult struct {
+	ts  int64
+	lim int64
+	bal int64
+	// done é fechado quando a gravação da transação original no WAL termina
+	done chan struct{}
+	// err é o erro da transação original quando ela não foi confirmada
+	err error
+}
+
+// confirmed é o done das chaves de transações já confirmadas
+var confirmed = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// EnableIdempotency abre o log de chaves em path e passa a responder as
+// transações com chave repetida dentro da janela com a resposta original.
+// Precisa ser chamado antes da inicialização dos clientes
+func (s *storeService) EnableIdempotency(path string, window time.Duration) error {
+	log, entries, err := db.OpenIdempotencyLog(path, time.Now().Add(-window).UnixMilli())
+	if err != nil {
+		return err
+	}
+	s.keys = &idempotency{
+		window: window,
+		log:    log,
+		loaded: make(map[string][]db.IdempotencyEntry),
+	}
+	for _, e := range entries {
+		s.keys.loaded[e.Client] = append(s.keys.loaded[e.Client], e)
+	}
+	slog.Info("idempotency keys loaded", "keys", len(entries), "window", window)
+	return nil
+}
+
+// seenKey retorna a resposta original da chave, se ela ainda está na janela.
+// Precisa do lock do cliente
+func (s *storeService) seenKey(infos *clientInfo, key string) (*keyResult, bool) {
+	if s.keys == nil || key == "" {
+		return nil, false
+	}
+	k, ok := infos.keys[key]
+	if !ok || k.ts < time.Now().Add(-s.keys.window).UnixMilli() {
+		return nil, false
+	}
+	return k, true
+}
+
+// rememberKey guarda a resposta da transação com a chave, descartando as
+// chaves do cliente que saíram da janela. A chave só vai para o log em
+// logKey, depois da confirmação da transação. Precisa do lock do cliente
+func (s *storeService) rememberKey(id string, infos *clientInfo, key string, k *keyResult) {
+	if s.keys == nil || key == "" {
+		return
+	}
+	if infos.keys == nil {
+		infos.keys = make(map[string]*keyResult)
+	}
+	since := time.Now().Add(-s.keys.window).UnixMilli()
+	for len(infos.keyOrder) > 0 {
+		old, ok := infos.keys[infos.keyOrder[0]]
+		if ok && old.ts >= since {
+			break
+		}
+		delete(infos.keys, infos.keyOrder[0])
+		infos.keyOrder = infos.keyOrder[1:]
+	}
+	if _, ok := infos.keys[key]; !ok {
+		infos.keyOrder = append(infos.keyOrder, key)
+	}
+	infos.keys[key] = k
+}
+
+// forgetKey descarta a chave de uma transação que não foi confirmada.
+// Precisa do lock do cliente
+func (s *storeService) forgetKey(infos *clientInfo, key string, k *keyResult) {
+	if infos.keys[key] != k {
+		return
+	}
+	delete(infos.keys, key)
+	for i, kk := range infos.keyOrder {
+		if kk == key {
+			infos.keyOrder = append(infos.keyOrder[:i], infos.keyOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// logKey acrescenta ao log a chave de uma transação confirmada
+func (s *storeService) logKey(id string, key string, k *keyResult) {
+	if s.keys == nil || key == "" {
+		return
+	}
+	err := s.keys.log.Append(db.IdempotencyEntry{Client: id, Key: key, Timestamp: k.ts, Limit: k.lim, Balance: k.bal})
+	if err != nil {
+		// a chave continua no metadado da transação, no WAL
+		slog.Error("error writing idempotency key", "err", err, "id", id)
+	}
+}
+
+// loadKeys coloca no cliente as chaves lidas do log
+func (s *storeService) loadKeys(id string, infos *clientInfo) {
+	if s.keys == nil {
+		return
+	}
+	infos.keys = make(map[string]*keyResult)
+	for _, e := range s.keys.loaded[id] {
+		if _, ok := infos.keys[e.Key]; !ok {
+			infos.keyOrder = append(infos.keyOrder, e.Key)
+		}
+		infos.keys[e.Key] = &keyResult{ts: e.Timestamp, lim: e.Limit, bal: e.Balance, done: confirmed}
+	}
+	delete(s.keys.loaded, id)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+// limitPolicy define o que acontece quando o novo limite fica abaixo do saldo
+// negativo atual do cliente
+type limitPolicy byte
+
+const (
+	// limitReject recusa a alteração
+	limitReject limitPolicy = 'r'
+	// limitAllow aceita a alteração; os débitos são recusados até o saldo
+	// voltar a caber no limite, os créditos continuam aceitos
+	limitAllow limitPolicy = 'a'
+)
+
+func parseLimitPolicy(s string) (limitPolicy, error) {
+	switch s {
+	case "", "reject":
+		return limitReject, nil
+	case "allow":
+		return limitAllow, nil
+	}
+	return 0, fmt.Errorf("invalid limit policy %q", s)
+}
+
+// descrição do evento de limite sem motivo informado
+const limitDescription = "limite"
+
+// SetLimit altera o limite do cliente e retorna o limite e o saldo atuais. A
+// alteração é gravada no ledger (RecordLimit) e no registro de clientes
+func (s *storeService) SetLimit(id string, limit int64, policy limitPolicy, reason string) (int64, int64, error) {
+	if limit < 0 {
+		return -1, -1, repository.ErrInvalidLimit
+	}
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+	bal, err := s.setLimit(id, limit, policy, reason)
+	if err != nil {
+		return -1, -1, err
+	}
+	s.syncRegistry()
+	return limit, bal, nil
+}
+
+// setLimit grava o evento de alteração de limite pelo mesmo caminho das
+// transações (WAL e buffer de flush), na ordem em que o limite passa a valer.
+// Assim o replay aplica a cada transação o limite da época
+func (s *storeService) setLimit(id string, limit int64, policy limitPolicy, reason string) (int64, error) {
+	if !s.Healthy() {
+		return -1, repository.ErrStoreFailure
+	}
+	clientLock, infos, ok := s.client(id)
+	if !ok {
+		return -1, repository.ErrClientNotInitialized
+	}
+	clientLock.Lock()
+	if infos.removed {
+		clientLock.Unlock()
+		return -1, repository.ErrClientNotInitialized
+	}
+	if infos.state == repository.StateClosed {
+		clientLock.Unlock()
+		return -1, repository.ErrAccountClosed
+	}
+	bal := infos.balance
+	if infos.limit == limit {
+		clientLock.Unlock()
+		return bal, nil
+	}
+	if policy != limitAllow && bal < -limit {
+		clientLock.Unlock()
+		return -1, repository.ErrLimitBelowBalance
+	}
+	if reason == "" {
+		reason = limitDescription
+	}
+	tr := &model.Transaction{
+		Type:        string(db.RecordLimit),
+		Value:       limit,
+		Description: reason,
+		Timestamp:   time.Now().UnixMilli(),
+		Metadata:    map[string]string{"previous": strconv.FormatInt(infos.limit, 10)},
+	}
+	if bal < -limit {
+		tr.Metadata["policy"] = "allow"
+	}
+	r, err := db.ToRecord(id, tr)
+	if err != nil {
+		clientLock.Unlock()
+		return -1, err
+	}
+	infos.limit = limit
+	infos.seq++
+	committed := s.wal.Append(infos.seq, r)
+	s.c <- &saveContext{
+		id:          id,
+		seq:         infos.seq,
+		transaction: tr,
+	}
+	clientLock.Unlock()
+
+	if err := <-committed; err != nil {
+		return -1, s.walFailed(id, err)
+	}
+	return bal, nil
+}
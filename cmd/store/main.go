@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/ricardovhz/rinha2/db"
 	"github.com/ricardovhz/rinha2/model"
@@ -18,17 +24,31 @@ import (
 
 type saveContext struct {
 	id          string
+	seq         uint64
 	transaction *model.Transaction
+	// pause interrompe o serviço de flush (backup)
+	pause *flushPause
 }
 
 type clientInfo struct {
-	limit            int32
-	balance          int32
-	counter          int32
+	limit   int64
+	balance int64
+	counter int32
+	// count é a quantidade de transações e seq a de registros, incluindo as
+	// alterações de limite e de estado (posição no histórico e no WAL)
+	count   int64
+	seq     uint64
+	state   repository.ClientState
+	created time.Time
+	// removed indica que o cliente saiu de operação (configuração)
+	removed bool
+	// chaves de idempotência na janela, na ordem em que foram vistas
+	keys             map[string]*keyResult
+	keyOrder         []string
 	lastTransactions []*model.Transaction
 }
 
-func (c *clientInfo) addBalance(b int32) int32 {
+func (c *clientInfo) addBalance(b int64) int64 {
 	bal := c.balance
 	c.balance += b
 	return bal
@@ -37,6 +57,60 @@ func (c *clientInfo) addBalance(b int32) int32 {
 func (c *clientInfo) addTransaction(t *model.Transaction) {
 	n := atomic.AddInt32(&c.counter, 1)
 	c.lastTransactions[n%5] = t
+	c.count++
+}
+
+// tamanho do cabeçalho da resposta: status, limite (int64) e saldo (int64)
+const responseHeaderSize = 17
+
+func putResponseHeader(resp []byte, lim, bal int64) {
+	resp[0] = '0'
+	binary.LittleEndian.PutUint64(resp[1:], uint64(lim))
+	binary.LittleEndian.PutUint64(resp[9:], uint64(bal))
+}
+
+// errorResponse converte o erro no código de erro do protocolo
+func errorResponse(err error) []byte {
+	respErr := []byte{'e', ' '}
+	switch err {
+	case repository.ErrClientNotInitialized:
+		respErr[1] = 'n'
+	case repository.ErrLimitExceeded:
+		respErr[1] = 'l'
+	case repository.ErrOverflow:
+		respErr[1] = 'o'
+	case repository.ErrClientExists:
+		respErr[1] = 'x'
+	case repository.ErrInvalidLimit:
+		respErr[1] = 'i'
+	case repository.ErrLimitBelowBalance:
+		respErr[1] = 'u'
+	case repository.ErrDebitFrozen:
+		respErr[1] = 'd'
+	case repository.ErrAccountFrozen:
+		respErr[1] = 'f'
+	case repository.ErrAccountClosed:
+		respErr[1] = 'c'
+	case repository.ErrInvalidState:
+		respErr[1] = 's'
+	case repository.ErrInvalidBackupPath:
+		respErr[1] = 'p'
+	}
+	return respErr
+}
+
+// tamanho de um cliente na listagem: id (uint32), limite, saldo, quantidade
+// de transações e criação (int64, unix millis) e estado (1 byte)
+const clientEntrySize = 4 + 8 + 8 + 8 + 8 + 1
+
+func appendClient(b []byte, c *repository.Client) []byte {
+	cid, _ := db.ParseClientID(c.ID)
+	b = binary.LittleEndian.AppendUint32(b, cid)
+	b = binary.LittleEndian.AppendUint64(b, uint64(c.Limit))
+	b = binary.LittleEndian.AppendUint64(b, uint64(c.Balance))
+	b = binary.LittleEndian.AppendUint64(b, uint64(c.Count))
+	b = binary.LittleEndian.AppendUint64(b, uint64(c.Created.UnixMilli()))
+	return append(b, byte(c.State))
 }
 
 func main() {
@@ -50,19 +124,174 @@ func main() {
 	slog.SetDefault(logger)
 
 	pathPrefix := os.Getenv("PATH_PREFIX")
-	dba := db.NewDB(db.NewFileWriterFactoryFromPath(pathPrefix), db.NewFileRegReader(pathPrefix))
+
+	// engine de armazenamento: "file" (chunks, padrão) ou "sqlite"
+	engine := os.Getenv("STORAGE_ENGINE")
+	if engine == "" {
+		engine = "file"
+	}
+	if engine != "file" && engine != "sqlite" {
+		panic("invalid STORAGE_ENGINE: " + engine)
+	}
+
+	// criptografia dos chunks (ENCRYPTION_KEY_FILE ou ENCRYPTION_KEYS)
+	keys, err := db.KeyringFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	if keys != nil {
+		db.SetKeyring(keys)
+		slog.Info("chunk encryption enabled", "key", keys.Active())
+	}
+
+	// trunca chunks corrompidos antes de carregar os clientes
+	if engine == "file" && os.Getenv("RECOVERY_MODE") == "true" {
+		res, err := db.RecoverAll(pathPrefix)
+		if err != nil {
+			panic(err)
+		}
+		for id, reports := range res {
+			for _, rep := range reports {
+				slog.Warn("chunk recovered", "id", id, "chunk", rep.Chunk, "kept", rep.Kept, "dropped", len(rep.Dropped), "trailing", rep.Trailing, "err", rep.Err)
+				for _, r := range rep.Dropped {
+					_, tr := db.ToTransaction(r)
+					slog.Warn("dropped record", "id", id, "chunk", rep.Chunk, "type", tr.Type, "value", tr.Value, "timestamp", tr.Timestamp, "description", tr.Description)
+				}
+			}
+		}
+	}
+	var dba *db.DB
+	if engine == "sqlite" {
+		sqlitePath := os.Getenv("SQLITE_PATH")
+		if sqlitePath == "" {
+			sqlitePath = filepath.Join(pathPrefix, "ledger.db")
+		}
+		e, err := db.OpenSQLite(sqlitePath)
+		if err != nil {
+			panic(err)
+		}
+		defer e.Close()
+		dba = db.NewDB(e, e)
+	} else {
+		dba = db.NewDB(db.NewFileWriterFactoryFromPath(pathPrefix), db.NewFileRegReaderWithArchive(pathPrefix, os.Getenv("ARCHIVE_PATH")))
+	}
+
+	// restaura um backup antes de carregar os clientes. As entradas do WAL
+	// são posteriores ao backup e são descartadas; as chaves de idempotência
+	// dos clientes restaurados voltam às do backup
+	if src := os.Getenv("RESTORE_FROM"); src != "" {
+		info, err := db.RestoreBackup(src, pathPrefix)
+		if err != nil {
+			panic(err)
+		}
+		err = os.RemoveAll(filepath.Join(pathPrefix, "wal"))
+		if err != nil {
+			panic(err)
+		}
+		slog.Warn("backup restored", "src", src, "created", info.Created, "clients", len(info.Clients))
+	}
+
+	wal, err := db.OpenWAL(filepath.Join(pathPrefix, "wal"))
+	if err != nil {
+		panic(err)
+	}
+	defer wal.Close()
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
-	serv := NewStoreService(ctx, dba)
+	serv := NewStoreService(ctx, dba, wal)
 	defer serv.Close()
 
-	serv.InitializeClient("1", 100000, 0)
-	serv.InitializeClient("2", 80000, 0)
-	serv.InitializeClient("3", 1000000, 0)
-	serv.InitializeClient("4", 10000000, 0)
-	serv.InitializeClient("5", 500000, 0)
+	// clientes do registro (PATH_PREFIX/CLIENTS), criado com os clientes
+	// padrão na primeira execução. Com CLIENTS_CONFIG, o arquivo é aplicado
+	// sobre o registro no start e a cada SIGHUP
+	cfgPath := os.Getenv("CLIENTS_CONFIG")
+	defaults := defaultClients
+	var cfg *clientsConfig
+	if cfgPath != "" {
+		cfg, err = loadClientsConfig(cfgPath)
+		if err != nil {
+			panic(err)
+		}
+		defaults = nil
+	}
+	// os backups pedidos pelo protocolo ficam em diretórios dentro de
+	// BACKUP_PATH. Sem ele, o backup pelo protocolo fica desabilitado
+	backupRoot := os.Getenv("BACKUP_PATH")
+
+	// chaves de idempotência (PATH_PREFIX/IDEMPOTENCY), lembradas pela
+	// janela de IDEMPOTENCY_WINDOW (0 desativa)
+	idempotencyWindow := defaultIdempotencyWindow
+	if v := os.Getenv("IDEMPOTENCY_WINDOW"); v != "" {
+		idempotencyWindow, err = time.ParseDuration(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if idempotencyWindow > 0 {
+		err = serv.EnableIdempotency(pathPrefix, idempotencyWindow)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = serv.LoadClients(pathPrefix, defaults)
+	if err != nil {
+		panic(err)
+	}
+	if cfg != nil {
+		_, err = serv.ApplyConfig(cfg)
+		if err != nil {
+			panic(err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				cfg, err := loadClientsConfig(cfgPath)
+				if err != nil {
+					slog.Error("invalid client config", "err", err, "path", cfgPath)
+					continue
+				}
+				changes, err := serv.ApplyConfig(cfg)
+				if err != nil {
+					slog.Error("error applying client config", "err", err, "path", cfgPath, "applied", len(changes))
+					continue
+				}
+				slog.Warn("client config reloaded", "path", cfgPath, "changes", len(changes))
+			}
+		}()
+	}
+
+	// compactação dos chunks antigos em segmentos, depois da quarentena
+	// feita na inicialização dos clientes
+	compactionInterval := time.Minute
+	if v := os.Getenv("COMPACTION_INTERVAL"); v != "" {
+		compactionInterval, err = time.ParseDuration(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if engine == "file" && compactionInterval > 0 {
+		go db.NewCompactor(pathPrefix).Run(ctx, compactionInterval)
+	}
+
+	// retenção: chunks mais antigos que RETENTION_AGE vão para ARCHIVE_PATH
+	// (padrão PATH_PREFIX/archive), deixando o saldo transportado
+	if v := os.Getenv("RETENTION_AGE"); engine == "file" && v != "" {
+		age, err := time.ParseDuration(v)
+		if err != nil {
+			panic(err)
+		}
+		retentionInterval := time.Hour
+		if v := os.Getenv("RETENTION_INTERVAL"); v != "" {
+			retentionInterval, err = time.ParseDuration(v)
+			if err != nil {
+				panic(err)
+			}
+		}
+		go db.NewArchiver(pathPrefix, os.Getenv("ARCHIVE_PATH"), age).Run(ctx, retentionInterval)
+	}
 
 	typ := os.Getenv("STORE_CONN_TYPE")
 	if typ == "" {
@@ -108,63 +337,200 @@ func main() {
 		slog.Info("accepted", "conn", conn.RemoteAddr())
 		conns = append(conns, conn)
 		go func() {
+			rd := bufio.NewReader(conn)
+			b := make([]byte, 15)
 			for {
-				b := make([]byte, 25)
-				i, err := conn.Read(b)
+				_, err := io.ReadFull(rd, b[:1])
 				if err != nil {
 					return
 				}
-				switch i {
-				case 2:
+				switch b[0] {
+				case '0':
 					// extract
-					id := string(b[1])
+					_, err = io.ReadFull(rd, b[1:5])
+					if err != nil {
+						return
+					}
+					id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[1:5])), 10)
 					lim, bal, tr, err := serv.GetExtract(ctx, id)
 					if err != nil {
 						slog.Debug("error getting extract", "err", err, "id", id)
-						respErr := [2]byte{'e', ' '}
-						if err == repository.ErrClientNotInitialized {
-							respErr[1] = 'n'
-						} else if err == repository.ErrLimitExceeded {
-							respErr[1] = 'l'
-						}
-						conn.Write(respErr[:])
+						conn.Write(errorResponse(err))
 						continue
 					}
-					resp := make([]byte, 9+db.RecordSize*len(tr))
-					resp[0] = '0'
-					binary.LittleEndian.PutUint32(resp[1:], uint32(lim))
-					binary.LittleEndian.PutUint32(resp[5:], uint32(bal))
-					for j, t := range tr {
-						re := db.ToRecord(id, t)
-						copy(resp[9+j*db.RecordSize:], re[:])
+					resp := make([]byte, responseHeaderSize, responseHeaderSize+1+64*len(tr))
+					putResponseHeader(resp, lim, bal)
+					resp = append(resp, byte(len(tr)))
+					for _, t := range tr {
+						resp, err = db.AppendRecord(resp, id, t)
+						if err != nil {
+							break
+						}
+					}
+					if err != nil {
+						slog.Error("error encoding extract", "err", err, "id", id)
+						conn.Write(errorResponse(err))
+						continue
 					}
 					conn.Write(resp)
-				case 25:
+				case '1':
 					// save
-					r := db.Record(b[1:])
+					// registro com checksum inválido ainda mantém o framing
+					r, err := db.ReadRecord(rd)
+					if err != nil && !errors.Is(err, db.ErrChecksum) {
+						slog.Error("invalid record", "err", err)
+						conn.Close()
+						return
+					}
 					lim, bal, err := serv.Save(ctx, r)
 					if err != nil {
 						slog.Debug("error saving transaction", "err", err)
-						respErr := [2]byte{'e', ' '}
-						if err == repository.ErrClientNotInitialized {
-							respErr[1] = 'n'
-						} else if err == repository.ErrLimitExceeded {
-							respErr[1] = 'l'
-						}
-						conn.Write(respErr[:])
+						conn.Write(errorResponse(err))
 						continue
 					}
 
-					resp := make([]byte, 9)
-					resp[0] = '0'
-					binary.LittleEndian.PutUint32(resp[1:], uint32(lim))
-					binary.LittleEndian.PutUint32(resp[5:], uint32(bal))
+					resp := make([]byte, responseHeaderSize)
+					putResponseHeader(resp, lim, bal)
 					_, err = conn.Write(resp)
 					if err != nil {
-						panic(err)
+						slog.Error("error writing response", "err", err)
+						conn.Close()
+						return
+					}
+				case '2':
+					// backup: tamanho (uint16) e diretório de destino
+					_, err = io.ReadFull(rd, b[1:3])
+					if err != nil {
+						return
+					}
+					dst := make([]byte, binary.LittleEndian.Uint16(b[1:3]))
+					_, err = io.ReadFull(rd, dst)
+					if err != nil {
+						return
+					}
+					var path string
+					path, err = backupPath(backupRoot, string(dst))
+					if err == nil {
+						_, err = serv.Backup(path)
+					}
+					if err != nil {
+						slog.Error("error creating backup", "err", err, "dst", string(dst))
+						conn.Write(errorResponse(err))
+						continue
+					}
+					conn.Write(make([]byte, responseHeaderSize))
+				case '3':
+					// saldo em um instante: id (uint32) e timestamp (int64, unix millis)
+					_, err = io.ReadFull(rd, b[1:13])
+					if err != nil {
+						return
+					}
+					id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[1:5])), 10)
+					ts := int64(binary.LittleEndian.Uint64(b[5:13]))
+					lim, bal, err := serv.BalanceAt(ctx, id, ts)
+					if err != nil {
+						slog.Debug("error getting balance", "err", err, "id", id, "ts", ts)
+						conn.Write(errorResponse(err))
+						continue
 					}
+					resp := make([]byte, responseHeaderSize)
+					putResponseHeader(resp, lim, bal)
+					conn.Write(resp)
+				case '4':
+					// criação de cliente: id (uint32) e limite (int64)
+					_, err = io.ReadFull(rd, b[1:13])
+					if err != nil {
+						return
+					}
+					id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[1:5])), 10)
+					lim := int64(binary.LittleEndian.Uint64(b[5:13]))
+					err = serv.CreateClient(id, lim)
+					if err != nil {
+						slog.Error("error creating client", "err", err, "id", id)
+						conn.Write(errorResponse(err))
+						continue
+					}
+					resp := make([]byte, responseHeaderSize)
+					putResponseHeader(resp, lim, 0)
+					conn.Write(resp)
+				case '5':
+					// listagem dos clientes: quantidade (uint32) e os clientes
+					clients := serv.ListClients()
+					resp := make([]byte, responseHeaderSize, responseHeaderSize+4+clientEntrySize*len(clients))
+					putResponseHeader(resp, 0, 0)
+					resp = binary.LittleEndian.AppendUint32(resp, uint32(len(clients)))
+					for i := range clients {
+						resp = appendClient(resp, &clients[i])
+					}
+					conn.Write(resp)
+				case '6':
+					// descrição do cliente: id (uint32)
+					_, err = io.ReadFull(rd, b[1:5])
+					if err != nil {
+						return
+					}
+					id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[1:5])), 10)
+					c, err := serv.DescribeClient(id)
+					if err != nil {
+						conn.Write(errorResponse(err))
+						continue
+					}
+					resp := make([]byte, responseHeaderSize, responseHeaderSize+clientEntrySize)
+					putResponseHeader(resp, c.Limit, c.Balance)
+					conn.Write(appendClient(resp, c))
+				case '7':
+					// alteração de limite: id (uint32), limite (int64), política
+					// ('r' ou 'a') e motivo (tamanho em 1 byte)
+					_, err = io.ReadFull(rd, b[1:15])
+					if err != nil {
+						return
+					}
+					id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[1:5])), 10)
+					lim := int64(binary.LittleEndian.Uint64(b[5:13]))
+					policy := limitPolicy(b[13])
+					reason := make([]byte, b[14])
+					_, err = io.ReadFull(rd, reason)
+					if err != nil {
+						return
+					}
+					if policy != limitAllow {
+						policy = limitReject
+					}
+					lim, bal, err := serv.SetLimit(id, lim, policy, string(reason))
+					if err != nil {
+						slog.Debug("error setting limit", "err", err, "id", id)
+						conn.Write(errorResponse(err))
+						continue
+					}
+					resp := make([]byte, responseHeaderSize)
+					putResponseHeader(resp, lim, bal)
+					conn.Write(resp)
+				case '8':
+					// alteração de estado: id (uint32), estado e motivo
+					// (tamanho em 1 byte)
+					_, err = io.ReadFull(rd, b[1:7])
+					if err != nil {
+						return
+					}
+					id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[1:5])), 10)
+					state := repository.ClientState(b[5])
+					reason := make([]byte, b[6])
+					_, err = io.ReadFull(rd, reason)
+					if err != nil {
+						return
+					}
+					err = serv.SetState(id, state, string(reason))
+					if err != nil {
+						slog.Debug("error setting state", "err", err, "id", id)
+						conn.Write(errorResponse(err))
+						continue
+					}
+					conn.Write(make([]byte, responseHeaderSize))
 				default:
-					slog.Error("invalid message", "b", b)
+					// framing perdido, não há como continuar nesta conexão
+					slog.Error("invalid message", "b", b[:1])
+					conn.Close()
+					return
 				}
 			}
 		}()
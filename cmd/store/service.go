@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ricardovhz/rinha2/db"
@@ -12,27 +17,109 @@ import (
 	"github.com/ricardovhz/rinha2/repository"
 )
 
+// quantidade de flushes de um cliente entre dois checkpoints de saldo
+const checkpointInterval = 10
+
 type storeService struct {
-	db *db.DB
+	db  *db.DB
+	wal *db.WAL
 
+	// mu protege l e clientInfos, que recebem os clientes criados em execução
+	mu          sync.RWMutex
 	l           map[string]*sync.Mutex
 	clientInfos map[string]*clientInfo
 
-	c    chan *saveContext
-	wg   *sync.WaitGroup
-	ctx  context.Context
-	once *sync.Once
-	buf  map[string][]*saveContext
+	// registry é o diretório do registro de clientes (LoadClients). createMu
+	// serializa as criações e a gravação do registro
+	registry string
+	createMu sync.Mutex
+
+	c       chan *saveContext
+	wg      *sync.WaitGroup
+	ctx     context.Context
+	once    *sync.Once
+	buf     map[string][]*saveContext
+	flushes map[string]int
+
+	backupMu sync.Mutex
+
+	// keys é nil sem idempotência (EnableIdempotency)
+	keys *idempotency
+
+	// unhealthy é ligado por um erro do WAL (walFailed)
+	unhealthy atomic.Bool
+}
+
+// walFailed marca o store como não saudável depois de um erro do WAL. O estado
+// em memória já contém a alteração não confirmada, então as próximas gravações
+// são recusadas até o restart, que reconstrói o estado pelo replay
+func (s *storeService) walFailed(id string, err error) error {
+	s.unhealthy.Store(true)
+	slog.Error("error writing to wal, store unhealthy until restart", "err", err, "id", id)
+	return fmt.Errorf("%w: wal: %w", repository.ErrStoreFailure, err)
 }
 
-func (s *storeService) flush(id string) {
+// Healthy indica se o store ainda aceita gravações
+func (s *storeService) Healthy() bool {
+	return !s.unhealthy.Load()
+}
+
+// flush grava o buffer do cliente nos chunks e libera o WAL. Se a gravação
+// falhar o buffer é mantido para a próxima tentativa e o WAL continua com os
+// registros, que são reaplicados no próximo start
+func (s *storeService) flush(id string) error {
 	tr := make([]*model.Transaction, len(s.buf[id]))
 	for i, sc := range s.buf[id] {
 		tr[i] = sc.transaction
 	}
 	err := s.db.Write(id, tr)
 	if err != nil {
-		slog.Error("error writing to db", "err", err, "id", id)
+		return fmt.Errorf("writing to db: %w", err)
+	}
+
+	// as chaves de idempotência precisam estar em disco antes da liberação
+	// do WAL, que também as guarda
+	if s.keys != nil {
+		err = s.keys.log.Sync()
+		if err != nil {
+			return fmt.Errorf("writing idempotency keys: %w", err)
+		}
+	}
+
+	// registros já estão nos chunks, o WAL pode ser liberado
+	cid, _ := db.ParseClientID(id)
+	s.wal.MarkFlushed(cid, s.buf[id][len(tr)-1].seq)
+	s.buf[id] = make([]*saveContext, 0)
+
+	s.flushes[id]++
+	if s.flushes[id]%checkpointInterval == 0 {
+		s.checkpoint(id)
+	}
+	return nil
+}
+
+// flushAll grava os buffers de todos os clientes, retornando o primeiro erro
+func (s *storeService) flushAll() error {
+	var first error
+	for id, b := range s.buf {
+		if len(b) == 0 {
+			continue
+		}
+		err := s.flush(id)
+		if err != nil {
+			slog.Error("error flushing", "err", err, "id", id, "pending", len(b))
+			if first == nil {
+				first = fmt.Errorf("%s: %w", id, err)
+			}
+		}
+	}
+	return first
+}
+
+func (s *storeService) checkpoint(id string) {
+	err := s.db.Checkpoint(id)
+	if err != nil {
+		slog.Error("error writing checkpoint", "err", err, "id", id)
 	}
 }
 
@@ -43,36 +130,65 @@ func (s *storeService) start() {
 	go func(ca chan *saveContext) {
 		defer s.wg.Done()
 		for t := range ca {
+			if t.pause != nil {
+				t.pause.err = s.flushAll()
+				close(t.pause.flushed)
+				<-t.pause.resume
+				continue
+			}
 			id := t.id
-			b := s.buf[t.id]
-			s.buf[id] = append(b, t)
-			if len(s.buf[id]) == 100 {
-				s.flush(id)
-				s.buf[id] = make([]*saveContext, 0)
+			s.buf[id] = append(s.buf[id], t)
+			// depois de uma falha, cada nova transação tenta de novo
+			if len(s.buf[id]) >= 100 {
+				err := s.flush(id)
+				if err != nil {
+					slog.Error("error flushing", "err", err, "id", id, "pending", len(s.buf[id]))
+				}
 			}
 		}
 		slog.Debug("closing")
-		for id := range s.clientInfos {
-			if len(s.buf[id]) > 0 {
-				s.flush(id)
+		if err := s.flushAll(); err != nil {
+			slog.Error("transactions kept in wal", "err", err)
+		}
+		for id, n := range s.flushes {
+			if n > 0 {
+				s.checkpoint(id)
 			}
 		}
 	}(s.c)
 }
 
+// client retorna o lock e o estado do cliente
+func (s *storeService) client(id string) (*sync.Mutex, *clientInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos, ok := s.clientInfos[id]
+	return s.l[id], infos, ok
+}
+
 func (s *storeService) Close() {
 	close(s.c)
 	s.wg.Wait()
+	if s.keys != nil {
+		err := s.keys.log.Close()
+		if err != nil {
+			slog.Error("error closing idempotency keys", "err", err)
+		}
+	}
 }
 
-func (s *storeService) Save(ctx context.Context, r db.Record) (int32, int32, error) {
+func (s *storeService) Save(ctx context.Context, r db.Record) (int64, int64, error) {
 	// validate
+	if !r.Valid() {
+		return -1, -1, db.ErrChecksum
+	}
+	if !s.Healthy() {
+		return -1, -1, repository.ErrStoreFailure
+	}
 	id, tr := db.ToTransaction(r)
-	var clientLock *sync.Mutex
-	if cl, ok := s.l[id]; !ok {
+	clientLock, infos, ok := s.client(id)
+	if !ok {
 		return -1, -1, repository.ErrClientNotInitialized
-	} else {
-		clientLock = cl
 	}
 
 	t1 := time.Now()
@@ -84,8 +200,24 @@ func (s *storeService) Save(ctx context.Context, r db.Record) (int32, int32, err
 	}()
 
 	clientLock.Lock()
-
-	infos := s.clientInfos[id]
+	if infos.removed {
+		clientLock.Unlock()
+		return -1, -1, repository.ErrClientNotInitialized
+	}
+	// transação repetida: responde como a original, depois da confirmação dela
+	key := tr.Metadata[model.IdempotencyKey]
+	if k, ok := s.seenKey(infos, key); ok {
+		clientLock.Unlock()
+		<-k.done
+		if k.err != nil {
+			return -1, -1, k.err
+		}
+		return k.lim, k.bal, nil
+	}
+	if err := infos.state.TransactionError(tr.Type); err != nil {
+		clientLock.Unlock()
+		return -1, -1, err
+	}
 
 	lim := infos.limit
 	bal := infos.balance
@@ -93,19 +225,20 @@ func (s *storeService) Save(ctx context.Context, r db.Record) (int32, int32, err
 	nowTime := time.Now().Format(time.RFC3339Nano)
 	tr.Date = nowTime
 
-	val := tr.Value
-	if tr.Type == "d" {
-		val *= -1
-	}
+	val := tr.GetValue()
 
 	for {
-		if tr.Type == "d" && (bal+int32(val)) < lim*-1 {
+		next, ok := model.AddAmount(bal, val)
+		if !ok {
+			clientLock.Unlock()
+			return -1, -1, repository.ErrOverflow
+		}
+		if tr.Type == "d" && next < lim*-1 {
 			clientLock.Unlock()
 			return -1, -1, repository.ErrLimitExceeded
 		}
 
-		if bal != infos.addBalance(int32(val)) {
-			infos := s.clientInfos[id]
+		if bal != infos.addBalance(val) {
 			bal = infos.balance
 			continue
 		} else {
@@ -114,33 +247,61 @@ func (s *storeService) Save(ctx context.Context, r db.Record) (int32, int32, err
 		}
 	}
 
-	clientLock.Unlock()
+	var k *keyResult
+	if s.keys != nil && key != "" {
+		k = &keyResult{ts: time.Now().UnixMilli(), lim: lim, bal: bal + val, done: make(chan struct{})}
+		s.rememberKey(id, infos, key, k)
+	}
 
+	// a ordem no WAL e no buffer de flush precisa ser a mesma da aplicação do saldo
+	infos.seq++
+	committed := s.wal.Append(infos.seq, r)
 	s.c <- &saveContext{
 		id:          id,
+		seq:         infos.seq,
 		transaction: tr,
 	}
-	return lim, bal + int32(val), nil
+
+	clientLock.Unlock()
+
+	// só confirma a transação depois do fsync do WAL
+	if err := <-committed; err != nil {
+		// o saldo em memória já foi alterado e não há como desfazer com
+		// segurança. o replay do WAL reconstrói o estado no próximo start
+		err = s.walFailed(id, err)
+		if k != nil {
+			// a chave não fica reservada para uma gravação que não ocorreu
+			clientLock.Lock()
+			s.forgetKey(infos, key, k)
+			clientLock.Unlock()
+			k.err = err
+			close(k.done)
+		}
+		return -1, -1, err
+	}
+	if k != nil {
+		s.logKey(id, key, k)
+		close(k.done)
+	}
+	return lim, bal + val, nil
 }
 
-func (s *storeService) GetExtract(ctx context.Context, id string) (int32, int32, []*model.Transaction, error) {
-	var infos *clientInfo
-	if l, ok := s.clientInfos[id]; !ok {
+func (s *storeService) GetExtract(ctx context.Context, id string) (int64, int64, []*model.Transaction, error) {
+	clientLock, infos, ok := s.client(id)
+	if !ok {
 		return -1, -1, nil, repository.ErrClientNotInitialized
-	} else {
-		infos = l
 	}
+	res := make([]*model.Transaction, 0, len(infos.lastTransactions))
+
+	clientLock.Lock()
 	lim := infos.limit
 	bal := infos.balance
-
-	res := make([]*model.Transaction, 0)
-
-	lt := infos.lastTransactions
-	for _, t := range lt {
+	for _, t := range infos.lastTransactions {
 		if t != nil {
 			res = append(res, t)
 		}
 	}
+	clientLock.Unlock()
 	sort.SliceStable(res, func(i, j int) bool {
 		return res[j].Date < res[i].Date
 	})
@@ -148,52 +309,209 @@ func (s *storeService) GetExtract(ctx context.Context, id string) (int32, int32,
 	return lim, bal, res, nil
 }
 
-func (s *storeService) InitializeClient(id string, limit int32, balance int32) {
+// BalanceAt retorna o limite e o saldo do cliente no instante ts (unix
+// millis). Os buffers de flush são gravados antes, para que as transações já
+// confirmadas estejam nos chunks
+func (s *storeService) BalanceAt(ctx context.Context, id string, ts int64) (int64, int64, error) {
+	clientLock, infos, ok := s.client(id)
+	if !ok {
+		return -1, -1, repository.ErrClientNotInitialized
+	}
+	clientLock.Lock()
+	lim := infos.limit
+	clientLock.Unlock()
+
+	p := &flushPause{flushed: make(chan struct{}), resume: make(chan struct{})}
+	s.c <- &saveContext{pause: p}
+	<-p.flushed
+	close(p.resume)
+	if p.err != nil {
+		return -1, -1, p.err
+	}
+
+	bal, err := s.db.BalanceAt(id, ts)
+	if errors.Is(err, db.ErrOverflow) {
+		return -1, -1, repository.ErrOverflow
+	}
+	if err != nil {
+		return -1, -1, err
+	}
+	return lim, bal, nil
+}
+
+func (s *storeService) InitializeClient(id string, limit int64, balance int64) error {
+	return s.initializeClient(id, limit, balance, repository.StateActive, time.Now())
+}
+
+// initializeClient carrega o estado do cliente a partir dos chunks e do WAL e
+// só então o coloca em operação. limit e state (registro de clientes) só valem
+// quando o ledger não tem alterações de limite ou de estado. Um erro de leitura deixa o cliente fora de
+// operação: com saldo ou sequência errados o replay do WAL reaplicaria
+// registros já gravados
+func (s *storeService) initializeClient(id string, limit int64, balance int64, state repository.ClientState, created time.Time) error {
 	var (
-		tr  []*model.Transaction
-		bal int32 = balance
+		tr      []*model.Transaction
+		bal     int64 = balance
+		count   int64
+		records int64
 	)
 
-	s.l[id] = &sync.Mutex{}
-	s.buf[id] = make([]*saveContext, 0)
+	cid, err := db.ParseClientID(id)
+	if err != nil {
+		return err
+	}
+
 	t1 := time.Now()
+	moved, err := s.db.Quarantine(id)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("error checking manifest", "err", err, "id", id)
+	} else if len(moved) > 0 {
+		slog.Warn("files moved to quarantine", "id", id, "files", moved)
+	}
 	rtr, err := s.db.ReadLast(id)
-	if err != nil {
-		tr = make([]*model.Transaction, 5)
-	} else {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("reading last transactions: %w", err)
+	}
+	if err == nil {
 		tr = rtr
 
 		// existe registro de transações
-		// carregando saldo
-		bal, err = s.db.ReadBalance(id)
-
+		// carregando saldo e quantidades em uma única leitura
+		sum, err := s.db.ReadSummary(id)
+		if errors.Is(err, db.ErrChecksum) {
+			return fmt.Errorf("corrupted chunk, restart with RECOVERY_MODE=true: %w", err)
+		}
 		if err != nil {
-			slog.Error("error reading balance", "err", err, "id", id)
+			return fmt.Errorf("reading summary: %w", err)
+		}
+		bal, count, records = sum.Balance, sum.Count, sum.Records
+		// limite e estado vêm do ledger; o registro de clientes é só um cache
+		if sum.HasLimit {
+			limit = sum.Limit
+		}
+		if sum.State != "" {
+			state, err = repository.ParseClientState(sum.State)
+			if err != nil {
+				return fmt.Errorf("reading state: %w", err)
+			}
 		}
 	}
-	s.clientInfos[id] = &clientInfo{
+
+	infos := &clientInfo{
 		limit:            limit,
 		balance:          bal,
-		counter:          0,
-		lastTransactions: tr,
+		counter:          int32(len(tr)) - 1,
+		count:            count,
+		seq:              uint64(records),
+		state:            state,
+		created:          created,
+		lastTransactions: make([]*model.Transaction, 5),
+	}
+	// ReadLast retorna da mais recente para a mais antiga, o anel guarda a
+	// mais antiga primeiro para ser a próxima sobrescrita
+	for i, t := range tr {
+		t.Date = time.UnixMilli(t.Timestamp).Format(time.RFC3339Nano)
+		infos.lastTransactions[len(tr)-1-i] = t
+	}
+	s.wal.MarkFlushed(cid, infos.seq)
+	s.loadKeys(id, infos)
+
+	// reaplica as transações confirmadas que ainda não chegaram aos chunks
+	replayed := 0
+	err = s.wal.Replay(cid, infos.seq, func(seq uint64, r db.Record) error {
+		_, t := db.ToTransaction(r)
+		t.Date = time.UnixMilli(t.Timestamp).Format(time.RFC3339Nano)
+		switch r.Type() {
+		case db.RecordLimit:
+			infos.limit = t.Value
+		case db.RecordState:
+			if st, err := repository.ParseClientState(t.Metadata["state"]); err == nil {
+				infos.state = st
+			}
+		default:
+			infos.addBalance(r.Value())
+			infos.addTransaction(t)
+			// chave ainda fora do log de idempotência
+			if key := t.Metadata[model.IdempotencyKey]; key != "" {
+				if _, ok := infos.keys[key]; !ok {
+					k := &keyResult{ts: t.Timestamp, lim: infos.limit, bal: infos.balance, done: confirmed}
+					s.rememberKey(id, infos, key, k)
+					s.logKey(id, key, k)
+				}
+			}
+		}
+		infos.seq = seq
+		s.c <- &saveContext{
+			id:          id,
+			seq:         seq,
+			transaction: t,
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("replaying wal: %w", err)
+	}
+
+	// o saldo inicial de um cliente sem histórico é gravado como a primeira
+	// transação, senão seria perdido no próximo start
+	if infos.seq == 0 && balance != 0 && balance != math.MinInt64 {
+		err = s.open(id, infos, balance)
+		if err != nil {
+			return fmt.Errorf("writing to wal: %w", err)
+		}
 	}
 
-	slog.Info("client initialized", "id", id, "limit", limit, "balance", bal, "time", time.Since(t1).Milliseconds())
+	s.mu.Lock()
+	s.l[id] = &sync.Mutex{}
+	s.clientInfos[id] = infos
+	s.mu.Unlock()
+
+	slog.Info("client initialized", "id", id, "limit", limit, "state", infos.state, "balance", infos.balance, "replayed", replayed, "time", time.Since(t1).Milliseconds())
+	return nil
+}
+
+// descrição da transação com o saldo inicial do cliente
+const openingDescription = "saldo inicial"
+
+// open grava a transação de abertura com o saldo inicial, já aplicado ao
+// estado do cliente
+func (s *storeService) open(id string, infos *clientInfo, balance int64) error {
+	tr := &model.Transaction{Type: "c", Value: balance, Description: openingDescription, Timestamp: time.Now().UnixMilli()}
+	if balance < 0 {
+		tr.Type, tr.Value = "d", -balance
+	}
+	r, err := db.ToRecord(id, tr)
+	if err != nil {
+		return err
+	}
+	tr.Date = time.UnixMilli(tr.Timestamp).Format(time.RFC3339Nano)
+	infos.addTransaction(tr)
+	infos.seq++
+	committed := s.wal.Append(infos.seq, r)
+	s.c <- &saveContext{
+		id:          id,
+		seq:         infos.seq,
+		transaction: tr,
+	}
+	return <-committed
 }
 
-func NewStoreService(ctx context.Context, db *db.DB) *storeService {
-	c := make(chan *saveContext)
+func NewStoreService(ctx context.Context, db *db.DB, wal *db.WAL) *storeService {
+	c := make(chan *saveContext, 1000)
 	s := &storeService{
-		db: db,
+		db:  db,
+		wal: wal,
 
 		l:           make(map[string]*sync.Mutex),
 		clientInfos: make(map[string]*clientInfo),
 
-		c:    c,
-		wg:   &sync.WaitGroup{},
-		ctx:  ctx,
-		once: &sync.Once{},
-		buf:  make(map[string][]*saveContext),
+		c:       c,
+		wg:      &sync.WaitGroup{},
+		ctx:     ctx,
+		once:    &sync.Once{},
+		buf:     make(map[string][]*saveContext),
+		flushes: make(map[string]int),
 	}
 	s.start()
 	return s
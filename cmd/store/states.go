@@ -0,0 +1,82 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+// descrição do evento de estado sem motivo informado
+const stateDescription = "estado"
+
+// SetState altera o estado da conta do cliente. A alteração é gravada no
+// ledger (RecordState) e no registro de clientes. Uma conta encerrada não
+// muda mais de estado
+func (s *storeService) SetState(id string, state repository.ClientState, reason string) error {
+	if !state.Valid() {
+		return repository.ErrInvalidState
+	}
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+	err := s.setState(id, state, reason)
+	if err != nil {
+		return err
+	}
+	s.syncRegistry()
+	return nil
+}
+
+// setState grava o evento de alteração de estado pelo mesmo caminho das
+// transações, como setLimit
+func (s *storeService) setState(id string, state repository.ClientState, reason string) error {
+	if !s.Healthy() {
+		return repository.ErrStoreFailure
+	}
+	clientLock, infos, ok := s.client(id)
+	if !ok {
+		return repository.ErrClientNotInitialized
+	}
+	clientLock.Lock()
+	if infos.removed {
+		clientLock.Unlock()
+		return repository.ErrClientNotInitialized
+	}
+	if infos.state == state {
+		clientLock.Unlock()
+		return nil
+	}
+	if infos.state == repository.StateClosed {
+		clientLock.Unlock()
+		return repository.ErrAccountClosed
+	}
+	if reason == "" {
+		reason = stateDescription
+	}
+	tr := &model.Transaction{
+		Type:        string(db.RecordState),
+		Description: reason,
+		Timestamp:   time.Now().UnixMilli(),
+		Metadata:    map[string]string{"state": state.String(), "previous": infos.state.String()},
+	}
+	r, err := db.ToRecord(id, tr)
+	if err != nil {
+		clientLock.Unlock()
+		return err
+	}
+	infos.state = state
+	infos.seq++
+	committed := s.wal.Append(infos.seq, r)
+	s.c <- &saveContext{
+		id:          id,
+		seq:         infos.seq,
+		transaction: tr,
+	}
+	clientLock.Unlock()
+
+	if err := <-committed; err != nil {
+		return s.walFailed(id, err)
+	}
+	return nil
+}
@@ -2,15 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/ricardovhz/rinha2/db"
 	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,41 +27,268 @@ func TestStore(t *testing.T) {
 		Level: slog.LevelDebug,
 	})))
 
-	dba := db.NewDB(db.NewFileWriterFactoryFromPath("./"), nil)
-	s := NewStoreService(context.Background(), dba)
+	t.Parallel()
+	dir := t.TempDir()
+	e := db.NewMemoryEngine()
+	dba := db.NewDB(e, e)
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
 	defer s.Close()
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
-	s.InitializeClient("1", 100000, 0)
+	require.NoError(t, s.InitializeClient("1", 100000, 0))
 
 	for i := 0; i < 4; i++ {
-		_, _, err := s.Save(ctx, db.ToRecord("1", &model.Transaction{
+		_, _, err := s.Save(ctx, record("1", &model.Transaction{
 			Type:        "c",
 			Description: "asd",
-			Value:       100 + i,
+			Value:       int64(100 + i),
 		}))
 		require.NoError(t, err)
 	}
 }
 
+func TestStoreReplay(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := db.NewMemoryEngine()
+	dba := db.NewDB(e, e)
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	require.NoError(t, s.InitializeClient("1", 1000, 0))
+
+	ctx := context.Background()
+	var bal int64
+	for i := 0; i < 150; i++ {
+		typ := "c"
+		if i%3 == 0 {
+			typ = "d"
+		}
+		_, bal, err = s.Save(ctx, record("1", &model.Transaction{
+			Type:        typ,
+			Description: "replay",
+			Value:       int64(10 + i),
+			Timestamp:   int64(i),
+		}))
+		require.NoError(t, err)
+	}
+
+	// simula uma queda: o serviço anterior não é fechado e as 50 últimas
+	// transações existem apenas no WAL
+	wal2, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal2.Close()
+	s2 := NewStoreService(context.Background(), dba, wal2)
+	defer s2.Close()
+	require.NoError(t, s2.InitializeClient("1", 1000, 0))
+
+	_, bal2, tr, err := s2.GetExtract(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, bal, bal2)
+	require.Len(t, tr, 5)
+}
+
+func TestStoreOverflow(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := db.NewMemoryEngine()
+	dba := db.NewDB(e, e)
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.NoError(t, s.InitializeClient("1", math.MaxInt64, 0))
+
+	ctx := context.Background()
+	_, bal, err := s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "big", Value: math.MaxInt64}))
+	require.NoError(t, err)
+	require.Equal(t, int64(math.MaxInt64), bal)
+
+	_, _, err = s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "over", Value: 1}))
+	require.ErrorIs(t, err, repository.ErrOverflow)
+
+	_, bal, err = s.Save(ctx, record("1", &model.Transaction{Type: "d", Description: "big", Value: math.MaxInt64}))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), bal)
+	_, bal, err = s.Save(ctx, record("1", &model.Transaction{Type: "d", Description: "big", Value: math.MaxInt64}))
+	require.NoError(t, err)
+	require.Equal(t, int64(-math.MaxInt64), bal)
+
+	_, _, err = s.Save(ctx, record("1", &model.Transaction{Type: "d", Description: "under", Value: 2}))
+	require.ErrorIs(t, err, repository.ErrOverflow)
+}
+
+func TestStoreInitializeReadError(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	require.NoError(t, dba.Write("1", []*model.Transaction{
+		{Type: "c", Description: "a", Value: 10, Timestamp: 1},
+		{Type: "c", Description: "b", Value: 20, Timestamp: 2},
+	}))
+	chunks, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	name := filepath.Join(dir, "1", chunks[0].Name)
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	b[len(b)-10] ^= 0xff
+	require.NoError(t, os.WriteFile(name, b, 0644))
+
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.ErrorIs(t, s.InitializeClient("1", 1000, 0), db.ErrChecksum)
+	_, err = s.DescribeClient("1")
+	require.ErrorIs(t, err, repository.ErrClientNotInitialized)
+}
+
+func TestStoreWALFailure(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := db.NewMemoryEngine()
+	dba := db.NewDB(e, e)
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	s := NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.NoError(t, s.InitializeClient("1", 1000, 0))
+
+	ctx := context.Background()
+	_, _, err = s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "a", Value: 10}))
+	require.NoError(t, err)
+
+	// o erro do WAL vai para o cliente e o store para de aceitar gravações
+	require.NoError(t, wal.Close())
+	_, _, err = s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "b", Value: 10}))
+	require.ErrorIs(t, err, repository.ErrStoreFailure)
+	require.ErrorIs(t, err, db.ErrWALClosed)
+	require.False(t, s.Healthy())
+	_, _, err = s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "c", Value: 10}))
+	require.ErrorIs(t, err, repository.ErrStoreFailure)
+	_, _, err = s.SetLimit("1", 10, limitReject, "")
+	require.ErrorIs(t, err, repository.ErrStoreFailure)
+	require.ErrorIs(t, s.SetState("1", repository.StateFrozen, ""), repository.ErrStoreFailure)
+	_, _, _, err = s.GetExtract(ctx, "1")
+	require.NoError(t, err)
+}
+
+func TestStoreWALFailureIdempotency(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := db.NewMemoryEngine()
+	dba := db.NewDB(e, e)
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	s := NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.NoError(t, s.EnableIdempotency(dir, time.Hour))
+	require.NoError(t, s.InitializeClient("1", 1000, 0))
+
+	ctx := context.Background()
+	save := func(key string) error {
+		tr := &model.Transaction{Type: "c", Description: "idem", Value: 10, Metadata: map[string]string{model.IdempotencyKey: key}}
+		_, _, err := s.Save(ctx, record("1", tr))
+		return err
+	}
+	require.NoError(t, save("a"))
+
+	// as repetições concorrentes recebem o erro da original, sem esperar
+	// para sempre, e a chave não fica reservada
+	require.NoError(t, wal.Close())
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() { errs <- save("b") }()
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case err := <-errs:
+			require.ErrorIs(t, err, repository.ErrStoreFailure)
+		case <-time.After(5 * time.Second):
+			t.Fatal("duplicate blocked")
+		}
+	}
+	clientLock, infos, ok := s.client("1")
+	require.True(t, ok)
+	clientLock.Lock()
+	_, claimed := infos.keys["b"]
+	order := append([]string(nil), infos.keyOrder...)
+	clientLock.Unlock()
+	require.False(t, claimed)
+	require.Equal(t, []string{"a"}, order)
+
+	require.NoError(t, s.keys.log.Sync())
+	b, err := os.ReadFile(filepath.Join(dir, db.IdempotencyFile))
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"key":"a"`)
+	require.NotContains(t, string(b), `"key":"b"`)
+}
+
+func TestStoreBalanceAt(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.NoError(t, s.InitializeClient("1", 1000, 0))
+
+	// parte das transações ainda está no buffer de flush
+	ctx := context.Background()
+	for i := 0; i < 150; i++ {
+		_, _, err := s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "saldo", Value: 2, Timestamp: int64(i)}))
+		require.NoError(t, err)
+	}
+	lim, bal, err := s.BalanceAt(ctx, "1", 139)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), lim)
+	require.Equal(t, int64(280), bal)
+	_, bal, err = s.BalanceAt(ctx, "1", math.MaxInt64)
+	require.NoError(t, err)
+	require.Equal(t, int64(300), bal)
+
+	_, _, err = s.BalanceAt(ctx, "9", 0)
+	require.ErrorIs(t, err, repository.ErrClientNotInitialized)
+
+	// cliente sem histórico: saldo zero em qualquer data
+	require.NoError(t, s.InitializeClient("2", 500, 0))
+	lim, bal, err = s.BalanceAt(ctx, "2", time.Now().UnixMilli())
+	require.NoError(t, err)
+	require.Equal(t, int64(500), lim)
+	require.Equal(t, int64(0), bal)
+}
+
 func BenchmarkStore(b *testing.B) {
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		// Level: slog.LevelDebug,
 	})))
 
-	dba := db.NewDB(db.NewFileWriterFactoryFromPath("./"), nil)
-	s := NewStoreService(context.Background(), dba)
+	dir := b.TempDir()
+	e := db.NewMemoryEngine()
+	dba := db.NewDB(e, e)
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(b, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
 	defer s.Close()
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
-	s.InitializeClient("1", 100000, 0)
-	s.InitializeClient("2", 80000, 0)
-	s.InitializeClient("3", 1000000, 0)
-	s.InitializeClient("4", 10000000, 0)
-	s.InitializeClient("5", 500000, 0)
+	require.NoError(b, s.InitializeClient("1", 100000, 0))
+	require.NoError(b, s.InitializeClient("2", 80000, 0))
+	require.NoError(b, s.InitializeClient("3", 1000000, 0))
+	require.NoError(b, s.InitializeClient("4", 10000000, 0))
+	require.NoError(b, s.InitializeClient("5", 500000, 0))
 
 	b.RunParallel(func(p *testing.PB) {
 		for p.Next() {
@@ -64,7 +299,7 @@ func BenchmarkStore(b *testing.B) {
 				t = "d"
 			}
 
-			s.Save(ctx, db.ToRecord(id, &model.Transaction{
+			s.Save(ctx, record(id, &model.Transaction{
 				Type:        t,
 				Description: "asd",
 				Value:       10000,
@@ -80,3 +315,424 @@ func BenchmarkStore(b *testing.B) {
 	// 	slog.Info("extract", "id", i, "ex", ex)
 	// }
 }
+
+// failingWriters falha a criação dos chunks enquanto fail estiver ligado
+type failingWriters struct {
+	*db.MemoryEngine
+	fail atomic.Bool
+}
+
+func (f *failingWriters) NewWriter(id, chunkId string, codec db.Codec, n int) (db.CloseableRegWriter, error) {
+	if f.fail.Load() {
+		return nil, errors.New("disk full")
+	}
+	return f.MemoryEngine.NewWriter(id, chunkId, codec, n)
+}
+
+func TestStoreFlushFailure(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := &failingWriters{MemoryEngine: db.NewMemoryEngine()}
+	dba := db.NewDB(e, e)
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	require.NoError(t, s.InitializeClient("1", 1000, 0))
+
+	ctx := context.Background()
+	e.fail.Store(true)
+	for i := 0; i < 100; i++ {
+		_, _, err := s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "f", Value: 1, Timestamp: int64(i)}))
+		require.NoError(t, err)
+	}
+	_, _, err = s.BalanceAt(ctx, "1", 1000)
+	require.ErrorContains(t, err, "disk full")
+
+	// o buffer é mantido e gravado inteiro quando o disco volta
+	e.fail.Store(false)
+	_, bal, err := s.BalanceAt(ctx, "1", 1000)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), bal)
+	count, err := dba.ReadCount("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), count)
+	s.Close()
+
+	// nada é perdido nem reaplicado no próximo start
+	wal2, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal2.Close()
+	s2 := NewStoreService(context.Background(), dba, wal2)
+	defer s2.Close()
+	require.NoError(t, s2.InitializeClient("1", 1000, 0))
+	c, err := s2.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), c.Balance)
+	require.Equal(t, int64(100), c.Count)
+}
+
+func record(id string, tr *model.Transaction) db.Record {
+	r, err := db.ToRecord(id, tr)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestStoreClients(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	s := NewStoreService(context.Background(), dba, wal)
+	require.NoError(t, s.LoadClients(dir, defaultClients))
+	require.Len(t, s.ListClients(), 5)
+
+	// criações concorrentes com gravações e extratos
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, _, err := s.Save(ctx, record("1", &model.Transaction{Type: "c", Description: "conc", Value: 1, Timestamp: int64(j)}))
+				require.NoError(t, err)
+				_, _, _, err = s.GetExtract(ctx, "1")
+				require.NoError(t, err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, s.CreateClient(strconv.Itoa(10+i), int64(100*i)))
+			_, _, err := s.Save(ctx, record(strconv.Itoa(10+i), &model.Transaction{Type: "d", Description: "novo", Value: int64(100 * i)}))
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	require.ErrorIs(t, s.CreateClient("10", 1), repository.ErrClientExists)
+	require.ErrorIs(t, s.CreateClient("20", -1), repository.ErrInvalidLimit)
+	c, err := s.DescribeClient("13")
+	require.NoError(t, err)
+	require.Equal(t, int64(300), c.Limit)
+	require.Equal(t, int64(-300), c.Balance)
+	require.Equal(t, int64(1), c.Count)
+	s.Close()
+	wal.Close()
+
+	// os clientes criados continuam registrados
+	wal, err = db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s = NewStoreService(context.Background(), dba, wal)
+	defer s.Close()
+	require.NoError(t, s.LoadClients(dir, defaultClients))
+	clients := s.ListClients()
+	require.Len(t, clients, 9)
+	require.Equal(t, "13", clients[8].ID)
+	require.Equal(t, int64(-300), clients[8].Balance)
+	require.Equal(t, int64(200), clients[0].Balance)
+}
+
+func TestStoreSetLimit(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	require.NoError(t, s.LoadClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+
+	ctx := context.Background()
+	save := func(typ string, v int64) error {
+		_, _, err := s.Save(ctx, record("1", &model.Transaction{Type: typ, Description: "lim", Value: v, Timestamp: time.Now().UnixMilli()}))
+		return err
+	}
+	require.NoError(t, save("d", 80))
+
+	_, _, err = s.SetLimit("1", 50, limitReject, "")
+	require.ErrorIs(t, err, repository.ErrLimitBelowBalance)
+	_, _, err = s.SetLimit("1", -1, limitAllow, "")
+	require.ErrorIs(t, err, repository.ErrInvalidLimit)
+
+	// abaixo do saldo: só créditos até o saldo voltar ao limite
+	lim, bal, err := s.SetLimit("1", 50, limitAllow, "risco")
+	require.NoError(t, err)
+	require.Equal(t, int64(50), lim)
+	require.Equal(t, int64(-80), bal)
+	require.ErrorIs(t, save("d", 1), repository.ErrLimitExceeded)
+	require.NoError(t, save("c", 10))
+	_, _, err = s.SetLimit("1", 200, limitReject, "")
+	require.NoError(t, err)
+	require.NoError(t, save("d", 100))
+
+	// queda sem flush: o registro antigo é corrigido pelo replay do WAL
+	require.NoError(t, db.WriteClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+	wal2, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal2.Close()
+	s2 := NewStoreService(context.Background(), dba, wal2)
+	require.NoError(t, s2.LoadClients(dir, nil))
+	c, err := s2.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(200), c.Limit)
+	require.Equal(t, int64(-170), c.Balance)
+	require.Equal(t, int64(3), c.Count)
+	clients, err := db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(200), clients[0].Limit)
+	_, _, tr, err := s2.GetExtract(ctx, "1")
+	require.NoError(t, err)
+	require.Len(t, tr, 3)
+	s2.Close()
+
+	// o ledger guarda o limite de cada momento
+	it, err := dba.Iterate("1")
+	require.NoError(t, err)
+	defer it.Close()
+	var limits []string
+	for it.Next() {
+		_, tr := db.ToTransaction(it.Record())
+		if it.Record().Type() == db.RecordLimit {
+			limits = append(limits, tr.Metadata["previous"]+">"+strconv.FormatInt(tr.Value, 10)+":"+tr.Description)
+		}
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []string{"100>50:risco", "50>200:limite"}, limits)
+}
+
+func TestStoreSetState(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+	s := NewStoreService(context.Background(), dba, wal)
+	require.NoError(t, s.LoadClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+
+	ctx := context.Background()
+	save := func(typ string) error {
+		_, _, err := s.Save(ctx, record("1", &model.Transaction{Type: typ, Description: "st", Value: 10, Timestamp: time.Now().UnixMilli()}))
+		return err
+	}
+	require.NoError(t, save("d"))
+	require.ErrorIs(t, s.SetState("1", repository.ClientState('x'), ""), repository.ErrInvalidState)
+
+	require.NoError(t, s.SetState("1", repository.StateDebitFrozen, "chargeback"))
+	require.ErrorIs(t, save("d"), repository.ErrDebitFrozen)
+	require.NoError(t, save("c"))
+
+	require.NoError(t, s.SetState("1", repository.StateFrozen, ""))
+	require.ErrorIs(t, save("c"), repository.ErrAccountFrozen)
+	_, _, err = s.SetLimit("1", 200, limitReject, "")
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetState("1", repository.StateClosed, ""))
+	require.ErrorIs(t, save("c"), repository.ErrAccountClosed)
+	require.ErrorIs(t, s.SetState("1", repository.StateActive, ""), repository.ErrAccountClosed)
+	_, _, err = s.SetLimit("1", 300, limitReject, "")
+	require.ErrorIs(t, err, repository.ErrAccountClosed)
+	c, err := s.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, repository.StateClosed, c.State)
+	require.Equal(t, int64(0), c.Balance)
+	require.Equal(t, int64(2), c.Count)
+	clients, err := db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Equal(t, "closed", clients[0].State)
+
+	// queda sem flush: o estado vem do replay do WAL
+	require.NoError(t, db.WriteClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+	wal2, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal2.Close()
+	s2 := NewStoreService(context.Background(), dba, wal2)
+	require.NoError(t, s2.LoadClients(dir, nil))
+	c, err = s2.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, repository.StateClosed, c.State)
+	require.Equal(t, int64(200), c.Limit)
+	clients, err = db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Equal(t, "closed", clients[0].State)
+	s2.Close()
+
+	// depois do flush o estado vem do registro
+	wal3, err := db.OpenWAL(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	defer wal3.Close()
+	s3 := NewStoreService(context.Background(), dba, wal3)
+	defer s3.Close()
+	require.NoError(t, s3.LoadClients(dir, nil))
+	c, err = s3.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, repository.StateClosed, c.State)
+	require.Equal(t, int64(2), c.Count)
+	tr, err := dba.ReadLast("1")
+	require.NoError(t, err)
+	require.Len(t, tr, 2)
+}
+
+func TestStoreLedgerEventsCount(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	open := func() *storeService {
+		wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+		require.NoError(t, err)
+		t.Cleanup(func() { wal.Close() })
+		s := NewStoreService(context.Background(), dba, wal)
+		require.NoError(t, s.LoadClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+		return s
+	}
+
+	// alterações de limite e de estado não são transações
+	s := open()
+	_, _, err := s.SetLimit("1", 200, limitReject, "")
+	require.NoError(t, err)
+	require.NoError(t, s.SetState("1", repository.StateDebitFrozen, ""))
+	c, err := s.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), c.Count)
+	s.Close()
+
+	s = open()
+	require.NoError(t, s.SetState("1", repository.StateActive, ""))
+	c, err = s.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), c.Count)
+	_, _, err = s.Save(context.Background(), record("1", &model.Transaction{Type: "d", Description: "ev", Value: 10, Timestamp: time.Now().UnixMilli()}))
+	require.NoError(t, err)
+	s.Close()
+
+	// a sequência continua contando todos os registros: nada é reaplicado
+	s = open()
+	defer s.Close()
+	c, err = s.DescribeClient("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), c.Count)
+	require.Equal(t, int64(-10), c.Balance)
+	require.Equal(t, int64(200), c.Limit)
+	records, err := dba.ReadRecords("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), records)
+}
+
+func TestStoreLedgerLimitState(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	open := func() *storeService {
+		wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+		require.NoError(t, err)
+		t.Cleanup(func() { wal.Close() })
+		s := NewStoreService(context.Background(), dba, wal)
+		require.NoError(t, s.LoadClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+		return s
+	}
+
+	// falha ao gravar o registro depois do commit no WAL não desfaz a alteração
+	s := open()
+	tmp := filepath.Join(dir, db.ClientsFile+".tmp")
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "x"), 0755))
+	lim, _, err := s.SetLimit("1", 300, limitReject, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(300), lim)
+	require.NoError(t, s.SetState("1", repository.StateFrozen, ""))
+	s.Close()
+	clients, err := db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), clients[0].Limit)
+	require.NoError(t, os.RemoveAll(tmp))
+
+	// registro desatualizado ou ausente: limite e estado vêm do ledger, e o
+	// registro é corrigido
+	for _, stale := range []bool{true, false} {
+		if stale {
+			require.NoError(t, db.WriteClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+		} else {
+			require.NoError(t, os.Remove(filepath.Join(dir, db.ClientsFile)))
+		}
+		s = open()
+		c, err := s.DescribeClient("1")
+		require.NoError(t, err)
+		require.Equal(t, int64(300), c.Limit)
+		require.Equal(t, repository.StateFrozen, c.State)
+		s.Close()
+		clients, err := db.ReadClients(dir)
+		require.NoError(t, err)
+		require.Equal(t, int64(300), clients[0].Limit)
+		require.Equal(t, "frozen", clients[0].State)
+	}
+}
+
+func TestStoreIdempotency(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dba := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	open := func() *storeService {
+		wal, err := db.OpenWAL(filepath.Join(dir, "wal"))
+		require.NoError(t, err)
+		t.Cleanup(func() { wal.Close() })
+		s := NewStoreService(context.Background(), dba, wal)
+		require.NoError(t, s.EnableIdempotency(dir, time.Hour))
+		require.NoError(t, s.LoadClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}}))
+		return s
+	}
+	ctx := context.Background()
+	save := func(s *storeService, key string, v int64) (int64, error) {
+		tr := &model.Transaction{Type: "d", Description: "idem", Value: v, Timestamp: time.Now().UnixMilli()}
+		if key != "" {
+			tr.Metadata = map[string]string{model.IdempotencyKey: key}
+		}
+		_, bal, err := s.Save(ctx, record("1", tr))
+		return bal, err
+	}
+	count := func(s *storeService) int64 {
+		c, err := s.DescribeClient("1")
+		require.NoError(t, err)
+		return c.Count
+	}
+
+	s := open()
+	bal, err := save(s, "a", 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(-10), bal)
+	bal, err = save(s, "a", 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(-10), bal)
+	bal, err = save(s, "", 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(-20), bal)
+	// transação recusada não guarda a chave
+	_, err = save(s, "b", 1000)
+	require.ErrorIs(t, err, repository.ErrLimitExceeded)
+	bal, err = save(s, "b", 5)
+	require.NoError(t, err)
+	require.Equal(t, int64(-25), bal)
+	require.Equal(t, int64(3), count(s))
+
+	// queda sem flush: as chaves vêm do replay do WAL
+	s2 := open()
+	bal, err = save(s2, "a", 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(-10), bal)
+	require.Equal(t, int64(3), count(s2))
+	s2.Close()
+
+	// depois do flush as chaves vêm do log
+	s3 := open()
+	defer s3.Close()
+	bal, err = save(s3, "b", 5)
+	require.NoError(t, err)
+	require.Equal(t, int64(-25), bal)
+	bal, err = save(s3, "c", 5)
+	require.NoError(t, err)
+	require.Equal(t, int64(-30), bal)
+	require.Equal(t, int64(4), count(s3))
+}
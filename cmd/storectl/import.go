@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+// limites dos clientes inicializados pelo store
+const defaultLimits = "1=100000,2=80000,3=1000000,4=10000000,5=500000"
+
+var errClientHasData = errors.New("client already has data")
+
+// importRow é uma linha do JSONL, no formato do dump
+type importRow struct {
+	Client string `json:"cliente"`
+	model.Transaction
+}
+
+// rowReader lê as transações do arquivo importado, retornando io.EOF no fim
+type rowReader interface {
+	next() (string, *model.Transaction, error)
+}
+
+type jsonRows struct {
+	sc *bufio.Scanner
+}
+
+func (j *jsonRows) next() (string, *model.Transaction, error) {
+	for j.sc.Scan() {
+		line := strings.TrimSpace(j.sc.Text())
+		if line == "" {
+			continue
+		}
+		var row importRow
+		err := json.Unmarshal([]byte(line), &row)
+		if err != nil {
+			return "", nil, err
+		}
+		return row.Client, &row.Transaction, nil
+	}
+	if err := j.sc.Err(); err != nil {
+		return "", nil, err
+	}
+	return "", nil, io.EOF
+}
+
+// csvRows lê o CSV do dump; as colunas são identificadas pelo cabeçalho
+type csvRows struct {
+	r    *csv.Reader
+	cols map[string]int
+}
+
+func (c *csvRows) next() (string, *model.Transaction, error) {
+	rec, err := c.r.Read()
+	if err != nil {
+		return "", nil, err
+	}
+	col := func(name string) string {
+		if i, ok := c.cols[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+	tr := &model.Transaction{Type: col("type"), Description: col("description"), Date: col("date")}
+	tr.Value, err = strconv.ParseInt(col("value"), 10, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid value %q", col("value"))
+	}
+	if v := col("timestamp"); v != "" {
+		tr.Timestamp, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid timestamp %q", v)
+		}
+	}
+	if v := col("metadata"); v != "" {
+		err = json.Unmarshal([]byte(v), &tr.Metadata)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+	return col("client"), tr, nil
+}
+
+func newRowReader(r io.Reader, format string) (rowReader, error) {
+	if format == "json" {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &jsonRows{sc: sc}, nil
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, h := range []string{"type", "value", "description"} {
+		if _, ok := cols[h]; !ok {
+			return nil, fmt.Errorf("missing csv column %q", h)
+		}
+	}
+	return &csvRows{r: cr, cols: cols}, nil
+}
+
+func parseLimits(s string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		id, v, ok := strings.Cut(kv, "=")
+		lim, err := strconv.ParseInt(v, 10, 64)
+		if _, idErr := db.ParseClientID(id); !ok || err != nil || idErr != nil || lim < 0 {
+			return nil, fmt.Errorf("invalid limit %q", kv)
+		}
+		limits[id] = lim
+	}
+	return limits, nil
+}
+
+// importClient é o estado de um cliente durante a importação
+type importClient struct {
+	limit   int64
+	balance int64
+	count   int64
+	lastTs  int64
+	state   repository.ClientState
+	buf     []*model.Transaction
+}
+
+// importFile percorre o arquivo validando cada linha e chama write com as
+// transações de cada cliente em lotes de até batch transações
+func importFile(path, format, client string, limits map[string]int64, batch int, write func(id string, tr []*model.Transaction) error) (map[string]*importClient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, err := newRowReader(f, format)
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]*importClient)
+	for line := 1; ; line++ {
+		id, tr, err := rows.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if id == "" {
+				id = client
+			}
+			err = validateRow(clients, limits, id, tr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", line, err)
+		}
+		c := clients[id]
+		c.buf = append(c.buf, tr)
+		if len(c.buf) == batch {
+			err = write(id, c.buf)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", id, err)
+			}
+			c.buf = make([]*model.Transaction, 0, batch)
+		}
+	}
+	for id, c := range clients {
+		if len(c.buf) > 0 {
+			err = write(id, c.buf)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", id, err)
+			}
+			c.buf = nil
+		}
+	}
+	return clients, nil
+}
+
+// validateRow aplica as mesmas regras do store: transação válida, saldo sem
+// overflow, sem ultrapassar o limite e aceita pelo estado da conta, que mudam
+// nas alterações de limite e de estado do arquivo. Os timestamps de cada
+// cliente precisam estar em ordem
+func validateRow(clients map[string]*importClient, limits map[string]int64, id string, tr *model.Transaction) error {
+	if _, err := db.ParseClientID(id); err != nil {
+		return fmt.Errorf("client %q: %w", id, err)
+	}
+	c, ok := clients[id]
+	if !ok {
+		lim, ok := limits[id]
+		if !ok {
+			return fmt.Errorf("no limit for client %s", id)
+		}
+		c = &importClient{limit: lim, lastTs: -1, state: repository.StateActive}
+		clients[id] = c
+	}
+	var state repository.ClientState
+	switch tr.Type {
+	case string(db.RecordLimit):
+		// alteração de limite exportada pelo dump: vale para as linhas seguintes
+		if tr.Value < 0 {
+			return fmt.Errorf("invalid limit %d", tr.Value)
+		}
+	case string(db.RecordState):
+		// assim como a alteração de estado
+		var err error
+		state, err = repository.ParseClientState(tr.Metadata["state"])
+		if err != nil {
+			return fmt.Errorf("%w %q", err, tr.Metadata["state"])
+		}
+		if c.state == repository.StateClosed && state != c.state {
+			return repository.ErrAccountClosed
+		}
+	default:
+		if err := tr.Validate(); err != nil {
+			return err
+		}
+		if err := c.state.TransactionError(tr.Type); err != nil {
+			return err
+		}
+	}
+	if tr.Timestamp == 0 && tr.Date != "" {
+		t, err := time.Parse(time.RFC3339Nano, tr.Date)
+		if err != nil {
+			return fmt.Errorf("invalid date %s", tr.Date)
+		}
+		tr.Timestamp = t.UnixMilli()
+	}
+	if tr.Timestamp < c.lastTs {
+		return fmt.Errorf("timestamp %d before %d", tr.Timestamp, c.lastTs)
+	}
+	switch tr.Type {
+	case string(db.RecordLimit):
+		c.limit, c.count, c.lastTs = tr.Value, c.count+1, tr.Timestamp
+		return nil
+	case string(db.RecordState):
+		c.state, c.count, c.lastTs = state, c.count+1, tr.Timestamp
+		return nil
+	}
+	next, ok := model.AddAmount(c.balance, tr.GetValue())
+	if !ok {
+		return db.ErrOverflow
+	}
+	if tr.Type == "d" && next < -c.limit {
+		return fmt.Errorf("limit exceeded: balance %d, limit %d", next, c.limit)
+	}
+	c.balance, c.count, c.lastTs = next, c.count+1, tr.Timestamp
+	return nil
+}
+
+// importData carrega transações exportadas (JSONL ou CSV, no formato do dump)
+// em clientes sem histórico. O arquivo inteiro é validado antes da primeira
+// gravação; depois os chunks são gravados em lotes, um checkpoint é gerado
+// para cada cliente e o registro de clientes recebe o limite e o estado do
+// fim do arquivo
+func importData(path string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "json", "json (um objeto por linha) ou csv")
+	client := fs.String("client", "", "cliente das linhas sem cliente")
+	limitsFlag := fs.String("limits", defaultLimits, "limites dos clientes (id=limite,...)")
+	batch := fs.Int("batch", 100, "transações por chunk")
+	check := fs.Bool("check", false, "apenas valida o arquivo")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected the file to import")
+	}
+	if *batch < 1 {
+		return errors.New("expected a positive -batch")
+	}
+	limits, err := parseLimits(*limitsFlag)
+	if err != nil {
+		return err
+	}
+
+	clients, err := importFile(fs.Arg(0), *format, *client, limits, *batch, func(string, []*model.Transaction) error { return nil })
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if *check {
+		for _, id := range ids {
+			fmt.Fprintf(out, "%s: balance %d, records %d\n", id, clients[id].balance, clients[id].count)
+		}
+		return nil
+	}
+
+	// o replay do WAL usa a quantidade de registros como sequência, então
+	// os clientes não podem ter histórico nem transações pendentes
+	err = checkEmpty(path, ids)
+	if err != nil {
+		return err
+	}
+
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(path), db.NewFileRegReader(path))
+	clients, err = importFile(fs.Arg(0), *format, *client, limits, *batch, d.Write)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = d.Checkpoint(id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		bal, err := d.ReadBalance(id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		if bal != clients[id].balance {
+			return fmt.Errorf("%s: balance %d, expected %d", id, bal, clients[id].balance)
+		}
+		fmt.Fprintf(out, "%s: balance %d, records %d\n", id, bal, clients[id].count)
+	}
+	return registerClients(path, clients)
+}
+
+// registerClients grava no registro de clientes o limite e o estado final de
+// cada cliente importado. Sem registro, parte dos clientes padrão, que o store
+// registraria no primeiro start
+func registerClients(path string, clients map[string]*importClient) error {
+	now := time.Now()
+	reg, err := db.ReadClients(path)
+	if errors.Is(err, os.ErrNotExist) {
+		defaults, _ := parseLimits(defaultLimits)
+		for id, lim := range defaults {
+			reg = append(reg, db.ClientConfig{ID: id, Limit: lim, Created: now})
+		}
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	idx := make(map[string]int, len(reg))
+	for i, c := range reg {
+		idx[c.ID] = i
+	}
+	for id, c := range clients {
+		state := ""
+		if c.state != repository.StateActive {
+			state = c.state.String()
+		}
+		if i, ok := idx[id]; ok {
+			reg[i].Limit, reg[i].State = c.limit, state
+			continue
+		}
+		reg = append(reg, db.ClientConfig{ID: id, Limit: c.limit, State: state, Created: now})
+	}
+	return db.WriteClients(path, reg)
+}
+
+func checkEmpty(path string, ids []string) error {
+	frr := db.NewFileRegReader(path)
+	for _, id := range ids {
+		n, err := frr.Records(id)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		if n > 0 {
+			return fmt.Errorf("%s: %w", id, errClientHasData)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, "wal")); err != nil {
+		return nil
+	}
+	wal, err := db.OpenWAL(filepath.Join(path, "wal"))
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+	for _, id := range ids {
+		cid, _ := db.ParseClientID(id)
+		pending := false
+		err = wal.Replay(cid, 0, func(uint64, db.Record) error {
+			pending = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if pending {
+			return fmt.Errorf("%s: %w (wal)", id, errClientHasData)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+// setLimit altera o limite de um cliente do store em execução. Sem -allow o
+// store recusa um limite abaixo do saldo negativo atual
+func setLimit(ctx context.Context, m repository.ClientManager, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("limit", flag.ContinueOnError)
+	allow := fs.Bool("allow", false, "aceita limite abaixo do saldo negativo atual")
+	reason := fs.String("reason", "", "motivo da alteração, gravado no ledger")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("expected the client id and limit")
+	}
+	limit, err := strconv.ParseInt(fs.Arg(1), 10, 64)
+	if err != nil || limit < 0 {
+		return fmt.Errorf("invalid limit %q", fs.Arg(1))
+	}
+	if len(*reason) > 255 {
+		return errors.New("reason longer than 255 bytes")
+	}
+	return withClient(fs.Args()[:1], func(id string) error {
+		bal, err := m.SetLimit(ctx, id, limit, *allow, *reason)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "client %s limit set to %d (balance %d)\n", id, limit, bal)
+		return nil
+	})
+}
+
+// limits lista as alterações de limite do ledger do cliente, com o saldo no
+// momento de cada alteração
+func limits(path, archivePath string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("limits", flag.ContinueOnError)
+	includeArchive := fs.Bool("archive", false, "inclui o histórico arquivado")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	return withClient(fs.Args(), func(id string) error {
+		d := db.NewDB(nil, db.NewFileRegReaderWithArchive(path, archivePath))
+		it, err := d.IterateHistory(id, db.HistoryOptions{IncludeArchive: *includeArchive})
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DATE\tPREVIOUS\tLIMIT\tBALANCE\tDESCRIPTION")
+		var bal int64
+		for it.Next() {
+			r := it.Record()
+			var ok bool
+			if bal, ok = model.AddAmount(bal, r.Value()); !ok {
+				return db.ErrOverflow
+			}
+			if r.Type() != db.RecordLimit {
+				continue
+			}
+			_, tr := db.ToTransaction(r)
+			date := time.UnixMilli(tr.Timestamp).UTC().Format(time.RFC3339Nano)
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", date, tr.Metadata["previous"], tr.Value, bal, tr.Description)
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
@@ -0,0 +1,514 @@
+// storectl inspeciona e repara o diretório de dados do store (PATH_PREFIX)
+// com o store parado.
+//
+//	storectl [-path dir] clients
+//	storectl [-path dir] chunks <id>
+//	storectl [-path dir] dump [-format json|csv] [-from ts] [-to ts] [-archive] <id>
+//	storectl [-path dir] balance <id>
+//	storectl [-path dir] verify [id...]
+//	storectl [-path dir] repair [id...]
+//	storectl backup [-addr host:port] <dst>
+//	storectl client [-addr host:port] create <id> <limit> | list | describe <id>
+//	storectl client [-addr host:port] limit [-allow] [-reason texto] <id> <limit>
+//	storectl client [-addr host:port] state [-reason texto] <id> <active|debit_frozen|frozen|closed>
+//	storectl [-path dir] limits [-archive] <id>
+//	storectl [-path dir] restore [-check] <src>
+//	storectl [-path dir] reencrypt [id...]
+//	storectl [-path dir] archive -age duration [id...]
+//	storectl [-path dir] import [-format json|csv] [-client id] [-limits id=limite,...] [-batch n] [-check] <file>
+//
+// backup é feito pelo store em execução (dst é um diretório relativo ao
+// BACKUP_PATH do store), assim como a criação, a alteração do limite e do
+// estado e a consulta dos clientes (client); os demais comandos trabalham direto nos arquivos. As
+// chaves dos chunks cifrados vêm de ENCRYPTION_KEY_FILE ou ENCRYPTION_KEYS, como no store, e
+// reencrypt cifra de novo com a chave ativa (a primeira) os arquivos gravados
+// em claro ou com outra chave. O histórico arquivado fica em -archive-path
+// (ARCHIVE_PATH, padrão dir/archive). import carrega em clientes vazios o
+// histórico exportado pelo dump. limits lista as alterações de limite gravadas
+// no ledger do cliente
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+var errProblems = errors.New("problems found")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "storectl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("storectl", flag.ContinueOnError)
+	path := fs.String("path", os.Getenv("PATH_PREFIX"), "diretório de dados do store")
+	archivePath := fs.String("archive-path", os.Getenv("ARCHIVE_PATH"), "diretório do histórico arquivado")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("missing command: clients, chunks, dump, balance, verify, repair, backup, client, restore, reencrypt, archive, import or limits")
+	}
+	keys, err := db.KeyringFromEnv()
+	if err != nil {
+		return err
+	}
+	db.SetKeyring(keys)
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "clients":
+		return clients(*path, out)
+	case "chunks":
+		return withClient(args, func(id string) error { return chunks(*path, id, out) })
+	case "dump":
+		return dump(*path, *archivePath, args, out)
+	case "balance":
+		return withClient(args, func(id string) error { return balance(*path, id, out) })
+	case "verify":
+		return verify(*path, args, out)
+	case "repair":
+		return repair(*path, args, out)
+	case "backup":
+		return backup(args, out)
+	case "client":
+		return client(args, out)
+	case "restore":
+		return restore(*path, args, out)
+	case "reencrypt":
+		return reencrypt(*path, args, out)
+	case "archive":
+		return archive(*path, *archivePath, args, out)
+	case "import":
+		return importData(*path, args, out)
+	case "limits":
+		return limits(*path, *archivePath, args, out)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func withClient(args []string, f func(id string) error) error {
+	if len(args) != 1 {
+		return errors.New("expected one client id")
+	}
+	if _, err := db.ParseClientID(args[0]); err != nil {
+		return err
+	}
+	return f(args[0])
+}
+
+// clientIDs lista os diretórios de clientes, em ordem numérica
+func clientIDs(path string) ([]string, error) {
+	d, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for _, de := range d {
+		if _, err := db.ParseClientID(de.Name()); err == nil && de.IsDir() {
+			ids = append(ids, de.Name())
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := db.ParseClientID(ids[i])
+		b, _ := db.ParseClientID(ids[j])
+		return a < b
+	})
+	return ids, nil
+}
+
+func clients(path string, out io.Writer) error {
+	ids, err := clientIDs(path)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCHUNKS\tRECORDS\tLAST SEQ")
+	for _, id := range ids {
+		entries, err := db.LoadManifest(filepath.Join(path, id))
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%v\t\t\n", id, err)
+			continue
+		}
+		var count int64
+		var seq uint64
+		for _, e := range entries {
+			count += e.Count
+			seq = e.LastSeq
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", id, len(entries), count, seq)
+	}
+	return w.Flush()
+}
+
+func chunks(path, id string, out io.Writer) error {
+	dir := filepath.Join(path, id)
+	entries, err := db.LoadManifest(dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tNAME\tSEALED\tRECORDS\tMIN TS\tMAX TS\tSIZE\tKEY")
+	for _, e := range entries {
+		size := int64(-1)
+		if st, err := os.Stat(filepath.Join(dir, e.Name)); err == nil {
+			size = st.Size()
+		}
+		key, err := db.ChunkKeyID(filepath.Join(dir, e.Name))
+		if err != nil {
+			key = "?"
+		} else if key == "" {
+			key = "-"
+		}
+		seq := strconv.FormatUint(e.FirstSeq, 10)
+		if e.LastSeq != e.FirstSeq {
+			seq += "-" + strconv.FormatUint(e.LastSeq, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%d\t%d\t%d\t%s\n", seq, e.Name, e.Sealed, e.Count, e.MinTs, e.MaxTs, size, key)
+	}
+	return w.Flush()
+}
+
+func dump(path, archivePath string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	format := fs.String("format", "json", "json (um objeto por linha) ou csv")
+	from := fs.Int64("from", math.MinInt64, "timestamp inicial (unix millis)")
+	to := fs.Int64("to", math.MaxInt64, "timestamp final (unix millis)")
+	includeArchive := fs.Bool("archive", false, "inclui o histórico arquivado")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return withClient(fs.Args(), func(id string) error {
+		d := db.NewDB(nil, db.NewFileRegReaderWithArchive(path, archivePath))
+		it, err := d.IterateHistory(id, db.HistoryOptions{IncludeArchive: *includeArchive})
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+
+		enc := json.NewEncoder(out)
+		cw := csv.NewWriter(out)
+		if *format == "csv" {
+			cw.Write([]string{"client", "type", "value", "description", "timestamp", "date", "metadata"})
+		}
+		for it.Next() {
+			cid, tr := db.ToTransaction(it.Record())
+			if tr.Timestamp < *from || tr.Timestamp > *to {
+				continue
+			}
+			tr.Date = time.UnixMilli(tr.Timestamp).UTC().Format(time.RFC3339Nano)
+			if *format == "json" {
+				err = enc.Encode(struct {
+					Client string `json:"cliente"`
+					*model.Transaction
+				}{cid, tr})
+			} else {
+				meta := ""
+				if tr.Metadata != nil {
+					b, _ := json.Marshal(tr.Metadata)
+					meta = string(b)
+				}
+				err = cw.Write([]string{cid, tr.Type, strconv.FormatInt(tr.Value, 10), tr.Description, strconv.FormatInt(tr.Timestamp, 10), tr.Date, meta})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		return it.Err()
+	})
+}
+
+// balance recalcula saldo e quantidade lendo todo o histórico, sem usar o
+// checkpoint, e compara com o checkpoint gravado
+func balance(path, id string, out io.Writer) error {
+	it, err := db.NewFileRegReader(path).Iterate(id)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	var bal, count int64
+	for it.Next() {
+		var ok bool
+		if bal, ok = model.AddAmount(bal, it.Record().Value()); !ok {
+			return db.ErrOverflow
+		}
+		count += it.Record().Records()
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "balance: %d\nrecords: %d\n", bal, count)
+
+	cp, err := db.ReadCheckpoint(filepath.Join(path, id))
+	if err != nil {
+		fmt.Fprintf(out, "checkpoint: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "checkpoint: balance %d, records %d, seq %d (%s)\n", cp.Balance, cp.Records, cp.LastSeq, cp.LastChunk)
+	return nil
+}
+
+func clientArgs(path string, args []string) ([]string, error) {
+	if len(args) == 0 {
+		return clientIDs(path)
+	}
+	for _, id := range args {
+		if _, err := db.ParseClientID(id); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func verify(path string, args []string, out io.Writer) error {
+	ids, err := clientArgs(path, args)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, id := range ids {
+		reports, err := db.Verify(filepath.Join(path, id))
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		for _, rep := range reports {
+			for _, p := range rep.Problems {
+				fmt.Fprintf(out, "%s/%s: %s\n", id, rep.Chunk, p)
+			}
+		}
+		if len(reports) == 0 {
+			fmt.Fprintf(out, "%s: ok\n", id)
+		}
+		found = found || len(reports) > 0
+	}
+	if found {
+		return errProblems
+	}
+	return nil
+}
+
+// repair trunca os chunks corrompidos e move para a quarentena os arquivos
+// fora do manifesto, como o store faz com RECOVERY_MODE=true
+func repair(path string, args []string, out io.Writer) error {
+	ids, err := clientArgs(path, args)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		dir := filepath.Join(path, id)
+		reports, err := db.Recover(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		for _, rep := range reports {
+			fmt.Fprintf(out, "%s/%s: kept %d, dropped %d, trailing %d bytes", id, rep.Chunk, rep.Kept, len(rep.Dropped), rep.Trailing)
+			if rep.Err != nil {
+				fmt.Fprintf(out, ", not repaired: %v", rep.Err)
+			}
+			fmt.Fprintln(out)
+		}
+		moved, err := db.Quarantine(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		for _, name := range moved {
+			fmt.Fprintf(out, "%s/%s: moved to %s\n", id, name, db.QuarantineDir)
+		}
+	}
+	return nil
+}
+
+func backup(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	addr := fs.String("addr", os.Getenv("STORE_HOST"), "endereço do store")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected the backup directory")
+	}
+	repo := repository.NewTcpRepository(*addr)
+	defer repo.ShutDown()
+	b, ok := repo.(repository.Backuper)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	err = b.Backup(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "backup written to %s\n", fs.Arg(0))
+	return nil
+}
+
+// client cria, lista e descreve os clientes do store em execução
+func client(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	addr := fs.String("addr", os.Getenv("STORE_HOST"), "endereço do store")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("missing client command: create, list, describe, limit or state")
+	}
+	repo := repository.NewTcpRepository(*addr)
+	defer repo.ShutDown()
+	m, ok := repo.(repository.ClientManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	ctx := context.Background()
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	var clients []repository.Client
+	switch cmd {
+	case "create":
+		if len(args) != 2 {
+			return errors.New("expected the client id and limit")
+		}
+		limit, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q", args[1])
+		}
+		err = withClient(args[:1], func(id string) error { return m.CreateClient(ctx, id, limit) })
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "client %s created with limit %d\n", args[0], limit)
+		return nil
+	case "limit":
+		return setLimit(ctx, m, args, out)
+	case "state":
+		return setState(ctx, m, args, out)
+	case "list":
+		clients, err = m.ListClients(ctx)
+	case "describe":
+		err = withClient(args, func(id string) error {
+			c, err := m.DescribeClient(ctx, id)
+			if err == nil {
+				clients = append(clients, *c)
+			}
+			return err
+		})
+	default:
+		return fmt.Errorf("unknown client command %q", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLIMIT\tBALANCE\tRECORDS\tSTATE\tCREATED")
+	for _, c := range clients {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", c.ID, c.Limit, c.Balance, c.Count, c.State, c.Created.UTC().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// restore verifica o backup e substitui os diretórios dos clientes, descartando
+// o WAL. O store precisa estar parado; com -check o backup é apenas verificado
+func restore(path string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	check := fs.Bool("check", false, "apenas verifica o backup")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected the backup directory")
+	}
+	var info *db.BackupInfo
+	if *check {
+		info, err = db.VerifyBackup(fs.Arg(0))
+	} else {
+		info, err = db.RestoreBackup(fs.Arg(0), path)
+		if err == nil {
+			err = os.RemoveAll(filepath.Join(path, "wal"))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, c := range info.Clients {
+		fmt.Fprintf(out, "%s: balance %d, records %d, limit %d\n", c.ID, c.Balance, c.Count, c.Limit)
+	}
+	if !*check {
+		fmt.Fprintf(out, "restored backup from %s\n", info.Created.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// reencrypt cifra de novo os chunks selados com a chave ativa. Depois disso as
+// chaves antigas podem ser removidas do keyring
+func reencrypt(path string, args []string, out io.Writer) error {
+	ids, err := clientArgs(path, args)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		changed, err := db.Reencrypt(filepath.Join(path, id))
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		for _, name := range changed {
+			fmt.Fprintf(out, "%s/%s: reencrypted\n", id, name)
+		}
+		fmt.Fprintf(out, "%s: %d files reencrypted\n", id, len(changed))
+	}
+	return nil
+}
+
+// archive arquiva os chunks mais antigos que -age, como o store faz com
+// RETENTION_AGE
+func archive(path, archivePath string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+	age := fs.Duration("age", 0, "idade mínima dos chunks arquivados")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *age <= 0 {
+		return errors.New("expected a positive -age")
+	}
+	ids, err := clientArgs(path, fs.Args())
+	if err != nil {
+		return err
+	}
+	a := db.NewArchiver(path, archivePath, *age)
+	for _, id := range ids {
+		n, err := a.Archive(id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		fmt.Fprintf(out, "%s: %d chunks archived\n", id, n)
+	}
+	return nil
+}
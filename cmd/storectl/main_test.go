@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/ricardovhz/rinha2/repository"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorectl(t *testing.T) {
+	dir := t.TempDir()
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: int64(i*2 + 1), Value: 100, Type: "c", Description: "crédito, a"},
+			{Timestamp: int64(i*2 + 2), Value: 30, Type: "d", Description: "débito", Metadata: map[string]string{"loja": "x"}},
+		}))
+	}
+	require.NoError(t, d.Checkpoint("1"))
+
+	ctl := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := run(append([]string{"-path", dir}, args...), out)
+		return out.String(), err
+	}
+
+	out, err := ctl("clients")
+	require.NoError(t, err)
+	require.Contains(t, out, "1   3")
+
+	out, err = ctl("dump", "-format", "csv", "-from", "2", "-to", "3", "1")
+	require.NoError(t, err)
+	rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	require.Equal(t, []string{"1", "d", "30", "débito", "2", "1970-01-01T00:00:00.002Z", `{"loja":"x"}`}, rows[1])
+
+	out, err = ctl("dump", "1")
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 6)
+	require.Contains(t, out, `"cliente":"1"`)
+
+	out, err = ctl("balance", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "balance: 210\nrecords: 6\ncheckpoint: balance 210, records 6")
+
+	out, err = ctl("verify")
+	require.NoError(t, err)
+	require.Equal(t, "1: ok\n", out)
+
+	// corrompe o último registro e deixa um arquivo fora do manifesto
+	chunks, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	path := filepath.Join(dir, "1", chunks[2].Name)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[len(b)-1]++
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1", "stray"), nil, 0644))
+
+	out, err = ctl("verify", "1")
+	require.ErrorIs(t, err, errProblems)
+	require.Contains(t, out, "record 2: record checksum mismatch")
+	require.Contains(t, out, "1/stray: file not in manifest")
+
+	out, err = ctl("repair")
+	require.NoError(t, err)
+	require.Contains(t, out, "kept 1, dropped 1")
+	require.Contains(t, out, "1/stray: moved to quarantine")
+
+	out, err = ctl("verify")
+	require.NoError(t, err)
+	out, err = ctl("balance", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "balance: 240\nrecords: 5")
+
+	// cifra os chunks gravados em claro
+	t.Setenv("ENCRYPTION_KEYS", "k1:"+strings.Repeat("ab", 32))
+	out, err = ctl("reencrypt")
+	require.NoError(t, err)
+	require.Contains(t, out, "1: 3 files reencrypted")
+	out, err = ctl("chunks", "1")
+	require.NoError(t, err)
+	require.Equal(t, 3, strings.Count(out, " k1\n"))
+	out, err = ctl("balance", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "balance: 240\nrecords: 5")
+
+	// arquiva o chunk mais antigo, mantendo o saldo
+	out, err = ctl("archive", "-age", "1h")
+	require.NoError(t, err)
+	require.Equal(t, "1: 1 chunks archived\n", out)
+	out, err = ctl("balance", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "balance: 240\nrecords: 5")
+	out, err = ctl("dump", "-format", "csv", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "1,b,70,saldo anterior,2,")
+	out, err = ctl("dump", "-archive", "1")
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 5)
+}
+
+func TestStorectlImport(t *testing.T) {
+	dir := t.TempDir()
+	ctl := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := run(append([]string{"-path", dir}, args...), out)
+		return out.String(), err
+	}
+	file := func(content string) string {
+		p := filepath.Join(t.TempDir(), "import")
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		return p
+	}
+
+	// nada é gravado quando alguma linha é inválida
+	_, err := ctl("import", file(`{"cliente":"1","valor":10,"tipo":"c","descricao":"a","Timestamp":1}
+{"cliente":"1","valor":10,"tipo":"x","descricao":"b","Timestamp":2}
+`))
+	require.ErrorContains(t, err, "row 2: invalid type x")
+	_, err = ctl("import", "-limits", "1=5", file(`{"cliente":"1","valor":10,"tipo":"d","descricao":"a","Timestamp":1}`))
+	require.ErrorContains(t, err, "row 1: limit exceeded")
+	_, err = os.Stat(filepath.Join(dir, "1"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	jsonl := ""
+	for i := 0; i < 5; i++ {
+		jsonl += fmt.Sprintf(`{"valor":%d,"tipo":"c","descricao":"json","Timestamp":%d}`+"\n", 10*(i+1), i)
+	}
+	jsonl += `{"valor":0,"tipo":"c","descricao":"meta","Timestamp":5,"metadados":{"loja":"x"}}` + "\n"
+	path := file(jsonl)
+	out, err := ctl("import", "-client", "1", "-check", path)
+	require.NoError(t, err)
+	require.Equal(t, "1: balance 150, records 6\n", out)
+	_, err = os.Stat(filepath.Join(dir, "1"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	out, err = ctl("import", "-client", "1", "-batch", "2", path)
+	require.NoError(t, err)
+	require.Equal(t, "1: balance 150, records 6\n", out)
+	chunks, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	cp, err := db.ReadCheckpoint(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Equal(t, int64(150), cp.Balance)
+	// sem registro, os clientes padrão são registrados junto com os importados
+	clients, err := db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Len(t, clients, 5)
+	require.Equal(t, db.ClientConfig{ID: "1", Limit: 100000, Created: clients[0].Created}, clients[0])
+	require.False(t, clients[0].Created.IsZero())
+
+	_, err = ctl("import", "-client", "1", path)
+	require.ErrorIs(t, err, errClientHasData)
+
+	// erro ao ler o histórico não é tratado como cliente vazio
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	require.NoError(t, d.Write("2", []*model.Transaction{{Timestamp: 1, Value: 10, Type: "c", Description: "a"}}))
+	chunks, err = db.LoadManifest(filepath.Join(dir, "2"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2", chunks[0].Name), bytes.Repeat([]byte("x"), 64), 0644))
+	_, err = ctl("import", "-client", "2", path)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errClientHasData)
+	chunks, err = db.LoadManifest(filepath.Join(dir, "2"))
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "2")))
+
+	// o CSV do dump é importado em outro diretório
+	out, err = ctl("dump", "-format", "csv", "1")
+	require.NoError(t, err)
+	csvPath := file(out + "2,d,80,csv,10,,\n")
+	dir = t.TempDir()
+	out, err = ctl("import", "-format", "csv", csvPath)
+	require.NoError(t, err)
+	require.Equal(t, "1: balance 150, records 6\n2: balance -80, records 1\n", out)
+	out, err = ctl("dump", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, `"metadados":{"loja":"x"}`)
+}
+
+func TestStorectlLimits(t *testing.T) {
+	dir := t.TempDir()
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+	require.NoError(t, d.Write("1", []*model.Transaction{
+		{Timestamp: 1, Value: 80, Type: "d", Description: "a"},
+		{Timestamp: 2, Value: 50, Type: string(db.RecordLimit), Description: "risco", Metadata: map[string]string{"previous": "100"}},
+		{Timestamp: 3, Value: 10, Type: "c", Description: "b"},
+	}))
+	ctl := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := run(append([]string{"-path", dir}, args...), out)
+		return out.String(), err
+	}
+
+	out, err := ctl("limits", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "1970-01-01T00:00:00.002Z  100       50     -80      risco")
+
+	// o dump inclui as alterações de limite, que a importação aplica
+	dump, err := ctl("dump", "1")
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "dump.jsonl")
+	require.NoError(t, os.WriteFile(file, []byte(dump+`{"cliente":"1","valor":1,"tipo":"d","descricao":"c","Timestamp":4}`+"\n"), 0644))
+	dir = t.TempDir()
+	_, err = ctl("import", "-limits", "1=100", file)
+	require.ErrorContains(t, err, "row 4: limit exceeded")
+	require.NoError(t, os.WriteFile(file, []byte(dump), 0644))
+	out, err = ctl("import", "-limits", "1=100", file)
+	require.NoError(t, err)
+	require.Equal(t, "1: balance -70, records 3\n", out)
+	out, err = ctl("limits", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "risco")
+	// o registro fica com o limite do fim do arquivo
+	dir = t.TempDir()
+	require.NoError(t, db.WriteClients(dir, []db.ClientConfig{{ID: "1", Limit: 100}, {ID: "2", Limit: 7, State: "frozen"}}))
+	_, err = ctl("import", "-limits", "1=100", file)
+	require.NoError(t, err)
+	clients, err := db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, int64(50), clients[0].Limit)
+	require.Equal(t, "", clients[0].State)
+	require.Equal(t, db.ClientConfig{ID: "2", Limit: 7, State: "frozen"}, clients[1])
+
+	// transações depois do encerramento da conta são recusadas
+	require.NoError(t, os.WriteFile(file, []byte(`{"cliente":"1","valor":10,"tipo":"c","descricao":"a","Timestamp":1}
+{"cliente":"1","valor":0,"tipo":"s","descricao":"fim","Timestamp":2,"metadados":{"state":"closed","previous":"active"}}
+{"cliente":"1","valor":10,"tipo":"c","descricao":"b","Timestamp":3}
+`), 0644))
+	dir = t.TempDir()
+	_, err = ctl("import", "-limits", "1=100", file)
+	require.ErrorIs(t, err, repository.ErrAccountClosed)
+
+	// assim como o estado
+	require.NoError(t, os.WriteFile(file, []byte(`{"cliente":"1","valor":10,"tipo":"c","descricao":"a","Timestamp":1}
+{"cliente":"1","valor":0,"tipo":"s","descricao":"bloqueio","Timestamp":2,"metadados":{"state":"frozen","previous":"active"}}
+`), 0644))
+	_, err = ctl("import", "-limits", "1=100", file)
+	require.NoError(t, err)
+	clients, err = db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Equal(t, "frozen", clients[0].State)
+	require.Equal(t, int64(100), clients[0].Limit)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/ricardovhz/rinha2/repository"
+)
+
+// setState altera o estado da conta de um cliente do store em execução
+func setState(ctx context.Context, m repository.ClientManager, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	reason := fs.String("reason", "", "motivo da alteração, gravado no ledger")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("expected the client id and state (active, debit_frozen, frozen or closed)")
+	}
+	state, err := repository.ParseClientState(fs.Arg(1))
+	if err != nil || fs.Arg(1) == "" {
+		return fmt.Errorf("invalid state %q", fs.Arg(1))
+	}
+	if len(*reason) > 255 {
+		return errors.New("reason longer than 255 bytes")
+	}
+	return withClient(fs.Args()[:1], func(id string) error {
+		err := m.SetState(ctx, id, state, *reason)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "client %s state set to %s\n", id, state)
+		return nil
+	})
+}
@@ -0,0 +1,449 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// arquivamento (retenção)
+//
+// os chunks selados mais antigos que a idade máxima saem do diretório do
+// cliente para <arquivo>/<id>, que tem um manifesto próprio com as sequências
+// originais. No lugar deles fica o saldo transportado: um chunk
+// <último arquivado>.carry com um único registro RecordCarry, com a soma dos
+// valores e as quantidades de transações e de registros arquivados. Assim
+// GetBalance, Count e Records continuam corretos lendo apenas o diretório do
+// cliente, e as leituras de histórico só incluem o arquivo quando pedido
+// (HistoryOptions).
+//
+// os chunks são copiados para o arquivo antes de serem trocados pelo saldo
+// transportado no manifesto do cliente (entrada R). Cópias de um arquivamento
+// interrompido continuam no diretório do cliente e são ignoradas na leitura
+// do arquivo. O arquivo não faz parte do backup
+const (
+	ArchiveDir  = "archive"
+	CarrySuffix = ".carry"
+)
+
+// o histórico resumido por um saldo transportado não está no arquivo
+var ErrArchiveUnavailable = errors.New("archived history unavailable")
+
+// Archiver move o histórico antigo de cada cliente para o arquivo
+type Archiver struct {
+	path    string
+	archive string
+
+	// MaxAge é a idade, pelo maior timestamp dos registros, a partir da qual
+	// um chunk é arquivado
+	MaxAge time.Duration
+	// Keep é a quantidade de chunks selados mais recentes que nunca são
+	// arquivados (no mínimo 1)
+	Keep int
+}
+
+// Run executa o arquivamento de todos os clientes a cada intervalo, até o
+// contexto ser cancelado
+func (a *Archiver) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			a.ArchiveAll()
+		}
+	}
+}
+
+// ArchiveAll arquiva o histórico antigo de todos os clientes do diretório de dados
+func (a *Archiver) ArchiveAll() {
+	d, err := os.ReadDir(a.path)
+	if err != nil {
+		slog.Error("error listing clients", "err", err, "path", a.path)
+		return
+	}
+	for _, de := range d {
+		if !de.IsDir() {
+			continue
+		}
+		if _, err := ParseClientID(de.Name()); err != nil {
+			continue
+		}
+		t1 := time.Now()
+		n, err := a.Archive(de.Name())
+		if err != nil {
+			slog.Error("error archiving client", "err", err, "id", de.Name())
+		} else if n > 0 {
+			slog.Info("client archived", "id", de.Name(), "chunks", n, "time", time.Since(t1).Milliseconds())
+		}
+	}
+}
+
+// Archive arquiva os chunks antigos do cliente e retorna a quantidade de
+// chunks arquivados
+func (a *Archiver) Archive(id string) (int, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Join(a.path, id)
+	l := maintenanceLock(dir)
+	l.Lock()
+	defer l.Unlock()
+
+	// sobras de arquivamentos interrompidos
+	if tmps, err := filepath.Glob(filepath.Join(dir, "*"+CarrySuffix+".tmp")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+
+	entries, err := LoadManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	group := a.selectChunks(entries)
+	// o saldo transportado sozinho não tem o que arquivar
+	if len(group) == 0 || (len(group) == 1 && group[0].IsCarry()) {
+		return 0, nil
+	}
+
+	rec, err := carryRecord(dir, cid, group)
+	if err != nil {
+		return 0, err
+	}
+	n, err := a.copyToArchive(dir, filepath.Join(a.archive, id), group)
+	if err != nil {
+		return 0, err
+	}
+	last := group[len(group)-1]
+	info := ChunkInfo{Name: last.Name + CarrySuffix, FirstSeq: group[0].FirstSeq, LastSeq: last.LastSeq, Sealed: true}
+	info.observe(rec.Timestamp())
+	err = writeCarry(filepath.Join(dir, info.Name), rec)
+	if err != nil {
+		return 0, err
+	}
+
+	// a entrada R no manifesto é o ponto de troca, como na compactação
+	ml := manifestLock(dir)
+	ml.Lock()
+	err = appendManifest(dir, manifestOp{op: opReplace, info: info})
+	ml.Unlock()
+	if err != nil {
+		os.Remove(filepath.Join(dir, info.Name))
+		return 0, err
+	}
+
+	// um checkpoint no meio dos chunks arquivados contaria de novo parte do
+	// saldo transportado. Checkpoints novos são sempre posteriores, já que os
+	// chunks selados mais recentes não são arquivados
+	if cp, err := ReadCheckpoint(dir); err == nil && cp.LastSeq < info.LastSeq {
+		os.Remove(filepath.Join(dir, CheckpointFile))
+	}
+	for _, e := range group {
+		os.Remove(filepath.Join(dir, e.Name))
+	}
+	return n, syncDir(dir)
+}
+
+// selectChunks retorna os primeiros chunks selados do cliente mais antigos que
+// MaxAge, sem os Keep chunks selados mais recentes
+func (a *Archiver) selectChunks(entries []ChunkInfo) []ChunkInfo {
+	keep := a.Keep
+	if keep < 1 {
+		keep = 1
+	}
+	sealed := sealedChunks(entries)
+	if len(sealed) <= keep {
+		return nil
+	}
+	limit := sealed[len(sealed)-keep].FirstSeq
+	cutoff := time.Now().Add(-a.MaxAge).UnixMilli()
+	group := make([]ChunkInfo, 0)
+	for _, e := range entries {
+		if !e.Sealed || e.FirstSeq >= limit || (e.Count > 0 && e.MaxTs >= cutoff) {
+			break
+		}
+		group = append(group, e)
+	}
+	return group
+}
+
+// carryRecord soma os registros dos chunks (incluindo um saldo transportado
+// anterior) em um novo registro de saldo transportado, que guarda também a
+// última alteração de limite e de estado
+func carryRecord(dir string, cid uint32, group []ChunkInfo) (Record, error) {
+	var (
+		sum Summary
+		ts  int64
+	)
+	for _, e := range group {
+		cr, err := openChunk(filepath.Join(dir, e.Name))
+		if errors.Is(err, ErrInvalidHeader) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for {
+			r, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				cr.Close()
+				return nil, fmt.Errorf("%s: %w", e.Name, err)
+			}
+			if !sum.add(r) {
+				cr.Close()
+				return nil, fmt.Errorf("%s: %w", e.Name, ErrOverflow)
+			}
+			if r.Timestamp() > ts {
+				ts = r.Timestamp()
+			}
+		}
+		cr.Close()
+	}
+	meta := map[string]string{"count": strconv.FormatInt(sum.Count, 10), "records": strconv.FormatInt(sum.Records, 10)}
+	if sum.HasLimit {
+		meta["limit"] = strconv.FormatInt(sum.Limit, 10)
+	}
+	if sum.State != "" {
+		meta["state"] = sum.State
+	}
+	return appendRecord(nil, cid, RecordCarry, ts, sum.Balance, "saldo anterior", meta)
+}
+
+// copyToArchive copia os chunks para o arquivo do cliente e os registra no
+// manifesto dele. Saldos transportados não são arquivados. A entrada R torna
+// a cópia idempotente
+func (a *Archiver) copyToArchive(dir, adir string, group []ChunkInfo) (int, error) {
+	err := os.MkdirAll(adir, 0755)
+	if err != nil {
+		return 0, err
+	}
+	_, err = LoadManifest(adir)
+	if err != nil {
+		return 0, err
+	}
+	archived := make([]ChunkInfo, 0, len(group))
+	for _, e := range group {
+		if e.IsCarry() {
+			continue
+		}
+		err = linkOrCopy(filepath.Join(dir, e.Name), filepath.Join(adir, e.Name))
+		if err != nil {
+			return 0, err
+		}
+		archived = append(archived, e)
+	}
+	err = syncDir(adir)
+	if err != nil {
+		return 0, err
+	}
+
+	l := manifestLock(adir)
+	l.Lock()
+	defer l.Unlock()
+	for _, e := range archived {
+		err = appendManifest(adir, manifestOp{op: opReplace, info: e})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(archived), nil
+}
+
+// linkOrCopy cria dst como hard link de src ou, em outro sistema de arquivos,
+// como cópia
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	_, err := copyFile(src, dst)
+	return err
+}
+
+// writeCarry grava o chunk de saldo transportado
+func writeCarry(path string, rec Record) error {
+	codec, err := CodecFor(CurrentFormat)
+	if err != nil {
+		return err
+	}
+	b, err := codec.Append(nil, rec)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w, ew, err := contentWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	err = WriteHeader(bw, codec.Version())
+	if err == nil {
+		_, err = bw.Write(b)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// NewArchiver cria o arquivamento do diretório de dados path. Sem archive, o
+// arquivo fica em path/archive
+func NewArchiver(path, archive string, maxAge time.Duration) *Archiver {
+	if archive == "" {
+		archive = filepath.Join(path, ArchiveDir)
+	}
+	return &Archiver{
+		path:    path,
+		archive: archive,
+		MaxAge:  maxAge,
+		Keep:    2,
+	}
+}
+
+// archiveReader é implementado pelos engines que arquivam o histórico antigo
+type archiveReader interface {
+	// ReadRangeArchive é o ReadRange incluindo o histórico arquivado
+	ReadRangeArchive(id string, from, to int64) ([]Record, error)
+	// IterateArchive é o Iterate incluindo o histórico arquivado no lugar
+	// dos saldos transportados
+	IterateArchive(id string) (Iterator, error)
+}
+
+// archived lista os chunks arquivados do cliente anteriores aos chunks em
+// uso. Cópias de um arquivamento interrompido ainda estão em uso
+func (frr *fileRegReader) archived(id string, live []ChunkInfo) ([]ChunkInfo, error) {
+	refs, err := listChunks(filepath.Join(frr.archive, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	limit := uint64(math.MaxUint64)
+	for _, c := range live {
+		if !c.IsCarry() {
+			limit = c.FirstSeq
+			break
+		}
+	}
+	i := sort.Search(len(refs), func(i int) bool {
+		return refs[i].LastSeq >= limit
+	})
+	return refs[:i], nil
+}
+
+func (frr *fileRegReader) ReadRangeArchive(id string, from, to int64) ([]Record, error) {
+	live, err := listChunks(filepath.Join(frr.path, id))
+	if err != nil {
+		return nil, err
+	}
+	refs, err := frr.archived(id, live)
+	if err != nil {
+		return nil, err
+	}
+	records, err := appendChunksRange(make([]Record, 0), filepath.Join(frr.archive, id), refs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	more, err := frr.ReadRange(id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(records, more...), nil
+}
+
+func (frr *fileRegReader) IterateArchive(id string) (Iterator, error) {
+	dir := filepath.Join(frr.path, id)
+	live, err := listChunks(dir)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := frr.archived(id, live)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveIterator{its: []*fileIterator{
+		{dir: filepath.Join(frr.archive, id), chunks: refs},
+		{dir: dir, chunks: live},
+	}}, nil
+}
+
+// archiveIterator percorre o arquivo e depois os chunks em uso, sem os
+// saldos transportados
+type archiveIterator struct {
+	its []*fileIterator
+}
+
+func (it *archiveIterator) Next() bool {
+	for len(it.its) > 0 {
+		cur := it.its[0]
+		for cur.Next() {
+			if cur.Record().Type() != RecordCarry {
+				return true
+			}
+		}
+		if cur.Err() != nil {
+			return false
+		}
+		cur.Close()
+		it.its = it.its[1:]
+	}
+	return false
+}
+
+func (it *archiveIterator) Record() Record {
+	return it.its[0].Record()
+}
+
+func (it *archiveIterator) Err() error {
+	if len(it.its) == 0 {
+		return nil
+	}
+	return it.its[0].Err()
+}
+
+func (it *archiveIterator) Close() error {
+	var err error
+	for _, i := range it.its {
+		if cerr := i.Close(); err == nil {
+			err = cerr
+		}
+	}
+	it.its = nil
+	return err
+}
@@ -0,0 +1,120 @@
+package db_test
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiver(t *testing.T) {
+	dir := t.TempDir()
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+
+	recent := time.Now().Add(-2 * time.Hour).UnixMilli()
+	for i := 0; i < 13; i++ {
+		ts := int64(i)
+		if i >= 10 {
+			ts = recent + int64(i)
+		}
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: ts, Value: 10, Type: "c", Description: "a"},
+			{Timestamp: ts, Value: 3, Type: "d", Description: "b"},
+		}))
+		if i == 2 {
+			require.NoError(t, d.Write("1", []*model.Transaction{
+				{Timestamp: ts, Value: 500, Type: string(db.RecordLimit), Description: "limite", Metadata: map[string]string{"previous": "100"}},
+			}))
+		}
+		if i == 4 {
+			require.NoError(t, d.Checkpoint("1"))
+		}
+	}
+
+	check := func(live int) {
+		bal, err := frr.GetBalance("1")
+		require.NoError(t, err)
+		require.Equal(t, int64(13*7), bal)
+		count, err := frr.Count("1")
+		require.NoError(t, err)
+		require.Equal(t, int64(26), count)
+		records, err := frr.Records("1")
+		require.NoError(t, err)
+		require.Equal(t, int64(27), records)
+		// a alteração de limite arquivada continua no saldo transportado
+		sum, err := d.ReadSummary("1")
+		require.NoError(t, err)
+		require.True(t, sum.HasLimit)
+		require.Equal(t, int64(500), sum.Limit)
+
+		tr, err := d.ReadRange("1", 0, math.MaxInt64)
+		require.NoError(t, err)
+		require.Len(t, tr, live)
+		tr, err = d.ReadHistory("1", 0, math.MaxInt64, db.HistoryOptions{IncludeArchive: true})
+		require.NoError(t, err)
+		require.Len(t, tr, 26)
+		require.Equal(t, int64(0), tr[0].Timestamp)
+
+		it, err := d.IterateHistory("1", db.HistoryOptions{IncludeArchive: true})
+		require.NoError(t, err)
+		n := 0
+		for it.Next() {
+			require.NotEqual(t, db.RecordCarry, it.Record().Type())
+			n++
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+		require.Equal(t, 27, n)
+
+		last, err := frr.ReadLast("1", 10)
+		require.NoError(t, err)
+		require.Len(t, last, min(live, 10))
+
+		for _, p := range []string{filepath.Join(dir, "1"), filepath.Join(dir, db.ArchiveDir, "1")} {
+			reports, err := db.Verify(p)
+			require.NoError(t, err)
+			require.Empty(t, reports)
+		}
+	}
+
+	a := db.NewArchiver(dir, "", 24*time.Hour)
+	n, err := a.Archive("1")
+	require.NoError(t, err)
+	require.Equal(t, 11, n)
+	check(6)
+
+	it, err := d.Iterate("1")
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	require.Equal(t, db.RecordCarry, it.Record().Type())
+	require.Equal(t, int64(10*7), it.Record().Value())
+	require.Equal(t, int64(20), it.Record().Transactions())
+	require.Equal(t, int64(21), it.Record().Records())
+	it.Close()
+
+	// nada mais com a idade mínima
+	n, err = a.Archive("1")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// o saldo transportado é somado ao próximo arquivamento
+	a.MaxAge = time.Hour
+	a.Keep = 1
+	n, err = a.Archive("1")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	check(2)
+
+	// a compactação não junta o saldo transportado a outros chunks
+	c := db.NewCompactor(dir)
+	c.Keep = 0
+	c.MinChunks = 1
+	_, err = c.Compact("1")
+	require.NoError(t, err)
+	check(2)
+}
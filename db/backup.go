@@ -0,0 +1,358 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ricardovhz/rinha2/model"
+)
+
+// estrutura do backup
+//
+//	<backup>/BACKUP        descrição do backup (JSON), gravada por último
+//	<backup>/<id>/...      manifesto, checkpoint e chunks selados do cliente
+//
+// um diretório sem o arquivo BACKUP é um backup incompleto e é recusado
+const BackupFile = "BACKUP"
+
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// BackupClient é o estado de um cliente no momento do backup. State é o nome
+// do estado da conta, vazio quando ativa, como no registro de clientes.
+// Files tem o sha256 de cada arquivo copiado
+type BackupClient struct {
+	ID      string            `json:"id"`
+	Limit   int64             `json:"limit"`
+	State   string            `json:"state,omitempty"`
+	Balance int64             `json:"balance"`
+	Count   int64             `json:"count"`
+	Files   map[string]string `json:"files"`
+}
+
+// BackupInfo descreve o backup. Keys são as chaves de idempotência dos
+// clientes do backup, com as respostas dadas até ele
+type BackupInfo struct {
+	Created time.Time          `json:"created"`
+	Clients []BackupClient     `json:"clients"`
+	Keys    []IdempotencyEntry `json:"keys,omitempty"`
+}
+
+// snapshotter é implementado pelos engines que sabem copiar os dados de um cliente
+type snapshotter interface {
+	Snapshot(id, dst string) (map[string]string, error)
+}
+
+// Snapshot copia para dst os dados do cliente, quando suportado pelo engine,
+// e retorna o sha256 de cada arquivo copiado
+func (db *DB) Snapshot(id, dst string) (map[string]string, error) {
+	if s, ok := db.r.(snapshotter); ok {
+		return s.Snapshot(id, dst)
+	}
+	return nil, errors.ErrUnsupported
+}
+
+func (frr *fileRegReader) Snapshot(id, dst string) (map[string]string, error) {
+	return SnapshotClient(filepath.Join(frr.path, id), dst)
+}
+
+// SnapshotClient copia para dst o checkpoint e os chunks selados do cliente,
+// com um manifesto apenas com eles. A cópia é feita com o manifestLock do
+// diretório: a compactação só remove os chunks de origem depois de registrar
+// o segmento, então os arquivos do manifesto lido continuam existindo
+func SnapshotClient(dir, dst string) (map[string]string, error) {
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return nil, err
+	}
+	_, err = LoadManifest(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// cliente sem nenhum chunk gravado
+		return snapshotManifest(dst, nil, map[string]string{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := manifestLock(dir)
+	l.Lock()
+	defer l.Unlock()
+	entries, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries = sealedChunks(entries)
+
+	sums := make(map[string]string, len(entries)+2)
+	names := []string{CheckpointFile}
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	for _, name := range names {
+		sum, err := copyFile(filepath.Join(dir, name), filepath.Join(dst, name))
+		if errors.Is(err, os.ErrNotExist) && name == CheckpointFile {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sums[name] = sum
+	}
+	return snapshotManifest(dst, entries, sums)
+}
+
+// snapshotManifest grava o manifesto do backup com os chunks copiados
+func snapshotManifest(dst string, entries []ChunkInfo, sums map[string]string) (map[string]string, error) {
+	err := rewriteManifest(dst, entries)
+	if err != nil {
+		return nil, err
+	}
+	sums[ManifestFile], err = fileSum(filepath.Join(dst, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// copyFile copia src para dst, sincronizando dst, e retorna o sha256 do conteúdo
+func copyFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteBackupInfo grava a descrição do backup, concluindo-o
+func WriteBackupInfo(dst string, info *BackupInfo) error {
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dst, BackupFile+".tmp")
+	err = os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dst, BackupFile))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dst)
+}
+
+// VerifyBackup confere o backup antes de uma restauração: os arquivos e seus
+// sha256, a consistência dos chunks (Verify) e o saldo e a quantidade de
+// registros de cada cliente, recalculados a partir dos chunks
+func VerifyBackup(src string) (*BackupInfo, error) {
+	b, err := os.ReadFile(filepath.Join(src, BackupFile))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	info := &BackupInfo{}
+	err = json.Unmarshal(b, info)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	for _, c := range info.Clients {
+		if _, err := ParseClientID(c.ID); err != nil {
+			return nil, fmt.Errorf("%w: client %q", ErrInvalidBackup, c.ID)
+		}
+		dir := filepath.Join(src, c.ID)
+		d, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if len(d) != len(c.Files) {
+			return nil, fmt.Errorf("%w: %s: %d files, expected %d", ErrInvalidBackup, c.ID, len(d), len(c.Files))
+		}
+		for name, sum := range c.Files {
+			got, err := fileSum(filepath.Join(dir, name))
+			if err != nil || got != sum {
+				return nil, fmt.Errorf("%w: %s/%s: checksum mismatch", ErrInvalidBackup, c.ID, name)
+			}
+		}
+
+		reports, err := Verify(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBackup, c.ID, err)
+		}
+		if len(reports) > 0 {
+			return nil, fmt.Errorf("%w: %s/%s: %s", ErrInvalidBackup, c.ID, reports[0].Chunk, reports[0].Problems[0])
+		}
+
+		bal, count, err := sumHistory(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBackup, c.ID, err)
+		}
+		// sem registros, o saldo é o inicial do cliente
+		if count != c.Count || (count > 0 && bal != c.Balance) {
+			return nil, fmt.Errorf("%w: %s: balance %d with %d records, expected %d with %d", ErrInvalidBackup, c.ID, bal, count, c.Balance, c.Count)
+		}
+	}
+	return info, nil
+}
+
+// sumHistory soma todo o histórico do cliente, sem usar o checkpoint
+func sumHistory(dir string) (int64, int64, error) {
+	chunks, err := listChunks(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	it := &fileIterator{dir: dir, chunks: chunks}
+	defer it.Close()
+	var bal, count int64
+	for it.Next() {
+		var ok bool
+		if bal, ok = model.AddAmount(bal, it.Record().Value()); !ok {
+			return 0, 0, ErrOverflow
+		}
+		count += it.Record().Transactions()
+	}
+	return bal, count, it.Err()
+}
+
+// RestoreBackup verifica o backup e substitui, no diretório de dados, os
+// diretórios dos clientes presentes nele, junto com os seus limites e as
+// suas chaves de idempotência. Clientes fora do backup não são alterados. O
+// WAL do store deve ser descartado junto, já que as suas entradas são
+// posteriores ao backup
+func RestoreBackup(src, path string) (*BackupInfo, error) {
+	info, err := VerifyBackup(src)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(info.Clients))
+	for _, c := range info.Clients {
+		ids = append(ids, c.ID)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		tmp := filepath.Join(path, id+".restore")
+		err = os.RemoveAll(tmp)
+		if err == nil {
+			err = os.MkdirAll(tmp, 0755)
+		}
+		if err != nil {
+			return nil, err
+		}
+		d, err := os.ReadDir(filepath.Join(src, id))
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range d {
+			_, err = copyFile(filepath.Join(src, id, de.Name()), filepath.Join(tmp, de.Name()))
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = syncDir(tmp)
+		if err == nil {
+			err = os.RemoveAll(filepath.Join(path, id))
+		}
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(path, id))
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifestSizes.Delete(filepath.Join(path, id, ManifestFile))
+	}
+	err = restoreClients(path, info)
+	if err != nil {
+		return nil, err
+	}
+	err = restoreKeys(path, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, syncDir(path)
+}
+
+// restoreKeys troca, no log de idempotência, as chaves dos clientes do backup
+// pelas chaves gravadas nele. Chaves de transações posteriores ao backup
+// responderiam como aplicadas transações desfeitas pela restauração
+func restoreKeys(path string, info *BackupInfo) error {
+	entries, err := readIdempotencyEntries(path)
+	if err != nil {
+		return err
+	}
+	restored := make(map[string]bool, len(info.Clients))
+	for _, c := range info.Clients {
+		restored[c.ID] = true
+	}
+	keys := make([]IdempotencyEntry, 0, len(entries)+len(info.Keys))
+	for _, e := range entries {
+		if !restored[e.Client] {
+			keys = append(keys, e)
+		}
+	}
+	for _, e := range info.Keys {
+		if restored[e.Client] {
+			keys = append(keys, e)
+		}
+	}
+	return writeIdempotencyEntries(path, keys)
+}
+
+// restoreClients grava no registro de clientes os limites e os estados do
+// backup. Clientes já registrados mantêm a data de criação, e os que estão
+// fora do backup continuam registrados
+func restoreClients(path string, info *BackupInfo) error {
+	clients, err := ReadClients(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	idx := make(map[string]int, len(clients))
+	for i, c := range clients {
+		idx[c.ID] = i
+	}
+	for _, c := range info.Clients {
+		if i, ok := idx[c.ID]; ok {
+			clients[i].Limit, clients[i].State = c.Limit, c.State
+			continue
+		}
+		clients = append(clients, ClientConfig{ID: c.ID, Limit: c.Limit, State: c.State, Created: info.Created})
+	}
+	return WriteClients(path, clients)
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+
+	"github.com/ricardovhz/rinha2/model"
+)
+
+// balanceAtReader é implementado pelos engines que calculam o saldo em um
+// instante sem percorrer todo o histórico
+type balanceAtReader interface {
+	BalanceAt(id string, ts int64) (int64, error)
+}
+
+// BalanceAt retorna o saldo do cliente considerando apenas as transações com
+// timestamp até ts (unix millis, inclusive). Um cliente sem histórico tem
+// saldo zero em qualquer instante. Engines sem uma implementação própria
+// percorrem todo o histórico
+func (db *DB) BalanceAt(id string, ts int64) (int64, error) {
+	if b, ok := db.r.(balanceAtReader); ok {
+		return b.BalanceAt(id, ts)
+	}
+	it, err := db.r.Iterate(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	defer it.Close()
+	var bal int64
+	for it.Next() {
+		if r := it.Record(); r.Timestamp() <= ts {
+			var ok bool
+			if bal, ok = model.AddAmount(bal, r.Value()); !ok {
+				return -1, ErrOverflow
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return -1, err
+	}
+	return bal, nil
+}
+
+// BalanceAt usa os timestamps mínimo e máximo de cada chunk, gravados no
+// manifesto, e o checkpoint para ler o mínimo de chunks, escolhendo entre
+// somar os registros até ts (a partir do checkpoint, quando todo o histórico
+// até ele é anterior a ts) ou subtrair do saldo atual os registros
+// posteriores a ts. Se um arquivo sumir durante a leitura (compactação ou
+// arquivamento concluídos), a listagem é refeita
+func (frr *fileRegReader) BalanceAt(id string, ts int64) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		bal, err := frr.tryBalanceAt(id, ts)
+		if errors.Is(err, fs.ErrNotExist) && attempt < 3 {
+			continue
+		}
+		return bal, err
+	}
+}
+
+// balanceRef localiza um chunk no diretório do cliente ou no arquivo
+type balanceRef struct {
+	dir  string
+	info ChunkInfo
+}
+
+func (frr *fileRegReader) tryBalanceAt(id string, ts int64) (int64, error) {
+	dir := filepath.Join(frr.path, id)
+	live, err := listChunks(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// cliente sem histórico
+		return 0, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	cp, err := ReadCheckpoint(dir)
+	if err != nil {
+		cp = &Checkpoint{}
+	}
+
+	// um saldo transportado com registros posteriores a ts é trocado pelos
+	// chunks arquivados que ele resume
+	refs := make([]balanceRef, 0, len(live))
+	for _, c := range live {
+		if !c.IsCarry() || c.MaxTs <= ts {
+			refs = append(refs, balanceRef{dir: dir, info: c})
+			continue
+		}
+		archived, err := frr.archived(id, live)
+		if err != nil {
+			return -1, err
+		}
+		if len(archived) == 0 {
+			return -1, fmt.Errorf("%s: %w", c.Name, ErrArchiveUnavailable)
+		}
+		for _, a := range archived {
+			refs = append(refs, balanceRef{dir: filepath.Join(frr.archive, id), info: a})
+		}
+	}
+
+	// custo de cada caminho, em registros lidos
+	after := chunksAfter(live, cp.LastSeq)
+	useCp := cp.LastSeq > 0
+	var forward, backward int64
+	for _, r := range refs {
+		if r.info.FirstSeq <= cp.LastSeq && r.info.Count > 0 && r.info.MaxTs > ts {
+			useCp = false
+		}
+		if r.info.MaxTs > ts {
+			backward += r.info.Count
+		}
+	}
+	for _, c := range after {
+		backward += c.Count
+	}
+	for _, r := range refs {
+		if r.info.MinTs <= ts && (!useCp || r.info.LastSeq > cp.LastSeq) {
+			forward += r.info.Count
+		}
+	}
+
+	if forward <= backward {
+		var (
+			bal int64
+			seq uint64
+		)
+		if useCp {
+			bal, seq = cp.Balance, cp.LastSeq
+		}
+		for _, r := range refs {
+			if r.info.Count == 0 || r.info.MinTs > ts || r.info.LastSeq <= seq {
+				continue
+			}
+			s, err := sumChunk(r, seq, func(t int64) bool { return t <= ts })
+			if err != nil {
+				return -1, err
+			}
+			var ok bool
+			if bal, ok = model.AddAmount(bal, s); !ok {
+				return -1, ErrOverflow
+			}
+		}
+		return bal, nil
+	}
+
+	// saldo atual, como em trySummary, menos os registros posteriores a ts
+	bal := cp.Balance
+	for _, c := range after {
+		s, err := sumChunk(balanceRef{dir: dir, info: c}, cp.LastSeq, func(int64) bool { return true })
+		if err != nil {
+			return -1, err
+		}
+		var ok bool
+		if bal, ok = model.AddAmount(bal, s); !ok {
+			return -1, ErrOverflow
+		}
+	}
+	for _, r := range refs {
+		if r.info.Count == 0 || r.info.MaxTs <= ts {
+			continue
+		}
+		s, err := sumChunk(r, 0, func(t int64) bool { return t > ts })
+		if err != nil {
+			return -1, err
+		}
+		var ok bool
+		if bal, ok = model.AddAmount(bal, -s); !ok || s == math.MinInt64 {
+			return -1, ErrOverflow
+		}
+	}
+	return bal, nil
+}
+
+// sumChunk soma os valores dos registros do chunk posteriores à sequência seq
+// cujo timestamp satisfaz match
+func sumChunk(r balanceRef, seq uint64, match func(ts int64) bool) (int64, error) {
+	cr, err := openChunk(filepath.Join(r.dir, r.info.Name))
+	if err != nil {
+		return 0, err
+	}
+	defer cr.Close()
+	cr.skipThrough(r.info.FirstSeq, seq)
+	var sum int64
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return sum, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", r.info.Name, err)
+		}
+		if !match(rec.Timestamp()) {
+			continue
+		}
+		var ok bool
+		if sum, ok = model.AddAmount(sum, rec.Value()); !ok {
+			return 0, fmt.Errorf("%s: %w", r.info.Name, ErrOverflow)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalanceAt(t *testing.T) {
+	dir := t.TempDir()
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+
+	// 20 chunks, com timestamps i*10 e i*10+5
+	now := time.Now().UnixMilli()
+	old := now - (48 * time.Hour).Milliseconds()
+	ts := func(i int) int64 {
+		if i < 10 {
+			return old + int64(i*10)
+		}
+		return now + int64(i*10)
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: ts(i), Value: 10, Type: "c", Description: "a"},
+			{Timestamp: ts(i) + 5, Value: 3, Type: "d", Description: "b"},
+		}))
+	}
+
+	check := func() {
+		for i := 0; i < 20; i++ {
+			bal, err := d.BalanceAt("1", ts(i)-1)
+			require.NoError(t, err)
+			require.Equal(t, int64(i*7), bal, i)
+			bal, err = d.BalanceAt("1", ts(i))
+			require.NoError(t, err)
+			require.Equal(t, int64(i*7+10), bal, i)
+		}
+		bal, err := d.BalanceAt("1", ts(19)+5)
+		require.NoError(t, err)
+		require.Equal(t, int64(20*7), bal)
+	}
+	check()
+
+	require.NoError(t, d.Checkpoint("1"))
+	check()
+
+	c := db.NewCompactor(dir)
+	c.MinChunks = 2
+	c.MaxChunks = 4
+	c.Keep = 2
+	_, err := c.Compact("1")
+	require.NoError(t, err)
+	check()
+
+	// o histórico arquivado substitui o saldo transportado
+	a := db.NewArchiver(dir, "", 24*time.Hour)
+	n, err := a.Archive("1")
+	require.NoError(t, err)
+	require.NotZero(t, n)
+	check()
+
+	// sem o arquivo só há o saldo a partir do transportado
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, db.ArchiveDir)))
+	bal, err := d.BalanceAt("1", ts(15))
+	require.NoError(t, err)
+	require.Equal(t, int64(15*7+10), bal)
+	_, err = d.BalanceAt("1", ts(5))
+	require.ErrorIs(t, err, db.ErrArchiveUnavailable)
+}
+
+func TestBalanceAtEmptyClient(t *testing.T) {
+	dir := t.TempDir()
+	sq, err := db.OpenSQLite(filepath.Join(dir, "ledger.db"))
+	require.NoError(t, err)
+	defer sq.Close()
+	mem := db.NewMemoryEngine()
+	files := filepath.Join(dir, "files")
+	engines := map[string]*db.DB{
+		"file":   db.NewDB(db.NewFileWriterFactoryFromPath(files), db.NewFileRegReader(files)),
+		"memory": db.NewDB(mem, mem),
+		"sqlite": db.NewDB(sq, sq),
+	}
+	for name, d := range engines {
+		for _, ts := range []int64{0, time.Now().UnixMilli()} {
+			bal, err := d.BalanceAt("1", ts)
+			require.NoError(t, err, name)
+			require.Equal(t, int64(0), bal, name)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// estrutura do checkpoint
+//
+//	   magic      version                balance (int64)  count (int64)  records (int64)  limit (int64)  last seq (uint64)  last chunk      state       crc32
+//	|-----------|  |---|  reserved    |-------------| |------------| |-------------| |------------| |-------------| |------------| |--------| |-----------|
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+...+---+---+...+---+---+...+---+---+...+---+---+---+...+---+---+...+---+---+---+---+---+
+//	| 0 | C | K | P | 5 | 0 | 0 | 0 | x | x | x | x | x |   | x | x |   | x | x |   | x | x |   | x | n | x |   | x | n |   | x | 0 | 0 | 0 | 0 |
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+...+---+---+...+---+---+...+---+---+...+---+---+---+...+---+---+...+---+---+---+---+---+
+//
+// o nome do último chunk e o estado são precedidos pelo seu tamanho (1 byte).
+// limit é -1 quando o histórico não tem alteração de limite. Checkpoints de
+// versões anteriores (sem a sequência do manifesto, com saldo int32 ou sem
+// as quantidades de registros, o limite e o estado) são ignorados
+const CheckpointFile = "CHECKPOINT"
+
+var checkpointMagic = [4]byte{0, 'C', 'K', 'P'}
+
+const checkpointVersion = 5
+
+// tamanho do checkpoint sem o nome do último chunk e sem o estado
+const checkpointMinSize = 8 + 8 + 8 + 8 + 8 + 8 + 1 + 1 + 4
+
+var ErrInvalidCheckpoint = errors.New("invalid checkpoint")
+
+// Checkpoint guarda o resumo de um cliente considerando todos os chunks até a
+// sequência LastSeq (inclusive)
+type Checkpoint struct {
+	Summary
+	LastSeq   uint64
+	LastChunk string
+}
+
+func (cp *Checkpoint) encode() []byte {
+	b := make([]byte, 0, checkpointMinSize+len(cp.LastChunk)+len(cp.State))
+	b = append(b, checkpointMagic[:]...)
+	b = append(b, checkpointVersion, 0, 0, 0)
+	b = binary.LittleEndian.AppendUint64(b, uint64(cp.Balance))
+	b = binary.LittleEndian.AppendUint64(b, uint64(cp.Count))
+	b = binary.LittleEndian.AppendUint64(b, uint64(cp.Records))
+	limit := int64(-1)
+	if cp.HasLimit {
+		limit = cp.Limit
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(limit))
+	b = binary.LittleEndian.AppendUint64(b, cp.LastSeq)
+	b = append(b, byte(len(cp.LastChunk)))
+	b = append(b, cp.LastChunk...)
+	b = append(b, byte(len(cp.State)))
+	b = append(b, cp.State...)
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+func decodeCheckpoint(b []byte) (*Checkpoint, error) {
+	if len(b) < checkpointMinSize || !bytes.Equal(b[:4], checkpointMagic[:]) || b[4] != checkpointVersion {
+		return nil, ErrInvalidCheckpoint
+	}
+	sum := binary.LittleEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(b[:len(b)-4]) != sum {
+		return nil, ErrInvalidCheckpoint
+	}
+	n := int(b[48])
+	if len(b) < checkpointMinSize+n {
+		return nil, ErrInvalidCheckpoint
+	}
+	ns := int(b[49+n])
+	if len(b) != checkpointMinSize+n+ns {
+		return nil, ErrInvalidCheckpoint
+	}
+	cp := &Checkpoint{
+		Summary: Summary{
+			Balance: int64(binary.LittleEndian.Uint64(b[8:16])),
+			Count:   int64(binary.LittleEndian.Uint64(b[16:24])),
+			Records: int64(binary.LittleEndian.Uint64(b[24:32])),
+			State:   string(b[50+n : 50+n+ns]),
+		},
+		LastSeq:   binary.LittleEndian.Uint64(b[40:48]),
+		LastChunk: string(b[49 : 49+n]),
+	}
+	if limit := int64(binary.LittleEndian.Uint64(b[32:40])); limit >= 0 {
+		cp.Limit, cp.HasLimit = limit, true
+	}
+	return cp, nil
+}
+
+// ReadCheckpoint lê o checkpoint do diretório do cliente
+func ReadCheckpoint(dir string) (*Checkpoint, error) {
+	b, err := os.ReadFile(filepath.Join(dir, CheckpointFile))
+	if err != nil {
+		return nil, err
+	}
+	return decodeCheckpoint(b)
+}
+
+// WriteCheckpoint grava o checkpoint de forma atômica (arquivo temporário + rename)
+func WriteCheckpoint(dir string, cp *Checkpoint) error {
+	tmp := filepath.Join(dir, CheckpointFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(cp.encode())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(dir, CheckpointFile))
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
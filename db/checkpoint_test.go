@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+
+	tr := []*model.Transaction{
+		{Timestamp: 1, Value: 100, Type: "c", Description: "a"},
+		{Timestamp: 2, Value: 30, Type: "d", Description: "b"},
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, d.Write("1", tr))
+	}
+	require.NoError(t, d.Checkpoint("1"))
+
+	cp, err := db.ReadCheckpoint(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Equal(t, int64(210), cp.Balance)
+	require.Equal(t, int64(6), cp.Count)
+
+	// checkpoint corrompido é ignorado
+	b, err := os.ReadFile(filepath.Join(dir, "1", db.CheckpointFile))
+	require.NoError(t, err)
+	b[9]++
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1", db.CheckpointFile), b, 0644))
+	bal, err := frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(210), bal)
+	require.NoError(t, d.Checkpoint("1"))
+
+	// os chunks anteriores ao checkpoint não são mais lidos
+	entries, err := os.ReadDir(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	for _, e := range entries {
+		if e.Name() != db.CheckpointFile && e.Name() != db.ManifestFile {
+			require.NoError(t, os.Remove(filepath.Join(dir, "1", e.Name())))
+		}
+	}
+	require.NoError(t, d.Write("1", tr))
+
+	bal, err = frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(280), bal)
+	count, err := frr.Count("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(8), count)
+
+}
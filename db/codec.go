@@ -0,0 +1,129 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// Codec lê e grava os registros de uma versão do formato de chunk. Os
+// leitores escolhem o codec pela versão gravada no cabeçalho do arquivo e o
+// DB grava os chunks novos com o codec configurado
+type Codec interface {
+	// Version é a versão gravada no cabeçalho dos arquivos deste codec
+	Version() byte
+	// Append acrescenta a b o registro codificado nesta versão
+	Append(b []byte, r Record) ([]byte, error)
+	// Read lê o próximo registro e o converte para o formato atual. Retorna
+	// io.EOF no fim dos dados e io.ErrUnexpectedEOF para um registro incompleto
+	Read(r io.Reader) (Record, error)
+}
+
+// formatos antigos só são lidos
+var ErrReadOnlyFormat = errors.New("read-only record format")
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		FormatV1: fixedCodec{version: FormatV1, size: RecordV1Size, decode: UpgradeV1},
+		FormatV2: fixedCodec{version: FormatV2, size: RecordV2Size, decode: upgradeV3},
+		FormatV3: fixedCodec{version: FormatV3, size: RecordV3Size, decode: checked(recordV3DataSize, upgradeV3)},
+		FormatV4: fixedCodec{version: FormatV4, size: RecordV4Size, decode: checked(recordV4DataSize, upgradeV4)},
+		FormatV5: recordCodec{},
+	}
+)
+
+// RegisterCodec registra um codec para a sua versão, substituindo o anterior
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Version()] = c
+}
+
+// CodecFor retorna o codec registrado para a versão
+func CodecFor(version byte) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[version]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return c, nil
+}
+
+// recordCodec é o codec do formato atual, em que o registro em disco é o
+// próprio Record
+type recordCodec struct{}
+
+func (recordCodec) Version() byte {
+	return FormatV5
+}
+
+func (recordCodec) Append(b []byte, r Record) ([]byte, error) {
+	return append(b, r...), nil
+}
+
+func (recordCodec) Read(r io.Reader) (Record, error) {
+	l := [2]byte{}
+	n, err := io.ReadFull(r, l[:])
+	if err != nil {
+		if n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint16(l[:]))
+	if size < recordMinSize {
+		return nil, ErrInvalidRecord
+	}
+	rec := make(Record, size)
+	copy(rec, l[:])
+	_, err = io.ReadFull(r, rec[2:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !rec.Valid() {
+		return rec, ErrChecksum
+	}
+	return rec, nil
+}
+
+// fixedCodec lê os registros de tamanho fixo das versões anteriores
+type fixedCodec struct {
+	version byte
+	size    int
+	decode  func(b []byte) (Record, error)
+}
+
+func (c fixedCodec) Version() byte {
+	return c.version
+}
+
+func (c fixedCodec) Append(b []byte, r Record) ([]byte, error) {
+	return b, ErrReadOnlyFormat
+}
+
+func (c fixedCodec) Read(r io.Reader) (Record, error) {
+	b := make([]byte, c.size)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(b)
+}
+
+// checked valida o crc32 gravado depois dos dataSize bytes do registro
+func checked(dataSize int, decode func(b []byte) (Record, error)) func(b []byte) (Record, error) {
+	return func(b []byte) (Record, error) {
+		r, err := decode(b)
+		if err == nil && binary.LittleEndian.Uint32(b[dataSize:]) != crc32.ChecksumIEEE(b[:dataSize]) {
+			err = ErrChecksum
+		}
+		return r, err
+	}
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Compactor junta chunks antigos de cada cliente em segmentos selados,
+// reduzindo a quantidade de arquivos pequenos no diretório de dados
+type Compactor struct {
+	path string
+
+	// Keep é a quantidade de chunks mais recentes que nunca são compactados
+	Keep int
+	// MinChunks é a quantidade mínima de chunks consecutivos para gerar um segmento
+	MinChunks int
+	// MaxChunks é a quantidade máxima de chunks em um segmento
+	MaxChunks int
+	// Compress grava os segmentos comprimidos (ver compress.go). Os chunks
+	// mais recentes, ainda não compactados, continuam sem compressão
+	Compress bool
+}
+
+// Run executa a compactação de todos os clientes a cada intervalo, até o
+// contexto ser cancelado
+func (c *Compactor) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.CompactAll()
+		}
+	}
+}
+
+// CompactAll compacta os chunks de todos os clientes do diretório de dados
+func (c *Compactor) CompactAll() {
+	d, err := os.ReadDir(c.path)
+	if err != nil {
+		slog.Error("error listing clients", "err", err, "path", c.path)
+		return
+	}
+	for _, de := range d {
+		if !de.IsDir() {
+			continue
+		}
+		if _, err := ParseClientID(de.Name()); err != nil {
+			continue
+		}
+		t1 := time.Now()
+		n, err := c.Compact(de.Name())
+		if err != nil {
+			slog.Error("error compacting client", "err", err, "id", de.Name())
+		} else if n > 0 {
+			slog.Info("client compacted", "id", de.Name(), "chunks", n, "time", time.Since(t1).Milliseconds())
+		}
+	}
+}
+
+// Compact junta os chunks antigos do cliente em segmentos e retorna a
+// quantidade de chunks compactados
+func (c *Compactor) Compact(id string) (int, error) {
+	dir := filepath.Join(c.path, id)
+
+	// sobras de compactações interrompidas
+	if tmps, err := filepath.Glob(filepath.Join(dir, "*"+SegmentSuffix+".tmp")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+
+	l := maintenanceLock(dir)
+	l.Lock()
+	defer l.Unlock()
+
+	entries, err := LoadManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) <= c.Keep {
+		return 0, nil
+	}
+	entries = entries[:len(entries)-c.Keep]
+
+	total := 0
+	group := make([]ChunkInfo, 0, c.MaxChunks)
+	compact := func() error {
+		if len(group) >= c.MinChunks {
+			err := c.writeSegment(dir, group)
+			if err != nil {
+				return err
+			}
+			total += len(group)
+		}
+		group = group[:0]
+		return nil
+	}
+	for _, e := range entries {
+		if !e.Sealed || e.IsSegment() || e.IsCarry() {
+			if err := compact(); err != nil {
+				return total, err
+			}
+			continue
+		}
+		group = append(group, e)
+		if len(group) == c.MaxChunks {
+			if err := compact(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, compact()
+}
+
+// writeSegment grava o segmento em um arquivo temporário e o registra no
+// manifesto no lugar dos chunks de origem. Só depois eles são removidos
+func (c *Compactor) writeSegment(dir string, group []ChunkInfo) error {
+	name := group[0].Name + "-" + group[len(group)-1].Name + SegmentSuffix
+	tmp := filepath.Join(dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	codec, err := CodecFor(CurrentFormat)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	out, ew, err := contentWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	bw := bufio.NewWriterSize(out, 64*1024)
+	var flags byte
+	if c.Compress {
+		flags = headerCompressed
+	}
+	err = writeHeader(bw, codec.Version(), flags)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	info := ChunkInfo{Name: name, FirstSeq: group[0].FirstSeq, LastSeq: group[len(group)-1].LastSeq, Sealed: true}
+	cw := &countingWriter{w: bw, n: HeaderSize}
+	var zw *flate.Writer
+	index := make([]segmentEntry, 0, len(group))
+	for _, ref := range group {
+		off := cw.n
+		var w io.Writer = cw
+		if c.Compress {
+			if zw == nil {
+				zw, err = flate.NewWriter(cw, flate.DefaultCompression)
+			} else {
+				zw.Reset(cw)
+			}
+			w = zw
+		}
+		e, err := copyChunk(w, codec, filepath.Join(dir, ref.Name), c.Compress)
+		if err == nil && zw != nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		e.chunk = ref.Name
+		e.offset = off
+		index = append(index, e)
+		if e.count > 0 {
+			if info.Count == 0 || e.minTs < info.MinTs {
+				info.MinTs = e.minTs
+			}
+			if info.Count == 0 || e.maxTs > info.MaxTs {
+				info.MaxTs = e.maxTs
+			}
+			info.Count += int64(e.count)
+		}
+	}
+
+	b := appendSegmentIndex(nil, index)
+	b = appendSegmentTrailer(b, cw.n, len(index))
+	_, err = bw.Write(b)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	err = syncDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// a entrada R no manifesto é o ponto de troca: antes dela os leitores
+	// enxergam os chunks, depois dela o segmento
+	l := manifestLock(dir)
+	l.Lock()
+	err = appendManifest(dir, manifestOp{op: opReplace, info: info})
+	l.Unlock()
+	if err != nil {
+		os.Remove(filepath.Join(dir, name))
+		return err
+	}
+
+	for _, ref := range group {
+		os.Remove(filepath.Join(dir, ref.Name))
+	}
+	return syncDir(dir)
+}
+
+// copyChunk copia os registros do chunk para o segmento, no formato do codec.
+// Com delta, os timestamps são gravados como diferença para o registro anterior
+func copyChunk(w io.Writer, codec Codec, path string, delta bool) (segmentEntry, error) {
+	e := segmentEntry{}
+	cr, err := openChunk(path)
+	if errors.Is(err, ErrInvalidHeader) {
+		// chunk interrompido antes do fim do cabeçalho, não há registros
+		return e, nil
+	}
+	if err != nil {
+		return e, err
+	}
+	defer cr.Close()
+	var (
+		buf  []byte
+		prev int64
+	)
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// não sela registros corrompidos, o chunk precisa passar pela recuperação
+			return e, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		ts := r.Timestamp()
+		if e.count == 0 || ts < e.minTs {
+			e.minTs = ts
+		}
+		if e.count == 0 || ts > e.maxTs {
+			e.maxTs = ts
+		}
+		buf, err = codec.Append(buf[:0], r)
+		if err != nil {
+			return e, err
+		}
+		if delta {
+			prev = deltaTimestamp(buf, prev)
+		}
+		_, err = w.Write(buf)
+		if err != nil {
+			return e, err
+		}
+		e.count++
+	}
+	return e, nil
+}
+
+func NewCompactor(path string) *Compactor {
+	return &Compactor{
+		path:      path,
+		Keep:      2,
+		MinChunks: 32,
+		MaxChunks: 1000,
+		Compress:  true,
+	}
+}
@@ -0,0 +1,137 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactor(t *testing.T) {
+	dir := t.TempDir()
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+
+	for i := 0; i < 40; i++ {
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: int64(i), Value: 10, Type: "c", Description: "a"},
+			{Timestamp: int64(i), Value: 3, Type: "d", Description: "b"},
+		}))
+		if i == 20 {
+			require.NoError(t, d.Checkpoint("1"))
+		}
+	}
+	last, err := frr.ReadLast("1", 5)
+	require.NoError(t, err)
+
+	c := db.NewCompactor(dir)
+	c.MinChunks = 4
+	c.MaxChunks = 16
+	n, err := c.Compact("1")
+	require.NoError(t, err)
+	require.Equal(t, 38, n)
+
+	entries, err := os.ReadDir(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	segments := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), db.SegmentSuffix) {
+			segments++
+		}
+	}
+	require.Equal(t, 3, segments)
+
+	// o checkpoint aponta para um chunk que agora está no meio de um segmento
+	bal, err := frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(40*7), bal)
+	count, err := frr.Count("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(80), count)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "1", db.CheckpointFile)))
+	bal, err = frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(40*7), bal)
+
+	last2, err := frr.ReadLast("1", 5)
+	require.NoError(t, err)
+	require.Equal(t, last, last2)
+
+	// nada mais a compactar
+	n, err = c.Compact("1")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestCompactorCompression(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	for _, dir := range dirs {
+		d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+		for i := 0; i < 20; i++ {
+			tr := make([]*model.Transaction, 50)
+			for j := range tr {
+				ts := int64(1708169655190 + i*50 + j)
+				tr[j] = &model.Transaction{Timestamp: ts, Value: int64(j + 1), Type: "c", Description: "pagamento"}
+			}
+			require.NoError(t, d.Write("1", tr))
+		}
+	}
+
+	sizes := make([]int64, 2)
+	for i, dir := range dirs {
+		c := db.NewCompactor(dir)
+		c.MinChunks = 4
+		c.MaxChunks = 8
+		c.Compress = i == 1
+		_, err := c.Compact("1")
+		require.NoError(t, err)
+		entries, err := db.LoadManifest(filepath.Join(dir, "1"))
+		require.NoError(t, err)
+		for _, e := range entries {
+			if e.IsSegment() {
+				st, err := os.Stat(filepath.Join(dir, "1", e.Name))
+				require.NoError(t, err)
+				sizes[i] += st.Size()
+			}
+		}
+	}
+	require.Less(t, sizes[1]*3, sizes[0])
+
+	results := make([][]any, 2)
+	for i, dir := range dirs {
+		frr := db.NewFileRegReader(dir)
+		last, err := frr.ReadLast("1", 60)
+		require.NoError(t, err)
+		rng, err := frr.ReadRange("1", 1708169655190+390, 1708169655190+420)
+		require.NoError(t, err)
+		bal, err := frr.GetBalance("1")
+		require.NoError(t, err)
+		reports, err := db.Verify(filepath.Join(dir, "1"))
+		require.NoError(t, err)
+		require.Empty(t, reports)
+		results[i] = []any{last, rng, bal}
+	}
+	require.Equal(t, results[0], results[1])
+	require.Len(t, results[1][1], 31)
+	require.Equal(t, int64(20*50*51/2), results[1][2])
+
+	// bloco comprimido corrompido
+	dir := dirs[1]
+	entries, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	path := filepath.Join(dir, "1", entries[0].Name)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[db.HeaderSize+40] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	_, err = db.NewFileRegReader(dir).GetBalance("1")
+	require.ErrorIs(t, err, db.ErrChecksum)
+	reports, err := db.Verify(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// compressão dos segmentos
+//
+// com a flag headerCompressed no cabeçalho (byte 5), a área de registros é uma
+// sequência de blocos, um por chunk de origem (entrada do índice do
+// segmento), cada um comprimido de forma independente com flate (deflate
+// puro). O offset de cada entrada do índice aponta para o início do seu
+// bloco, então a leitura continua podendo pular chunks de origem.
+//
+// dentro do bloco os registros estão no formato atual, mas com o timestamp
+// gravado como a diferença para o registro anterior (o primeiro, para zero).
+// O crc32 é o do registro original e é conferido depois de restaurar o
+// timestamp
+const (
+	headerFlagsOffset = 5
+
+	headerCompressed byte = 1 << 0
+)
+
+// deltaTimestamp troca o timestamp do registro codificado em b pela
+// diferença para prev e retorna o timestamp original
+func deltaTimestamp(b []byte, prev int64) int64 {
+	ts := int64(binary.LittleEndian.Uint64(b[recordTsOffset:]))
+	binary.LittleEndian.PutUint64(b[recordTsOffset:], uint64(ts-prev))
+	return ts
+}
+
+// readCompressed lê o próximo registro de um arquivo comprimido. No fim de
+// um bloco, o próximo (se houver) é um novo stream flate
+func (cr *chunkReader) readCompressed() (Record, error) {
+	l := [2]byte{}
+	for {
+		_, err := io.ReadFull(cr.z, l[:])
+		if err == io.EOF {
+			if _, perr := cr.b.Peek(1); perr != nil {
+				return nil, io.EOF
+			}
+			err = cr.z.(flate.Resetter).Reset(cr.b, nil)
+			if err != nil {
+				return nil, err
+			}
+			cr.prev = 0
+			continue
+		}
+		if err != nil {
+			return nil, compressedErr(err)
+		}
+		break
+	}
+	size := int(binary.LittleEndian.Uint16(l[:]))
+	if size < recordMinSize {
+		return nil, fmt.Errorf("%w: invalid record size %d", ErrChecksum, size)
+	}
+	rec := make(Record, size)
+	copy(rec, l[:])
+	_, err := io.ReadFull(cr.z, rec[2:])
+	if err != nil {
+		return nil, compressedErr(err)
+	}
+	cr.prev += int64(binary.LittleEndian.Uint64(rec[recordTsOffset:]))
+	binary.LittleEndian.PutUint64(rec[recordTsOffset:], uint64(cr.prev))
+	if !rec.Valid() {
+		return rec, ErrChecksum
+	}
+	return rec, nil
+}
+
+// arquivos comprimidos são gravados de forma atômica, então um bloco
+// incompleto ou inválido é corrupção
+func compressedErr(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", ErrChecksum, err)
+}
+
+// countingWriter conta os bytes gravados, para calcular os offsets dos blocos
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,487 @@
+package db
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// criptografia dos chunks
+//
+// com um keyring configurado (SetKeyring), os chunks e segmentos novos são
+// gravados cifrados com AES-256-GCM pela chave ativa. O arquivo cifrado começa
+// com um cabeçalho próprio:
+//
+//	magic {0,'R','N','E'} | versão | tamanho do id da chave | id da chave | nonce (8 bytes)
+//
+// seguido do conteúdo do arquivo em claro (cabeçalho do chunk, registros e
+// índice do segmento) dividido em frames de encFrameSize bytes, cada um
+// cifrado de forma independente. O nonce de um frame é o nonce do arquivo
+// seguido do número do frame; o cabeçalho, o número do frame e a marca de
+// último frame são autenticados, então frames trocados, removidos ou de outro
+// arquivo são detectados. A leitura decifra frame a frame, mantendo os offsets
+// do conteúdo em claro (índice dos segmentos, leitura do fim do chunk).
+//
+// o WAL, o manifesto e o checkpoint não são cifrados
+const (
+	encVersion   byte = 1
+	encFrameSize      = 64 * 1024
+	encNonceSize      = 8
+	encKeySize        = 32
+)
+
+var encMagic = [4]byte{0, 'R', 'N', 'E'}
+
+var (
+	ErrUnknownKey = errors.New("unknown encryption key")
+	ErrInvalidKey = errors.New("invalid encryption key")
+	ErrNoKeyring  = errors.New("no encryption key configured")
+)
+
+// Keyring guarda as chaves por id. Os arquivos são gravados com a chave ativa
+// e lidos com a chave do id gravado no arquivo, então chaves antigas devem
+// continuar no keyring até os arquivos serem cifrados de novo (Reencrypt)
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]cipher.AEAD)}
+}
+
+// Add registra uma chave AES-256. A primeira chave registrada é a ativa
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || len(id) > 255 || strings.ContainsAny(id, ":,# \t\r\n") {
+		return fmt.Errorf("%w: id %q", ErrInvalidKey, id)
+	}
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("%w: duplicated id %q", ErrInvalidKey, id)
+	}
+	if len(key) != encKeySize {
+		return fmt.Errorf("%w: %s: %d bytes, expected %d", ErrInvalidKey, id, len(key), encKeySize)
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = aead
+	if k.active == "" {
+		k.active = id
+	}
+	return nil
+}
+
+// SetActive troca a chave usada nas gravações
+func (k *Keyring) SetActive(id string) error {
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	k.active = id
+	return nil
+}
+
+// Active retorna o id da chave usada nas gravações
+func (k *Keyring) Active() string {
+	return k.active
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	if k != nil {
+		if a, ok := k.keys[id]; ok {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+}
+
+// ParseKeyring lê as chaves no formato "id:chave em hex", separadas por
+// vírgula ou quebra de linha. Linhas vazias e iniciadas por # são ignoradas.
+// A primeira chave é a ativa
+func ParseKeyring(s string) (*Keyring, error) {
+	k := NewKeyring()
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, key, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: expected id:key", ErrInvalidKey)
+		}
+		b, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidKey, id, err)
+		}
+		err = k.Add(strings.TrimSpace(id), b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if k.active == "" {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidKey)
+	}
+	return k, nil
+}
+
+// KeyringFromEnv carrega as chaves do arquivo em ENCRYPTION_KEY_FILE ou, sem
+// ele, de ENCRYPTION_KEYS. Sem nenhum dos dois retorna nil (sem criptografia)
+func KeyringFromEnv() (*Keyring, error) {
+	if path := os.Getenv("ENCRYPTION_KEY_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKeyring(string(b))
+	}
+	if s := os.Getenv("ENCRYPTION_KEYS"); s != "" {
+		return ParseKeyring(s)
+	}
+	return nil, nil
+}
+
+var keyring atomic.Pointer[Keyring]
+
+// SetKeyring configura as chaves usadas na leitura e gravação dos chunks. Com
+// nil os arquivos novos são gravados em claro. O keyring não deve ser alterado
+// depois de configurado
+func SetKeyring(k *Keyring) {
+	keyring.Store(k)
+}
+
+// contentWriter retorna onde gravar o conteúdo de um arquivo novo: o próprio
+// arquivo ou, com um keyring configurado, um encryptWriter com a chave ativa,
+// que precisa ser fechado antes do Sync do arquivo
+func contentWriter(f io.Writer) (io.Writer, *encryptWriter, error) {
+	k := keyring.Load()
+	if k == nil {
+		return f, nil, nil
+	}
+	ew, err := newEncryptWriter(f, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ew, ew, nil
+}
+
+// encryptWriter cifra o que é gravado, frame a frame. O Close cifra o último
+// frame (possivelmente vazio), que marca o fim do arquivo
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	hdr   []byte
+	frame uint32
+	buf   []byte
+	out   []byte
+}
+
+// newEncryptWriter grava o cabeçalho de criptografia com a chave ativa do
+// keyring em w
+func newEncryptWriter(w io.Writer, k *Keyring) (*encryptWriter, error) {
+	aead, err := k.aead(k.active)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 0, 6+len(k.active)+encNonceSize)
+	hdr = append(hdr, encMagic[:]...)
+	hdr = append(hdr, encVersion, byte(len(k.active)))
+	hdr = append(hdr, k.active...)
+	hdr = hdr[:len(hdr)+encNonceSize]
+	_, err = rand.Read(hdr[len(hdr)-encNonceSize:])
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, hdr: hdr, buf: make([]byte, 0, encFrameSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+		if len(e.buf) == encFrameSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	e.out = e.aead.Seal(e.out[:0], frameNonce(e.hdr, e.frame), e.buf, frameAAD(e.hdr, e.frame, final))
+	_, err := e.w.Write(e.out)
+	e.frame++
+	e.buf = e.buf[:0]
+	return err
+}
+
+// Close grava o último frame. Não fecha o writer de destino
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func frameNonce(hdr []byte, frame uint32) []byte {
+	n := make([]byte, 12)
+	copy(n, hdr[len(hdr)-encNonceSize:])
+	binary.BigEndian.PutUint32(n[encNonceSize:], frame)
+	return n
+}
+
+func frameAAD(hdr []byte, frame uint32, final bool) []byte {
+	a := append(make([]byte, 0, len(hdr)+5), hdr...)
+	a = binary.BigEndian.AppendUint32(a, frame)
+	if final {
+		return append(a, 1)
+	}
+	return append(a, 0)
+}
+
+// decryptReader lê o conteúdo em claro de um arquivo cifrado, por offset. O
+// último frame decifrado é mantido para as leituras sequenciais
+type decryptReader struct {
+	f      io.ReaderAt
+	aead   cipher.AEAD
+	hdr    []byte
+	keyID  string
+	size   int64
+	frames int64
+
+	cur   int64
+	plain []byte
+	ct    []byte
+}
+
+// isEncrypted verifica se o arquivo começa com o cabeçalho de criptografia
+func isEncrypted(f io.ReaderAt) bool {
+	m := [4]byte{}
+	n, _ := f.ReadAt(m[:], 0)
+	return n == len(m) && m == encMagic
+}
+
+// openEncrypted lê o cabeçalho de criptografia do arquivo de tamanho size
+func openEncrypted(f io.ReaderAt, size int64) (*decryptReader, error) {
+	h := make([]byte, 6)
+	if n, _ := f.ReadAt(h, 0); n < len(h) {
+		return nil, ErrInvalidHeader
+	}
+	if h[4] != encVersion {
+		return nil, ErrUnknownFormat
+	}
+	hlen := int64(6 + int(h[5]) + encNonceSize)
+	hdr := make([]byte, hlen)
+	if n, _ := f.ReadAt(hdr, 0); int64(n) < hlen {
+		return nil, ErrInvalidHeader
+	}
+	d := &decryptReader{f: f, hdr: hdr, keyID: string(hdr[6 : 6+int(h[5])]), cur: -1}
+	var err error
+	d.aead, err = keyring.Load().aead(d.keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// todo arquivo completo tem ao menos o último frame
+	overhead := int64(d.aead.Overhead())
+	l := size - hlen
+	if l < overhead {
+		return nil, ErrInvalidHeader
+	}
+	d.frames = (l + encFrameSize + overhead - 1) / (encFrameSize + overhead)
+	last := l - (d.frames-1)*(encFrameSize+overhead)
+	if last < overhead {
+		return nil, fmt.Errorf("%w: incomplete frame", ErrChecksum)
+	}
+	d.size = (d.frames-1)*encFrameSize + last - overhead
+	return d, nil
+}
+
+func (d *decryptReader) load(frame int64) error {
+	if frame == d.cur {
+		return nil
+	}
+	overhead := int64(d.aead.Overhead())
+	off := int64(len(d.hdr)) + frame*(encFrameSize+overhead)
+	n := int64(encFrameSize) + overhead
+	if frame == d.frames-1 {
+		n = d.size - frame*encFrameSize + overhead
+	}
+	if int64(cap(d.ct)) < n {
+		d.ct = make([]byte, n)
+	}
+	d.ct = d.ct[:n]
+	_, err := d.f.ReadAt(d.ct, off)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	d.cur = -1
+	d.plain, err = d.aead.Open(d.plain[:0], frameNonce(d.hdr, uint32(frame)), d.ct, frameAAD(d.hdr, uint32(frame), frame == d.frames-1))
+	if err != nil {
+		return fmt.Errorf("%w: frame %d: %v", ErrChecksum, frame, err)
+	}
+	d.cur = frame
+	return nil
+}
+
+func (d *decryptReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < d.size {
+		frame := off / encFrameSize
+		err := d.load(frame)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], d.plain[off-frame*encFrameSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	if c, ok := d.f.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// openContent retorna o conteúdo em claro do arquivo e o seu tamanho, e o id
+// da chave com que ele foi cifrado (vazio para arquivos em claro)
+func openContent(f *os.File) (io.ReaderAt, int64, string, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if !isEncrypted(f) {
+		return f, st.Size(), "", nil
+	}
+	d, err := openEncrypted(f, st.Size())
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return d, d.size, d.keyID, nil
+}
+
+// ChunkKeyID retorna o id da chave com que o arquivo foi cifrado, ou vazio
+// para arquivos em claro
+func ChunkKeyID(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if !isEncrypted(f) {
+		return "", nil
+	}
+	h := make([]byte, 6+255)
+	n, _ := f.ReadAt(h, 0)
+	if n < 6 || n < 6+int(h[5]) {
+		return "", ErrInvalidHeader
+	}
+	return string(h[6 : 6+int(h[5])]), nil
+}
+
+// Reencrypt cifra de novo, com a chave ativa, os chunks e segmentos selados do
+// cliente gravados em claro ou com outra chave, e retorna os arquivos
+// alterados. Cada arquivo é regravado em um temporário e renomeado, com o
+// manifestLock do diretório
+func Reencrypt(dir string) ([]string, error) {
+	k := keyring.Load()
+	if k == nil {
+		return nil, ErrNoKeyring
+	}
+	_, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := manifestLock(dir)
+	l.Lock()
+	defer l.Unlock()
+	entries, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	changed := make([]string, 0)
+	for _, e := range sealedChunks(entries) {
+		ok, err := reencryptFile(filepath.Join(dir, e.Name), k)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %w", e.Name, err)
+		}
+		if ok {
+			changed = append(changed, e.Name)
+		}
+	}
+	if len(changed) > 0 {
+		err = syncDir(dir)
+	}
+	return changed, err
+}
+
+func reencryptFile(path string, k *Keyring) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	content, size, keyID, err := openContent(f)
+	if err != nil {
+		return false, err
+	}
+	if keyID == k.active {
+		return false, nil
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+	bw := bufio.NewWriterSize(out, encFrameSize)
+	ew, err := newEncryptWriter(bw, k)
+	if err == nil {
+		_, err = io.Copy(ew, io.NewSectionReader(content, 0, size))
+	}
+	if err == nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
@@ -0,0 +1,151 @@
+package db_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	key1 = "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	key2 = "k2:1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func keyring(t *testing.T, s string) *db.Keyring {
+	k, err := db.ParseKeyring(s)
+	require.NoError(t, err)
+	return k
+}
+
+func TestParseKeyring(t *testing.T) {
+	k := keyring(t, "# chaves\n"+key2+"\n"+key1+"\n")
+	require.Equal(t, "k2", k.Active())
+	require.NoError(t, k.SetActive("k1"))
+	require.ErrorIs(t, k.SetActive("k3"), db.ErrUnknownKey)
+
+	for _, s := range []string{"", "k1", "k1:zz", "k1:0011", key1 + "," + key1, "a b:" + strings.Repeat("00", 32)} {
+		_, err := db.ParseKeyring(s)
+		require.ErrorIs(t, err, db.ErrInvalidKey, s)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	t.Cleanup(func() { db.SetKeyring(nil) })
+	dir := t.TempDir()
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+
+	// chunks em claro, gravados antes da criptografia ser ativada, e chunks
+	// maiores que um frame
+	write := func(n, size int) {
+		for i := 0; i < n; i++ {
+			tr := make([]*model.Transaction, size)
+			for j := range tr {
+				tr[j] = &model.Transaction{Timestamp: int64(i*size + j), Value: 2, Type: "c", Description: "pagamento"}
+			}
+			require.NoError(t, d.Write("1", tr))
+		}
+	}
+	write(2, 10)
+	db.SetKeyring(keyring(t, key1))
+	write(3, 2000)
+	write(6, 10)
+
+	entries, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "1", entries[3].Name))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 'R', 'N', 'E', 1, 2, 'k', '1'}, b[:8])
+	require.False(t, bytes.Contains(b, []byte("pagamento")))
+
+	check := func(count int64) {
+		bal, err := frr.GetBalance("1")
+		require.NoError(t, err)
+		require.Equal(t, 2*count, bal)
+		n, err := frr.Count("1")
+		require.NoError(t, err)
+		require.Equal(t, count, n)
+		last, err := frr.ReadLast("1", 3)
+		require.NoError(t, err)
+		require.Equal(t, int64(59), last[0].Timestamp())
+		records, err := frr.ReadRange("1", 4090, 4110)
+		require.NoError(t, err)
+		require.Len(t, records, 21)
+		reports, err := db.Verify(filepath.Join(dir, "1"))
+		require.NoError(t, err)
+		require.Empty(t, reports)
+	}
+	count := int64(2*10 + 3*2000 + 6*10)
+	check(count)
+
+	// segmentos cifrados, com e sem compressão
+	c := db.NewCompactor(dir)
+	c.MinChunks = 2
+	c.MaxChunks = 4
+	c.Keep = 3
+	_, err = c.Compact("1")
+	require.NoError(t, err)
+	c.Compress = false
+	c.Keep = 0
+	_, err = c.Compact("1")
+	require.NoError(t, err)
+	entries, err = db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.True(t, entries[0].IsSegment())
+	check(count)
+
+	// rotação: k2 passa a ser a ativa e os arquivos são cifrados de novo
+	db.SetKeyring(keyring(t, key2+","+key1))
+	write(1, 10)
+	changed, err := db.Reencrypt(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.NotEmpty(t, changed)
+	changed, err = db.Reencrypt(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Empty(t, changed)
+
+	db.SetKeyring(keyring(t, key2))
+	entries, err = db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	for _, e := range entries {
+		id, err := db.ChunkKeyID(filepath.Join(dir, "1", e.Name))
+		require.NoError(t, err)
+		require.Equal(t, "k2", id)
+	}
+	bal, err := frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, 2*(count+10), bal)
+
+	// sem a chave os chunks não podem ser lidos
+	db.SetKeyring(keyring(t, key1))
+	_, err = frr.ReadLast("1", 1)
+	require.ErrorIs(t, err, db.ErrUnknownKey)
+	_, err = frr.GetBalance("1")
+	require.ErrorIs(t, err, db.ErrUnknownKey)
+	_, err = frr.Count("1")
+	require.ErrorIs(t, err, db.ErrUnknownKey)
+
+	// um byte alterado invalida o frame
+	db.SetKeyring(keyring(t, key2))
+	path := filepath.Join(dir, "1", entries[0].Name)
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	b[len(b)/2]++
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	reports, err := db.Verify(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.Contains(t, reports[0].Problems[0], db.ErrChecksum.Error())
+	it, err := frr.Iterate("1")
+	require.NoError(t, err)
+	for it.Next() {
+	}
+	require.ErrorIs(t, it.Err(), db.ErrChecksum)
+	it.Close()
+}
@@ -1,33 +1,100 @@
 package db
 
 import (
+	"log/slog"
+	"sync"
+
 	"github.com/ricardovhz/rinha2/model"
 	"github.com/segmentio/ksuid"
 )
 
+// checkpointer é implementado pelos engines que mantêm checkpoint de saldo
+type checkpointer interface {
+	Checkpoint(id string) error
+}
+
+// lastChunkReader é implementado pelos engines que conhecem o último chunk gravado
+type lastChunkReader interface {
+	LastChunk(id string) (string, error)
+}
+
+// quarantiner é implementado pelos engines que isolam arquivos órfãos
+type quarantiner interface {
+	Quarantine(id string) ([]string, error)
+}
+
+// aborter é implementado pelos writers que descartam um lote incompleto sem
+// selá-lo
+type aborter interface {
+	Abort() error
+}
+
 type DB struct {
-	wf writerFactory
-	r  RegReader
+	wf    writerFactory
+	r     RegReader
+	codec Codec
+
+	mu     sync.Mutex
+	chunks map[string]ksuid.KSUID
+}
+
+// nextChunkId gera o id do próximo chunk do cliente. ksuids criados no mesmo
+// segundo não têm ordem garantida, então o id é sempre maior que o anterior
+func (db *DB) nextChunkId(id string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	last, ok := db.chunks[id]
+	if !ok {
+		if lr, ok := db.r.(lastChunkReader); ok {
+			if name, err := lr.LastChunk(id); err == nil {
+				last, _ = ksuid.Parse(name)
+			}
+		}
+	}
+	k := ksuid.New()
+	if ksuid.Compare(k, last) <= 0 {
+		k = last.Next()
+	}
+	db.chunks[id] = k
+	return k.String()
 }
 
 func (db *DB) Write(id string, t []*model.Transaction) error {
-	chunkId := ksuid.New().String()
-	w, err := db.wf.NewWriter(id, chunkId, len(t))
+	chunkId := db.nextChunkId(id)
+	w, err := db.wf.NewWriter(id, chunkId, db.codec, len(t))
 	if err != nil {
 		return err
 	}
-	defer w.Close()
 	r := Record{}
 	for _, tr := range t {
-		WriteToRecord(id, tr, &r)
-		_, err = w.Write(r[:])
+		err = WriteToRecord(id, tr, &r)
+		if err == nil {
+			err = w.WriteRecord(r)
+		}
 		if err != nil {
+			abort(w)
 			return err
 		}
 	}
-	return nil
+	return w.Close()
+}
+
+// abort descarta o lote que falhou no meio da gravação. Fechar o writer
+// selaria os registros já gravados
+func abort(w CloseableRegWriter) {
+	var err error
+	if a, ok := w.(aborter); ok {
+		err = a.Abort()
+	} else {
+		err = w.Close()
+	}
+	if err != nil {
+		slog.Error("error discarding chunk", "err", err)
+	}
 }
 
+// ReadLast retorna as 5 transações mais recentes do cliente, da mais recente
+// para a mais antiga
 func (db *DB) ReadLast(id string) ([]*model.Transaction, error) {
 	records, err := db.r.ReadLast(id, 5)
 	if err != nil {
@@ -40,7 +107,56 @@ func (db *DB) ReadLast(id string) ([]*model.Transaction, error) {
 	return tr, nil
 }
 
-func (db *DB) ReadBalance(id string) (int32, error) {
+// HistoryOptions ajusta as leituras de histórico
+type HistoryOptions struct {
+	// IncludeArchive inclui o histórico arquivado pela retenção (ver
+	// Archiver), quando suportado pelo engine
+	IncludeArchive bool
+}
+
+// ReadRange retorna as transações do cliente com timestamp entre from e to
+// (inclusive), em ordem de gravação
+func (db *DB) ReadRange(id string, from, to int64) ([]*model.Transaction, error) {
+	return db.ReadHistory(id, from, to, HistoryOptions{})
+}
+
+// ReadHistory é o ReadRange com opções
+func (db *DB) ReadHistory(id string, from, to int64, opt HistoryOptions) ([]*model.Transaction, error) {
+	var (
+		records []Record
+		err     error
+	)
+	if ar, ok := db.r.(archiveReader); ok && opt.IncludeArchive {
+		records, err = ar.ReadRangeArchive(id, from, to)
+	} else {
+		records, err = db.r.ReadRange(id, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tr := make([]*model.Transaction, len(records))
+	for i, r := range records {
+		_, tr[i] = ToTransaction(r)
+	}
+	return tr, nil
+}
+
+// Iterate retorna um iterador sobre todo o histórico do cliente, em ordem de
+// gravação. O iterador deve ser fechado com Close
+func (db *DB) Iterate(id string) (Iterator, error) {
+	return db.r.Iterate(id)
+}
+
+// IterateHistory é o Iterate com opções. Com o histórico arquivado, os
+// registros de saldo transportado são substituídos pelos registros arquivados
+func (db *DB) IterateHistory(id string, opt HistoryOptions) (Iterator, error) {
+	if ar, ok := db.r.(archiveReader); ok && opt.IncludeArchive {
+		return ar.IterateArchive(id)
+	}
+	return db.r.Iterate(id)
+}
+
+func (db *DB) ReadBalance(id string) (int64, error) {
 	bal, err := db.r.GetBalance(id)
 	if err != nil {
 		return -1, err
@@ -48,9 +164,53 @@ func (db *DB) ReadBalance(id string) (int32, error) {
 	return bal, nil
 }
 
+// ReadCount retorna a quantidade de transações gravadas para o cliente
+func (db *DB) ReadCount(id string) (int64, error) {
+	return db.r.Count(id)
+}
+
+// ReadSummary retorna saldo e quantidades de transações e de registros do
+// cliente lendo o histórico uma única vez
+func (db *DB) ReadSummary(id string) (*Summary, error) {
+	return db.r.Summary(id)
+}
+
+// ReadRecords retorna a quantidade de registros gravados para o cliente,
+// incluindo as alterações de limite e de estado
+func (db *DB) ReadRecords(id string) (int64, error) {
+	return db.r.Records(id)
+}
+
+// Checkpoint grava o checkpoint de saldo do cliente, quando suportado pelo engine
+func (db *DB) Checkpoint(id string) error {
+	if c, ok := db.r.(checkpointer); ok {
+		return c.Checkpoint(id)
+	}
+	return nil
+}
+
+// Quarantine isola os arquivos do cliente que não fazem parte do catálogo,
+// quando suportado pelo engine, e retorna os nomes dos arquivos movidos
+func (db *DB) Quarantine(id string) ([]string, error) {
+	if q, ok := db.r.(quarantiner); ok {
+		return q.Quarantine(id)
+	}
+	return nil, nil
+}
+
 func NewDB(wf writerFactory, r RegReader) *DB {
+	codec, _ := CodecFor(CurrentFormat)
+	return NewDBWithCodec(wf, r, codec)
+}
+
+// NewDBWithCodec cria um DB que grava os chunks novos com o codec informado.
+// O codec é registrado para que os leitores reconheçam a sua versão
+func NewDBWithCodec(wf writerFactory, r RegReader, codec Codec) *DB {
+	RegisterCodec(codec)
 	return &DB{
-		wf: wf,
-		r:  r,
+		wf:     wf,
+		r:      r,
+		codec:  codec,
+		chunks: make(map[string]ksuid.KSUID),
 	}
 }
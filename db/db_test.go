@@ -1,9 +1,14 @@
 package db_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,7 +24,8 @@ func TestToRecord(t *testing.T) {
 		Type:        "c",
 		Description: "test",
 	}
-	r := db.ToRecord("1", &tr)
+	r, err := db.ToRecord("1", &tr)
+	require.NoError(t, err)
 	log.Printf("%v", r)
 }
 
@@ -33,28 +39,142 @@ func TestWriteToRecord(t *testing.T) {
 	r := db.Record{}
 	// buf := bytes.NewBuffer(r[:])
 	// buf.Reset()
-	db.WriteToRecord("1", &tr, &r)
+	require.NoError(t, db.WriteToRecord("1", &tr, &r))
+	_, rtr := db.ToTransaction(r)
+	require.Equal(t, tr.Description, rtr.Description)
 	log.Printf("%v", r)
 }
 
 func TestRead(t *testing.T) {
-	r := db.Record{49, 99, 150, 115, 216, 182, 141, 1, 0, 0, 100, 0, 0, 0, 116, 101, 115, 116, 0, 0, 0, 0, 0, 0}
+	r, err := db.UpgradeV1([]byte{49, 99, 150, 115, 216, 182, 141, 1, 0, 0, 100, 0, 0, 0, 116, 101, 115, 116, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
 	id, tr := db.ToTransaction(r)
 	require.Equal(t, "1", id)
 	require.Equal(t, "c", tr.Type)
 	require.Equal(t, int64(1708169655190), tr.Timestamp)
-	require.Equal(t, 100, tr.Value)
+	require.Equal(t, int64(100), tr.Value)
 	require.Equal(t, "test", tr.Description)
 
-	r = db.Record{49, 99, 33, 221, 97, 186, 141, 1, 0, 0, 156, 255, 255, 255, 116, 101, 115, 116, 0, 0, 0, 0, 0, 0}
+	r, err = db.UpgradeV1([]byte{49, 99, 33, 221, 97, 186, 141, 1, 0, 0, 156, 255, 255, 255, 116, 101, 115, 116, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
 	id, tr = db.ToTransaction(r)
 	require.Equal(t, "1", id)
 	require.Equal(t, "c", tr.Type)
 	require.Equal(t, int64(1708228992289), tr.Timestamp)
-	require.Equal(t, -100, tr.Value)
+	require.Equal(t, int64(-100), tr.Value)
 	require.Equal(t, "test", tr.Description)
 }
 
+func TestRecordClientID(t *testing.T) {
+	for _, id := range []string{"1", "10", "4294967295"} {
+		r := record(t, id, &model.Transaction{
+			Timestamp:   1708169655190,
+			Value:       100,
+			Type:        "d",
+			Description: "test",
+		})
+		rid, tr := db.ToTransaction(r)
+		require.Equal(t, id, rid)
+		require.Equal(t, "d", tr.Type)
+		require.Equal(t, int64(100), tr.Value)
+		require.Equal(t, int64(-100), r.Value())
+	}
+
+	_, err := db.ParseClientID("a")
+	require.ErrorIs(t, err, db.ErrInvalidClientID)
+
+	r := record(t, "1", &model.Transaction{Value: 1, Type: "c", Description: "crc"})
+	require.True(t, r.Valid())
+	r[13]++
+	require.False(t, r.Valid())
+	_, err = db.ReadRecord(bytes.NewReader(r[:]))
+	require.ErrorIs(t, err, db.ErrChecksum)
+}
+
+func TestRecordValue64(t *testing.T) {
+	r := record(t, "4", &model.Transaction{Timestamp: 1, Value: 1 << 40, Type: "d", Description: "big"})
+	_, tr := db.ToTransaction(r)
+	require.Equal(t, int64(1<<40), tr.Value)
+	require.Equal(t, int64(-(1 << 40)), r.Value())
+
+	// registro v3, com valor em int32
+	v3 := []byte{4, 0, 0, 0, 'c', 1, 0, 0, 0, 0, 0, 0, 0, 100, 0, 0, 0, 'v', '3', 0, 0, 0, 0, 0, 0, 0, 0}
+	v3 = binary.LittleEndian.AppendUint32(v3, crc32.ChecksumIEEE(v3))
+	r, err := db.DecodeRecord(db.FormatV3, v3)
+	require.NoError(t, err)
+	require.True(t, r.Valid())
+	id, tr := db.ToTransaction(r)
+	require.Equal(t, "4", id)
+	require.Equal(t, int64(100), tr.Value)
+	require.Equal(t, "v3", tr.Description)
+
+	v3[14]++
+	_, err = db.DecodeRecord(db.FormatV3, v3)
+	require.ErrorIs(t, err, db.ErrChecksum)
+}
+
+// upperCodec grava a descrição em maiúsculas, para verificar que os chunks
+// usam o codec configurado
+type upperCodec struct{ db.Codec }
+
+func (upperCodec) Version() byte { return 9 }
+
+func (c upperCodec) Append(b []byte, r db.Record) ([]byte, error) {
+	id, tr := db.ToTransaction(r)
+	tr.Description = strings.ToUpper(tr.Description)
+	return db.AppendRecord(b, id, tr)
+}
+
+func TestRecordV5(t *testing.T) {
+	tr := &model.Transaction{
+		Timestamp:   7,
+		Value:       42,
+		Type:        "c",
+		Description: "pão de açúcar, número 10",
+		Metadata:    map[string]string{"origem": "pix", "canal": "app"},
+	}
+	r := record(t, "3", tr)
+	require.True(t, r.Valid())
+	id, rtr := db.ToTransaction(r)
+	require.Equal(t, "3", id)
+	require.Equal(t, tr, rtr)
+
+	// descrição acima do limite do registro
+	_, err := db.ToRecord("3", &model.Transaction{Type: "c", Description: strings.Repeat("x", db.MaxRecordSize)})
+	require.ErrorIs(t, err, db.ErrRecordTooLarge)
+
+	// id de cliente inválido
+	for _, id := range []string{"", "x", "-1"} {
+		_, err = db.ToRecord(id, &model.Transaction{Type: "c", Description: "a"})
+		require.ErrorIs(t, err, db.ErrInvalidClientID, id)
+	}
+
+	// registro v4 com a descrição cortada no meio de um caractere
+	v4 := []byte{3, 0, 0, 0, 'c', 1, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0}
+	v4 = append(v4, "açaí aç"[:9]+"\x00"...)
+	v4 = binary.LittleEndian.AppendUint32(v4, crc32.ChecksumIEEE(v4))
+	r, err = db.DecodeRecord(db.FormatV4, v4)
+	require.NoError(t, err)
+	require.Equal(t, "açaí a", r.Description())
+
+	dir := t.TempDir()
+	codec, err := db.CodecFor(db.CurrentFormat)
+	require.NoError(t, err)
+	d := db.NewDBWithCodec(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir), upperCodec{codec})
+	require.NoError(t, d.Write("3", []*model.Transaction{tr}))
+	trs, err := d.ReadLast("3")
+	require.NoError(t, err)
+	require.Len(t, trs, 1)
+	require.Equal(t, "PÃO DE AÇÚCAR, NÚMERO 10", trs[0].Description)
+	require.Equal(t, tr.Metadata, trs[0].Metadata)
+}
+
+func record(t *testing.T, id string, tr *model.Transaction) db.Record {
+	r, err := db.ToRecord(id, tr)
+	require.NoError(t, err)
+	return r
+}
+
 func BenchmarkRecord(b *testing.B) {
 	tr := model.Transaction{
 		Timestamp:   time.Now().UnixMilli(),
@@ -72,7 +192,12 @@ func BenchmarkRecord(b *testing.B) {
 }
 
 func BenchmarkRead(b *testing.B) {
-	r := db.Record{49, 99, 150, 115, 216, 182, 141, 1, 0, 0, 100, 0, 0, 0, 116, 101, 115, 116, 0, 0, 0, 0, 0, 0}
+	r, _ := db.ToRecord("1", &model.Transaction{
+		Timestamp:   1708169655190,
+		Value:       100,
+		Type:        "c",
+		Description: "test",
+	})
 	for i := 0; i < b.N; i++ {
 		db.ToTransaction(r)
 	}
@@ -80,15 +205,15 @@ func BenchmarkRead(b *testing.B) {
 
 func TestDB(t *testing.T) {
 
-	os.Remove("cpu.prof")
-	f, err := os.Create("cpu.prof")
+	f, err := os.Create(filepath.Join(t.TempDir(), "cpu.prof"))
 	if err != nil {
 		log.Fatalf("could not create cpu profile: %v", err)
 		t.Fail()
 	}
 	defer f.Close()
 
-	db := db.NewDB(db.NewFileWriterFactoryFromPath("./"), nil)
+	e := db.NewMemoryEngine()
+	db := db.NewDB(e, e)
 
 	tr := make([]*model.Transaction, 100)
 	for i := 0; i < 100; i++ {
@@ -113,8 +238,92 @@ func TestDB(t *testing.T) {
 
 }
 
+func TestLimitRecord(t *testing.T) {
+	dir := t.TempDir()
+	sq, err := db.OpenSQLite(filepath.Join(dir, "ledger.db"))
+	require.NoError(t, err)
+	defer sq.Close()
+	mem := db.NewMemoryEngine()
+	files := filepath.Join(dir, "files")
+	require.NoError(t, os.Mkdir(files, 0755))
+	engines := map[string]*db.DB{
+		"file":   db.NewDB(db.NewFileWriterFactoryFromPath(files), db.NewFileRegReader(files)),
+		"memory": db.NewDB(mem, mem),
+		"sqlite": db.NewDB(sq, sq),
+	}
+	for name, d := range engines {
+		// só a alteração de limite ainda conta como histórico
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: 1, Value: 500, Type: string(db.RecordLimit), Description: "limite", Metadata: map[string]string{"previous": "100"}},
+		}), name)
+		trs, err := d.ReadLast("1")
+		require.NoError(t, err, name)
+		require.Empty(t, trs, name)
+		count, err := d.ReadCount("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(0), count, name)
+
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: 2, Value: 30, Type: "d", Description: "a"},
+			{Timestamp: 3, Value: 800, Type: string(db.RecordLimit), Description: "limite", Metadata: map[string]string{"previous": "500"}},
+		}), name)
+		bal, err := d.ReadBalance("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(-30), bal, name)
+		count, err = d.ReadCount("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(1), count, name)
+		records, err := d.ReadRecords("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(3), records, name)
+		trs, err = d.ReadLast("1")
+		require.NoError(t, err, name)
+		require.Len(t, trs, 1, name)
+		trs, err = d.ReadRange("1", 0, 10)
+		require.NoError(t, err, name)
+		require.Len(t, trs, 1, name)
+		bal, err = d.BalanceAt("1", 3)
+		require.NoError(t, err, name)
+		require.Equal(t, int64(-30), bal, name)
+
+		it, err := d.Iterate("1")
+		require.NoError(t, err, name)
+		var limits []int64
+		for it.Next() {
+			if r := it.Record(); r.Type() == db.RecordLimit {
+				_, tr := db.ToTransaction(r)
+				limits = append(limits, tr.Value)
+				require.False(t, r.IsTransaction())
+			}
+		}
+		require.NoError(t, it.Close())
+		require.Equal(t, []int64{500, 800}, limits, name)
+
+		// alteração de estado também fica fora do saldo e do extrato
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: 4, Value: 9, Type: string(db.RecordState), Description: "fraude", Metadata: map[string]string{"state": "frozen", "previous": "active"}},
+		}), name)
+		bal, err = d.ReadBalance("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(-30), bal, name)
+		trs, err = d.ReadLast("1")
+		require.NoError(t, err, name)
+		require.Len(t, trs, 1, name)
+		count, err = d.ReadCount("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(1), count, name)
+		records, err = d.ReadRecords("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(4), records, name)
+		sum, err := d.ReadSummary("1")
+		require.NoError(t, err, name)
+		require.Equal(t, db.Summary{Balance: -30, Count: 1, Records: 4, Limit: 800, HasLimit: true, State: "frozen"}, *sum, name)
+	}
+}
+
 func BenchmarkDB(b *testing.B) {
-	db := db.NewDB(db.NewFileWriterFactoryFromPath("./"), nil)
+	e := db.NewMemoryEngine()
+	db := db.NewDB(e, e)
 
 	tr := make([]*model.Transaction, 100)
 	for i := 0; i < 100; i++ {
@@ -136,3 +345,52 @@ func BenchmarkDB(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func TestWriteAbort(t *testing.T) {
+	dir := t.TempDir()
+	sq, err := db.OpenSQLite(filepath.Join(dir, "ledger.db"))
+	require.NoError(t, err)
+	defer sq.Close()
+	mem := db.NewMemoryEngine()
+	files := filepath.Join(dir, "files")
+	require.NoError(t, os.Mkdir(files, 0755))
+	engines := map[string]*db.DB{
+		"file":   db.NewDB(db.NewFileWriterFactoryFromPath(files), db.NewFileRegReader(files)),
+		"memory": db.NewDB(mem, mem),
+		"sqlite": db.NewDB(sq, sq),
+	}
+	tr := func(v int64, desc string) *model.Transaction {
+		return &model.Transaction{Timestamp: v, Value: v, Type: "c", Description: desc}
+	}
+	for name, d := range engines {
+		require.NoError(t, d.Write("1", []*model.Transaction{tr(1, "a")}), name)
+
+		// lote que falha no meio: nenhum registro dele fica visível
+		err := d.Write("1", []*model.Transaction{tr(2, "b"), tr(3, strings.Repeat("x", db.MaxRecordSize))})
+		require.ErrorIs(t, err, db.ErrRecordTooLarge, name)
+		bal, err := d.ReadBalance("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(1), bal, name)
+		n, err := d.ReadRecords("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(1), n, name)
+
+		require.NoError(t, d.Write("1", []*model.Transaction{tr(4, "c")}), name)
+		bal, err = d.ReadBalance("1")
+		require.NoError(t, err, name)
+		require.Equal(t, int64(5), bal, name)
+	}
+
+	// o chunk descartado sai do manifesto e do diretório
+	chunks, err := db.LoadManifest(filepath.Join(files, "1"))
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	entries, err := os.ReadDir(filepath.Join(files, "1"))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	reports, err := db.Verify(filepath.Join(files, "1"))
+	require.NoError(t, err)
+	for _, r := range reports {
+		require.Empty(t, r.Problems, r.Chunk)
+	}
+}
@@ -3,13 +3,79 @@ package db
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
+	"sort"
+	"strconv"
 
 	"github.com/ricardovhz/rinha2/model"
 )
 
-// estrutura do registro
+// cabeçalho do arquivo de chunk
+//
+//	    magic            version  flags  reserved
+//	|---------------|   |---|   |---|   |-------|
+//	+---+---+---+---+---+---+---+---+
+//	| 0 | R | N | H | 5 | f | 0 | 0 |
+//	+---+---+---+---+---+---+---+---+
+//
+// arquivos da versão 1 não possuem cabeçalho e começam direto no primeiro
+// registro. As flags estão descritas em compress.go
+const (
+	FormatV1 byte = 1
+	FormatV2 byte = 2
+	FormatV3 byte = 3
+	FormatV4 byte = 4
+	FormatV5 byte = 5
 
+	CurrentFormat = FormatV5
+
+	HeaderSize = 8
+)
+
+var headerMagic = [4]byte{0, 'R', 'N', 'H'}
+
+// estrutura do registro (v5)
+//
+//	 len (uint16)  client_id (uint32)  type  timestamp (int64)  value (int64)  desc len (uint16)  description
+//	|-----------| |----------------|  |--| |---------------| |-------------| |---------------| |-----------|
+//
+//	 metadata count (byte)   key len (byte)  key   value len (uint16)  value     crc32
+//	|--------------------|  |-------------| |---| |----------------| |-----| |-----------|
+//
+// o registro tem tamanho variável. len é o tamanho total do registro,
+// incluindo o próprio len e o crc32 (IEEE), calculado sobre todos os bytes
+// anteriores. A descrição é gravada completa (UTF-8) e os metadados (chave e
+// valor) são gravados em ordem de chave
+const (
+	recordMinSize = 2 + 4 + 1 + 8 + 8 + 2 + 1 + 4
+	MaxRecordSize = 1<<16 - 1
+
+	// offsets dos campos fixos
+	recordIDOffset    = 2
+	recordTypeOffset  = 6
+	recordTsOffset    = 7
+	recordValueOffset = 15
+	recordDescOffset  = 23
+)
+
+// registros da versão 4 têm tamanho fixo, com a descrição limitada a 10 bytes
+//
+//	client_id (uint32)  type  timestamp (int64)  value (int64)  description (10 bytes)  crc32
+//
+// os da versão 3 guardam o valor em 4 bytes (int32) e terminam com o crc32 dos
+// 27 bytes anteriores. Os da versão 2 são iguais aos da 3, sem o crc32
+const (
+	RecordV4Size     = 35
+	recordV4DataSize = 31
+	recordV3DataSize = 27
+	RecordV3Size     = recordV3DataSize + 4
+	RecordV2Size     = recordV3DataSize
+)
+
+// estrutura do registro (v1)
+//
 // client_id (byte)
 //
 //	  ^              timestamp (int64)        value (int32)         description (string)
@@ -20,45 +86,351 @@ import (
 //		  |
 //	      v
 //		type (byte)
-const RecordSize = 24
+const RecordV1Size = 24
+
+// Record é um registro codificado no formato atual (v5)
+type Record []byte
 
-type Record [RecordSize]byte
+var (
+	ErrInvalidClientID = errors.New("invalid client id")
+	ErrInvalidHeader   = errors.New("invalid chunk header")
+	ErrUnknownFormat   = errors.New("unknown chunk format")
+	ErrChecksum        = errors.New("record checksum mismatch")
+	ErrOverflow        = errors.New("amount overflow")
+	ErrInvalidRecord   = errors.New("invalid record")
+	ErrRecordTooLarge  = errors.New("record too large")
+)
 
 type RegWriter interface {
 	Write([]byte) (int, error)
 	WriteByte(byte) error
 }
 
-func ToRecord(id string, t *model.Transaction) Record {
+// ParseClientID converte o id textual do cliente para o formato gravado nos registros
+func ParseClientID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, ErrInvalidClientID
+	}
+	return uint32(n), nil
+}
+
+func ToRecord(id string, t *model.Transaction) (Record, error) {
 	r := Record{}
-	r[0] = id[0]
-	r[1] = byte(t.Type[0])
-	binary.LittleEndian.PutUint64(r[2:10], uint64(t.Timestamp))
-	binary.LittleEndian.PutUint32(r[10:14], uint32(t.Value))
-	copy(r[14:], []byte(t.Description))
-	return r
+	err := WriteToRecord(id, t, &r)
+	return r, err
 }
 
-func WriteToRecord(id string, t *model.Transaction, w *Record) {
-	w[0] = id[0]
-	w[1] = byte(t.Type[0])
-	binary.LittleEndian.PutUint64(w[2:10], uint64(t.Timestamp))
-	binary.LittleEndian.PutUint32(w[10:14], uint32(t.Value))
-	copy(w[14:], []byte(t.Description)[0:])
+// WriteToRecord codifica a transação em w, reaproveitando a sua capacidade
+func WriteToRecord(id string, t *model.Transaction, w *Record) error {
+	b, err := AppendRecord((*w)[:0], id, t)
+	if err != nil {
+		return err
+	}
+	*w = b
+	return nil
 }
 
+// AppendRecord acrescenta a b a transação codificada no formato atual
+func AppendRecord(b []byte, id string, t *model.Transaction) ([]byte, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return b, err
+	}
+	var typ byte
+	if len(t.Type) > 0 {
+		typ = t.Type[0]
+	}
+	return appendRecord(b, cid, typ, t.Timestamp, t.Value, t.Description, t.Metadata)
+}
+
+func appendRecord(b []byte, cid uint32, typ byte, ts int64, value int64, desc string, meta map[string]string) ([]byte, error) {
+	size := recordMinSize + len(desc)
+	keys := make([]string, 0, len(meta))
+	for k, v := range meta {
+		if len(k) > 255 || len(v) > MaxRecordSize {
+			return b, ErrRecordTooLarge
+		}
+		keys = append(keys, k)
+		size += 1 + len(k) + 2 + len(v)
+	}
+	if size > MaxRecordSize || len(keys) > 255 {
+		return b, ErrRecordTooLarge
+	}
+	sort.Strings(keys)
+
+	start := len(b)
+	b = binary.LittleEndian.AppendUint16(b, uint16(size))
+	b = binary.LittleEndian.AppendUint32(b, cid)
+	b = append(b, typ)
+	b = binary.LittleEndian.AppendUint64(b, uint64(ts))
+	b = binary.LittleEndian.AppendUint64(b, uint64(value))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(desc)))
+	b = append(b, desc...)
+	b = append(b, byte(len(keys)))
+	for _, k := range keys {
+		b = append(b, byte(len(k)))
+		b = append(b, k...)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(meta[k])))
+		b = append(b, meta[k]...)
+	}
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:])), nil
+}
+
+// ReadRecord lê um registro no formato atual e valida o seu checksum
 func ReadRecord(r io.Reader) (Record, error) {
-	var rec Record
-	_, err := r.Read(rec[:])
-	return rec, err
+	return recordCodec{}.Read(r)
+}
+
+// Valid indica se o tamanho, a estrutura e o checksum do registro conferem
+func (r Record) Valid() bool {
+	if len(r) < recordMinSize || int(binary.LittleEndian.Uint16(r[0:2])) != len(r) {
+		return false
+	}
+	if binary.LittleEndian.Uint32(r[len(r)-4:]) != crc32.ChecksumIEEE(r[:len(r)-4]) {
+		return false
+	}
+	_, ok := r.metadataOffset()
+	return ok
+}
+
+// metadataOffset retorna o offset da quantidade de metadados, validando os
+// tamanhos da descrição e dos metadados
+func (r Record) metadataOffset() (int, bool) {
+	end := len(r) - 4
+	off := recordDescOffset + 2 + int(binary.LittleEndian.Uint16(r[recordDescOffset:]))
+	if off >= end {
+		return 0, false
+	}
+	p := off + 1
+	for i := 0; i < int(r[off]); i++ {
+		if p >= end || p+1+int(r[p])+2 > end {
+			return 0, false
+		}
+		p += 1 + int(r[p])
+		p += 2 + int(binary.LittleEndian.Uint16(r[p:]))
+	}
+	return off, p == end
+}
+
+// ClientID retorna o id do cliente gravado no registro
+func (r Record) ClientID() uint32 {
+	return binary.LittleEndian.Uint32(r[recordIDOffset:])
+}
+
+// RecordCarry é o tipo do registro de saldo transportado, gravado no lugar do
+// histórico arquivado (ver archive.go). O valor é o saldo resumido, com sinal,
+// o metadado "count" é a quantidade de transações resumidas e "records" a de
+// registros (transações e alterações de limite ou de estado). "limit" e
+// "state" guardam a última alteração de limite e de estado resumida
+const RecordCarry byte = 'b'
+
+// RecordLimit é o tipo do registro de alteração do limite do cliente. O valor
+// é o novo limite e o metadado "previous" o limite anterior; o registro não
+// altera o saldo
+const RecordLimit byte = 'l'
+
+// RecordState é o tipo do registro de alteração do estado da conta. O
+// metadado "state" é o novo estado e "previous" o anterior; o registro não
+// altera o saldo
+const RecordState byte = 's'
+
+// Type retorna o tipo da transação ('c' ou 'd', RecordCarry, RecordLimit ou
+// RecordState)
+func (r Record) Type() byte {
+	return r[recordTypeOffset]
+}
+
+// Timestamp retorna o timestamp da transação (unix millis)
+func (r Record) Timestamp() int64 {
+	return int64(binary.LittleEndian.Uint64(r[recordTsOffset:]))
+}
+
+// Value retorna o valor da transação com sinal (débitos negativos). No saldo
+// transportado, o valor já é gravado com sinal. Alterações de limite e de
+// estado não têm valor
+func (r Record) Value() int64 {
+	v := int64(binary.LittleEndian.Uint64(r[recordValueOffset:]))
+	switch r.Type() {
+	case 'd':
+		return -v
+	case RecordLimit, RecordState:
+		return 0
+	}
+	return v
+}
+
+// IsTransaction indica se o registro é uma transação, e não um saldo
+// transportado ou uma alteração de limite ou de estado
+func (r Record) IsTransaction() bool {
+	t := r.Type()
+	return t != RecordCarry && t != RecordLimit && t != RecordState
+}
+
+// Transactions retorna a quantidade de transações representadas pelo
+// registro: uma, nenhuma nas alterações de limite ou de estado, ou as
+// resumidas pelo saldo transportado
+func (r Record) Transactions() int64 {
+	switch {
+	case r.Type() == RecordCarry:
+		n, _ := strconv.ParseInt(r.Metadata()["count"], 10, 64)
+		return n
+	case r.IsTransaction():
+		return 1
+	}
+	return 0
+}
+
+// Records retorna a quantidade de registros representados pelo registro, que
+// é a posição no histórico do cliente (sequência do WAL): um, ou os resumidos
+// pelo saldo transportado. Saldos transportados sem "records" são anteriores
+// às alterações de limite e de estado, e "count" vale para os dois
+func (r Record) Records() int64 {
+	if r.Type() != RecordCarry {
+		return 1
+	}
+	meta := r.Metadata()
+	n, err := strconv.ParseInt(meta["records"], 10, 64)
+	if err != nil {
+		n, _ = strconv.ParseInt(meta["count"], 10, 64)
+	}
+	return n
+}
+
+// LimitChange retorna o limite gravado pelo registro: o novo limite de uma
+// alteração de limite, ou o último limite do histórico resumido por um saldo
+// transportado
+func (r Record) LimitChange() (int64, bool) {
+	switch r.Type() {
+	case RecordLimit:
+		return int64(binary.LittleEndian.Uint64(r[recordValueOffset:])), true
+	case RecordCarry:
+		v, ok := r.Metadata()["limit"]
+		if !ok {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// StateChange retorna o estado gravado pelo registro: o novo estado de uma
+// alteração de estado, ou o último estado do histórico resumido por um saldo
+// transportado
+func (r Record) StateChange() (string, bool) {
+	switch r.Type() {
+	case RecordState, RecordCarry:
+		state := r.Metadata()["state"]
+		return state, state != ""
+	}
+	return "", false
+}
+
+// Description retorna a descrição completa da transação
+func (r Record) Description() string {
+	n := int(binary.LittleEndian.Uint16(r[recordDescOffset:]))
+	if recordDescOffset+2+n > len(r) {
+		return ""
+	}
+	return string(r[recordDescOffset+2 : recordDescOffset+2+n])
+}
+
+// Metadata retorna os metadados da transação, ou nil quando não houver
+func (r Record) Metadata() map[string]string {
+	off, ok := r.metadataOffset()
+	if !ok || r[off] == 0 {
+		return nil
+	}
+	meta := make(map[string]string, int(r[off]))
+	p := off + 1
+	for i := 0; i < int(r[off]); i++ {
+		k := string(r[p+1 : p+1+int(r[p])])
+		p += 1 + int(r[p])
+		n := int(binary.LittleEndian.Uint16(r[p:]))
+		meta[k] = string(r[p+2 : p+2+n])
+		p += 2 + n
+	}
+	return meta
 }
 
 func ToTransaction(r Record) (string, *model.Transaction) {
-	timestamp := int64(binary.LittleEndian.Uint64(r[2:10]))
-	return string(r[0]), &model.Transaction{
-		Timestamp:   timestamp,
-		Type:        string(r[1]),
-		Value:       int(int32(binary.LittleEndian.Uint32(r[10:14]))),
-		Description: string(bytes.Trim(r[14:], "\x00")),
+	return strconv.FormatUint(uint64(r.ClientID()), 10), &model.Transaction{
+		Timestamp:   r.Timestamp(),
+		Type:        string(r.Type()),
+		Value:       int64(binary.LittleEndian.Uint64(r[recordValueOffset:])),
+		Description: r.Description(),
+		Metadata:    r.Metadata(),
+	}
+}
+
+// legacyDescription converte a descrição de tamanho fixo dos formatos
+// antigos, descartando os bytes nulos e um caractere UTF-8 cortado no final
+func legacyDescription(b []byte) string {
+	return string(bytes.ToValidUTF8(bytes.TrimRight(b, "\x00"), nil))
+}
+
+// UpgradeV1 converte um registro da versão 1 para o formato atual
+func UpgradeV1(b []byte) (Record, error) {
+	if len(b) < RecordV1Size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	cid, err := ParseClientID(string(b[0]))
+	if err != nil {
+		return nil, err
+	}
+	value := int64(int32(binary.LittleEndian.Uint32(b[10:14])))
+	return appendRecord(nil, cid, b[1], int64(binary.LittleEndian.Uint64(b[2:10])), value, legacyDescription(b[14:RecordV1Size]), nil)
+}
+
+// upgradeV3 converte os dados de um registro da versão 2 ou 3 (valor em
+// int32) para o formato atual
+func upgradeV3(b []byte) (Record, error) {
+	value := int64(int32(binary.LittleEndian.Uint32(b[13:17])))
+	return appendRecord(nil, binary.LittleEndian.Uint32(b[0:4]), b[4], int64(binary.LittleEndian.Uint64(b[5:13])), value, legacyDescription(b[17:recordV3DataSize]), nil)
+}
+
+// upgradeV4 converte um registro da versão 4 para o formato atual
+func upgradeV4(b []byte) (Record, error) {
+	value := int64(binary.LittleEndian.Uint64(b[13:21]))
+	return appendRecord(nil, binary.LittleEndian.Uint32(b[0:4]), b[4], int64(binary.LittleEndian.Uint64(b[5:13])), value, legacyDescription(b[21:recordV4DataSize]), nil)
+}
+
+// DecodeRecord converte um registro gravado na versão informada para o
+// formato atual, validando o checksum quando a versão possui um
+func DecodeRecord(version byte, b []byte) (Record, error) {
+	c, err := CodecFor(version)
+	if err != nil {
+		return nil, err
+	}
+	return c.Read(bytes.NewReader(b))
+}
+
+// WriteHeader escreve o cabeçalho do chunk com a versão informada
+func WriteHeader(w io.Writer, version byte) error {
+	return writeHeader(w, version, 0)
+}
+
+func writeHeader(w io.Writer, version byte, flags byte) error {
+	h := [HeaderSize]byte{}
+	copy(h[:], headerMagic[:])
+	h[4] = version
+	h[headerFlagsOffset] = flags
+	_, err := w.Write(h[:])
+	return err
+}
+
+// ParseHeader identifica a versão do chunk a partir dos primeiros bytes do arquivo.
+// Retorna a versão e o tamanho do cabeçalho (0 para arquivos v1)
+func ParseHeader(b []byte) (byte, int, error) {
+	if len(b) < len(headerMagic) || !bytes.Equal(b[:len(headerMagic)], headerMagic[:]) {
+		return FormatV1, 0, nil
+	}
+	if len(b) < HeaderSize {
+		return 0, 0, ErrInvalidHeader
+	}
+	if _, err := CodecFor(b[4]); err != nil || b[4] == FormatV1 {
+		return 0, 0, ErrUnknownFormat
 	}
+	return b[4], HeaderSize, nil
 }
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// chaves de idempotência
+//
+//	<path>/IDEMPOTENCY     uma chave por linha (JSON), com a resposta original
+//
+// as linhas são acrescentadas depois da confirmação no WAL de cada transação
+// com chave e gravadas em disco antes da liberação do WAL, que também guarda
+// a chave no metadado da transação. Na abertura as chaves antigas são descartadas e o arquivo é
+// reescrito
+const IdempotencyFile = "IDEMPOTENCY"
+
+// IdempotencyEntry é uma chave de idempotência vista pelo store, com o limite
+// e o saldo respondidos à transação original
+type IdempotencyEntry struct {
+	Client    string `json:"client"`
+	Key       string `json:"key"`
+	Timestamp int64  `json:"ts"`
+	Limit     int64  `json:"limit"`
+	Balance   int64  `json:"balance"`
+}
+
+// IdempotencyLog é o arquivo de chaves de idempotência aberto para escrita
+type IdempotencyLog struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// OpenIdempotencyLog lê as chaves gravadas em path a partir do timestamp
+// since (unix millis) e abre o arquivo para as próximas
+func OpenIdempotencyLog(path string, since int64) (*IdempotencyLog, []IdempotencyEntry, error) {
+	all, err := readIdempotencyEntries(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make([]IdempotencyEntry, 0, len(all))
+	for _, e := range all {
+		if e.Timestamp >= since {
+			entries = append(entries, e)
+		}
+	}
+
+	// reescreve só as chaves dentro da janela
+	err = writeIdempotencyEntries(path, entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(path, IdempotencyFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &IdempotencyLog{f: f, w: bufio.NewWriter(f)}, entries, nil
+}
+
+// readIdempotencyEntries lê todas as chaves gravadas em path. Uma última
+// linha incompleta (queda durante a escrita) é ignorada
+func readIdempotencyEntries(path string) ([]IdempotencyEntry, error) {
+	b, err := os.ReadFile(filepath.Join(path, IdempotencyFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	entries := make([]IdempotencyEntry, 0)
+	for len(b) > 0 {
+		line, rest, complete := bytes.Cut(b, []byte{'\n'})
+		b = rest
+		var e IdempotencyEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			if !complete {
+				break
+			}
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// writeIdempotencyEntries substitui o arquivo de chaves de path
+func writeIdempotencyEntries(path string, entries []IdempotencyEntry) error {
+	name := filepath.Join(path, IdempotencyFile)
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+	tmp := name + ".tmp"
+	err := os.WriteFile(tmp, buf.Bytes(), 0644)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err == nil {
+		err = syncDir(path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Append acrescenta a chave ao log. A gravação em disco só é garantida
+// depois de Sync
+func (l *IdempotencyLog) Append(e IdempotencyEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// Sync grava em disco as chaves acrescentadas
+func (l *IdempotencyLog) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.w.Flush()
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *IdempotencyLog) Close() error {
+	err := l.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyLog(t *testing.T) {
+	dir := t.TempDir()
+	l, entries, err := db.OpenIdempotencyLog(dir, 0)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.NoError(t, l.Append(db.IdempotencyEntry{Client: "1", Key: "a", Timestamp: 10, Limit: 100, Balance: -5}))
+	require.NoError(t, l.Append(db.IdempotencyEntry{Client: "2", Key: "a", Timestamp: 20, Limit: 50, Balance: 7}))
+	require.NoError(t, l.Close())
+
+	// última linha incompleta e chave fora da janela
+	f, err := os.OpenFile(filepath.Join(dir, db.IdempotencyFile), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"client":"1","key":"b","ts":30`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	l, entries, err = db.OpenIdempotencyLog(dir, 15)
+	require.NoError(t, err)
+	require.Equal(t, []db.IdempotencyEntry{{Client: "2", Key: "a", Timestamp: 20, Limit: 50, Balance: 7}}, entries)
+	require.NoError(t, l.Close())
+
+	b, err := os.ReadFile(filepath.Join(dir, db.IdempotencyFile))
+	require.NoError(t, err)
+	require.Equal(t, `{"client":"2","key":"a","ts":20,"limit":50,"balance":7}`+"\n", string(b))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, db.IdempotencyFile), []byte("x\n"), 0644))
+	_, _, err = db.OpenIdempotencyLog(dir, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+)
+
+// Iterator percorre os registros de um cliente em ordem de gravação, um
+// chunk por vez.
+//
+//	it, err := d.Iterate("1")
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		r := it.Record()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator interface {
+	// Next avança para o próximo registro e retorna false no fim do
+	// histórico ou em caso de erro
+	Next() bool
+	// Record retorna o registro atual
+	Record() Record
+	// Err retorna o erro que interrompeu a iteração, se houver
+	Err() error
+	Close() error
+}
+
+// fileIterator mantém aberto apenas o chunk atual. Os chunks são os do
+// manifesto no momento da criação; se um deles for compactado durante a
+// iteração, o manifesto é relido a partir da última sequência lida
+type fileIterator struct {
+	dir    string
+	chunks []ChunkInfo
+	cr     *chunkReader
+	cur    ChunkInfo
+	// última sequência completamente lida
+	seq uint64
+	r   Record
+	err error
+}
+
+func (it *fileIterator) Next() bool {
+	for it.err == nil {
+		if it.cr == nil && !it.open() {
+			return false
+		}
+		r, err := it.cr.Next()
+		if err == nil {
+			it.r = r
+			return true
+		}
+		if err != io.EOF {
+			it.err = fmt.Errorf("%s: %w", it.cur.Name, err)
+			return false
+		}
+		it.seq = it.cur.LastSeq
+		it.cr.Close()
+		it.cr = nil
+	}
+	return false
+}
+
+// open abre o próximo chunk, retornando false no fim do histórico
+func (it *fileIterator) open() bool {
+	for attempt := 0; ; attempt++ {
+		if len(it.chunks) == 0 {
+			return false
+		}
+		it.cur, it.chunks = it.chunks[0], it.chunks[1:]
+		cr, err := openChunk(filepath.Join(it.dir, it.cur.Name))
+		if errors.Is(err, fs.ErrNotExist) && attempt < 3 {
+			chunks, lerr := listChunks(it.dir)
+			if lerr != nil {
+				it.err = lerr
+				return false
+			}
+			it.chunks = chunksAfter(chunks, it.seq)
+			continue
+		}
+		if err != nil {
+			it.err = fmt.Errorf("%s: %w", it.cur.Name, err)
+			return false
+		}
+		cr.skipThrough(it.cur.FirstSeq, it.seq)
+		it.cr = cr
+		return true
+	}
+}
+
+func (it *fileIterator) Record() Record {
+	return it.r
+}
+
+func (it *fileIterator) Err() error {
+	return it.err
+}
+
+func (it *fileIterator) Close() error {
+	it.chunks = nil
+	if it.cr != nil {
+		err := it.cr.Close()
+		it.cr = nil
+		return err
+	}
+	return nil
+}
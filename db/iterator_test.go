@@ -0,0 +1,67 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	dir := t.TempDir()
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: int64(i * 2), Value: 10, Type: "c", Description: "a"},
+			{Timestamp: int64(i*2 + 1), Value: 3, Type: "d", Description: "b"},
+		}))
+	}
+
+	it, err := d.Iterate("1")
+	require.NoError(t, err)
+	defer it.Close()
+
+	// compactação no meio da iteração
+	var ts int64
+	for ; ts < 5 && it.Next(); ts++ {
+		r := it.Record()
+		require.Equal(t, ts, r.Timestamp())
+	}
+	c := db.NewCompactor(dir)
+	c.MinChunks = 4
+	n, err := c.Compact("1")
+	require.NoError(t, err)
+	require.Equal(t, 18, n)
+
+	for it.Next() {
+		r := it.Record()
+		require.Equal(t, ts, r.Timestamp())
+		ts++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, int64(40), ts)
+	require.NoError(t, it.Close())
+
+	// registro corrompido interrompe a iteração
+	chunks, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	path := filepath.Join(dir, "1", chunks[len(chunks)-1].Name)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[db.HeaderSize+len(record(t, "1", &model.Transaction{Type: "d", Description: "b"}))+15]++
+	require.NoError(t, os.WriteFile(path, b, 0644))
+
+	it, err = d.Iterate("1")
+	require.NoError(t, err)
+	defer it.Close()
+	count := 0
+	for it.Next() {
+		count++
+	}
+	require.ErrorIs(t, it.Err(), db.ErrChecksum)
+	require.Equal(t, 39, count)
+}
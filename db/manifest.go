@@ -0,0 +1,472 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// estrutura da entrada do manifesto
+//
+//	 len (uint16)  op   first seq   last seq   count    min ts   max ts   name    crc32
+//	|-----------| |--| |--------| |--------| |------| |------| |------| |-----| |-------|
+//
+// o manifesto é um arquivo append-only por cliente com o catálogo dos chunks.
+// Cada chunk recebe um número de sequência crescente; segmentos ocupam o
+// intervalo de sequências dos chunks que substituíram. As operações são:
+//
+//	A - chunk criado (ainda em escrita, não selado)
+//	S - chunk selado, com quantidade de registros e timestamps mínimo/máximo
+//	R - segmento que substitui os chunks do intervalo first..last
+//
+// uma entrada incompleta ou com crc inválido no final do arquivo (escrita
+// interrompida) é ignorada
+const ManifestFile = "MANIFEST"
+
+// diretório para onde vão arquivos que não fazem parte do manifesto
+const QuarantineDir = "quarantine"
+
+const (
+	opAdd     byte = 'A'
+	opSeal    byte = 'S'
+	opReplace byte = 'R'
+)
+
+// ChunkInfo descreve um chunk (ou segmento) registrado no manifesto
+type ChunkInfo struct {
+	Name     string
+	FirstSeq uint64
+	LastSeq  uint64
+	Count    int64
+	MinTs    int64
+	MaxTs    int64
+	Sealed   bool
+}
+
+// IsSegment indica se o arquivo é um segmento gerado pela compactação
+func (c *ChunkInfo) IsSegment() bool {
+	return strings.HasSuffix(c.Name, SegmentSuffix)
+}
+
+// IsCarry indica se o arquivo é o saldo transportado gerado pelo arquivamento
+func (c *ChunkInfo) IsCarry() bool {
+	return strings.HasSuffix(c.Name, CarrySuffix)
+}
+
+type manifestOp struct {
+	op   byte
+	info ChunkInfo
+}
+
+func appendManifestOp(b []byte, m manifestOp) []byte {
+	start := len(b)
+	b = append(b, 0, 0)
+	b = append(b, m.op)
+	b = binary.LittleEndian.AppendUint64(b, m.info.FirstSeq)
+	b = binary.LittleEndian.AppendUint64(b, m.info.LastSeq)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.info.Count))
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.info.MinTs))
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.info.MaxTs))
+	b = append(b, byte(len(m.info.Name)))
+	b = append(b, m.info.Name...)
+	binary.LittleEndian.PutUint16(b[start:], uint16(len(b)-start-2))
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start+2:]))
+}
+
+// tamanho mínimo do conteúdo de uma entrada (sem nome)
+const manifestOpMinSize = 1 + 8*5 + 1
+
+func decodeManifestOp(p []byte) (manifestOp, bool) {
+	if len(p) < manifestOpMinSize || len(p) != manifestOpMinSize+int(p[manifestOpMinSize-1]) {
+		return manifestOp{}, false
+	}
+	return manifestOp{
+		op: p[0],
+		info: ChunkInfo{
+			FirstSeq: binary.LittleEndian.Uint64(p[1:9]),
+			LastSeq:  binary.LittleEndian.Uint64(p[9:17]),
+			Count:    int64(binary.LittleEndian.Uint64(p[17:25])),
+			MinTs:    int64(binary.LittleEndian.Uint64(p[25:33])),
+			MaxTs:    int64(binary.LittleEndian.Uint64(p[33:41])),
+			Name:     string(p[manifestOpMinSize:]),
+		},
+	}, true
+}
+
+var manifestLocks sync.Map
+
+// manifestLock serializa as escritas no manifesto de um cliente
+func manifestLock(dir string) *sync.Mutex {
+	l, _ := manifestLocks.LoadOrStore(filepath.Clean(dir), &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+var maintenanceLocks sync.Map
+
+// maintenanceLock serializa as operações que substituem chunks de um cliente
+// (compactação e arquivamento)
+func maintenanceLock(dir string) *sync.Mutex {
+	l, _ := maintenanceLocks.LoadOrStore(filepath.Clean(dir), &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// LoadManifest retorna todos os chunks registrados no manifesto do cliente,
+// selados ou não, em ordem de sequência. Diretórios anteriores ao manifesto
+// (com o symlink LAST) são catalogados na primeira leitura
+func LoadManifest(dir string) ([]ChunkInfo, error) {
+	entries, err := readManifest(dir)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return entries, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	l := manifestLock(dir)
+	l.Lock()
+	defer l.Unlock()
+	entries, err = readManifest(dir)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return entries, err
+	}
+	entries, err = catalogLegacy(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = rewriteManifest(dir, entries)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(filepath.Join(dir, "LAST"))
+	return entries, syncDir(dir)
+}
+
+func readManifest(dir string) ([]ChunkInfo, error) {
+	entries, _, err := scanManifest(dir)
+	return entries, err
+}
+
+// scanManifest aplica as entradas válidas do manifesto e retorna o tamanho
+// da parte válida do arquivo
+func scanManifest(dir string) ([]ChunkInfo, int64, error) {
+	f, err := os.Open(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	entries := make([]ChunkInfo, 0)
+	var valid int64
+	b := bufio.NewReader(f)
+	l := make([]byte, 2)
+	for {
+		_, err = io.ReadFull(b, l)
+		if err != nil {
+			break
+		}
+		p := make([]byte, int(binary.LittleEndian.Uint16(l))+4)
+		_, err = io.ReadFull(b, p)
+		if err != nil {
+			break
+		}
+		sum := binary.LittleEndian.Uint32(p[len(p)-4:])
+		if crc32.ChecksumIEEE(p[:len(p)-4]) != sum {
+			break
+		}
+		m, ok := decodeManifestOp(p[:len(p)-4])
+		if !ok {
+			break
+		}
+		entries = applyManifestOp(entries, m)
+		valid += int64(2 + len(p))
+	}
+	return entries, valid, nil
+}
+
+func applyManifestOp(entries []ChunkInfo, m manifestOp) []ChunkInfo {
+	switch m.op {
+	case opAdd:
+		return append(entries, m.info)
+	case opSeal:
+		for i := range entries {
+			if entries[i].FirstSeq == m.info.FirstSeq {
+				entries[i].Count = m.info.Count
+				entries[i].MinTs = m.info.MinTs
+				entries[i].MaxTs = m.info.MaxTs
+				entries[i].Sealed = true
+			}
+		}
+	case opReplace:
+		m.info.Sealed = true
+		keep := entries[:0]
+		inserted := false
+		for _, e := range entries {
+			if e.FirstSeq >= m.info.FirstSeq && e.LastSeq <= m.info.LastSeq {
+				if !inserted {
+					keep = append(keep, m.info)
+					inserted = true
+				}
+				continue
+			}
+			keep = append(keep, e)
+		}
+		if !inserted {
+			keep = append(keep, m.info)
+		}
+		entries = keep
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].FirstSeq < entries[j].FirstSeq
+		})
+	}
+	return entries
+}
+
+// tamanho do manifesto após a última escrita deste processo, por arquivo
+var manifestSizes sync.Map
+
+// repairManifest remove do final do manifesto uma entrada incompleta,
+// deixada por uma escrita interrompida, para que as próximas entradas
+// não fiquem escondidas atrás dela. O arquivo só é verificado quando o seu
+// tamanho difere do gravado pela última escrita
+func repairManifest(dir string) (int64, error) {
+	path := filepath.Join(dir, ManifestFile)
+	st, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if size, ok := manifestSizes.Load(path); ok && size.(int64) == st.Size() {
+		return st.Size(), nil
+	}
+	_, valid, err := scanManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	if st.Size() > valid {
+		err = os.Truncate(path, valid)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return valid, nil
+}
+
+// appendManifest acrescenta as operações ao manifesto e sincroniza o arquivo.
+// Deve ser chamado com o manifestLock do diretório
+func appendManifest(dir string, ops ...manifestOp) error {
+	size, err := repairManifest(dir)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, ManifestFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 0, 64*len(ops))
+	for _, m := range ops {
+		b = appendManifestOp(b, m)
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		manifestSizes.Delete(path)
+		return err
+	}
+	manifestSizes.Store(path, size+int64(len(b)))
+	return nil
+}
+
+// rewriteManifest substitui o manifesto por um contendo apenas o estado
+// atual dos chunks. Deve ser chamado com o manifestLock do diretório
+func rewriteManifest(dir string, entries []ChunkInfo) error {
+	b := make([]byte, 0, 64*len(entries))
+	for _, e := range entries {
+		b = appendManifestOp(b, manifestOp{op: opAdd, info: e})
+		if e.Sealed {
+			b = appendManifestOp(b, manifestOp{op: opSeal, info: e})
+		}
+	}
+	tmp := filepath.Join(dir, ManifestFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return err
+	}
+	manifestSizes.Store(filepath.Join(dir, ManifestFile), int64(len(b)))
+	return syncDir(dir)
+}
+
+// sealedChunks filtra os chunks completos, os únicos visíveis para leitura
+func sealedChunks(entries []ChunkInfo) []ChunkInfo {
+	sealed := make([]ChunkInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.Sealed {
+			sealed = append(sealed, e)
+		}
+	}
+	return sealed
+}
+
+// listChunks lista os chunks selados do cliente em ordem de sequência
+func listChunks(dir string) ([]ChunkInfo, error) {
+	entries, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	return sealedChunks(entries), nil
+}
+
+// chunksAfter retorna os chunks com registros posteriores à sequência seq
+func chunksAfter(chunks []ChunkInfo, seq uint64) []ChunkInfo {
+	i := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].LastSeq > seq
+	})
+	return chunks[i:]
+}
+
+// catalogLegacy monta o catálogo de um diretório anterior ao manifesto,
+// ordenando os chunks pelo nome (ksuid)
+func catalogLegacy(dir string) ([]ChunkInfo, error) {
+	refs, _, err := scanChunks(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ChunkInfo, 0, len(refs))
+	var seq uint64
+	for _, ref := range refs {
+		info := ChunkInfo{Name: ref.name, FirstSeq: seq + 1, Sealed: true}
+		cr, err := openChunk(filepath.Join(dir, ref.name))
+		if err == nil {
+			if len(cr.index) > 0 {
+				for i, e := range cr.index {
+					if i == 0 || e.minTs < info.MinTs {
+						info.MinTs = e.minTs
+					}
+					if i == 0 || e.maxTs > info.MaxTs {
+						info.MaxTs = e.maxTs
+					}
+					info.Count += int64(e.count)
+				}
+				seq += uint64(len(cr.index))
+			} else {
+				for {
+					r, err := cr.Next()
+					if err != nil {
+						break
+					}
+					info.observe(r.Timestamp())
+				}
+				seq++
+			}
+			cr.Close()
+		} else {
+			seq++
+		}
+		info.LastSeq = seq
+		entries = append(entries, info)
+	}
+	return entries, nil
+}
+
+// nextChunkInfo monta a entrada do próximo chunk, com a sequência seguinte à
+// última do manifesto. Deve ser chamado com o manifestLock do diretório
+func nextChunkInfo(dir string, name string) (ChunkInfo, error) {
+	entries, err := readManifest(dir)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	info := ChunkInfo{Name: name, FirstSeq: 1}
+	if len(entries) > 0 {
+		info.FirstSeq = entries[len(entries)-1].LastSeq + 1
+	}
+	info.LastSeq = info.FirstSeq
+	return info, nil
+}
+
+// observe contabiliza um registro com o timestamp informado
+func (c *ChunkInfo) observe(ts int64) {
+	if c.Count == 0 || ts < c.MinTs {
+		c.MinTs = ts
+	}
+	if c.Count == 0 || ts > c.MaxTs {
+		c.MaxTs = ts
+	}
+	c.Count++
+}
+
+// Quarantine move para o diretório de quarentena os arquivos que não fazem
+// parte do manifesto e os chunks que nunca foram selados (escrita
+// interrompida). Deve ser executado antes de qualquer escrita no cliente
+func Quarantine(dir string) ([]string, error) {
+	entries, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := manifestLock(dir)
+	l.Lock()
+	defer l.Unlock()
+
+	known := make(map[string]bool, len(entries)+2)
+	known[ManifestFile] = true
+	known[CheckpointFile] = true
+	for _, e := range entries {
+		if e.Sealed {
+			known[e.Name] = true
+		}
+	}
+
+	d, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	moved := make([]string, 0)
+	for _, de := range d {
+		if de.IsDir() || known[de.Name()] {
+			continue
+		}
+		qdir := filepath.Join(dir, QuarantineDir)
+		err = os.MkdirAll(qdir, 0755)
+		if err != nil {
+			return moved, err
+		}
+		err = os.Rename(filepath.Join(dir, de.Name()), filepath.Join(qdir, de.Name()))
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, de.Name())
+	}
+	if len(moved) > 0 {
+		return moved, syncDir(dir)
+	}
+	return moved, nil
+}
@@ -0,0 +1,65 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	cdir := filepath.Join(dir, "1")
+	wf := db.NewFileWriterFactoryFromPath(dir)
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(wf, frr)
+
+	tr := []*model.Transaction{
+		{Timestamp: 1, Value: 100, Type: "c", Description: "a"},
+		{Timestamp: 2, Value: 30, Type: "d", Description: "b"},
+	}
+	require.NoError(t, d.Write("1", tr))
+
+	// chunk nunca selado (queda durante a escrita) e arquivo fora do manifesto
+	codec, err := db.CodecFor(db.CurrentFormat)
+	require.NoError(t, err)
+	w, err := wf.NewWriter("1", "2zzzzzzzzzzzzzzzzzzzzzzzzzz", codec, 1)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteRecord(record(t, "1", &model.Transaction{Timestamp: 3, Value: 500, Type: "c", Description: "c"})))
+	require.NoError(t, os.WriteFile(filepath.Join(cdir, "stray"), []byte("x"), 0644))
+
+	bal, err := frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(70), bal)
+
+	moved, err := d.Quarantine("1")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"2zzzzzzzzzzzzzzzzzzzzzzzzzz", "stray"}, moved)
+	_, err = os.Stat(filepath.Join(cdir, db.QuarantineDir, "stray"))
+	require.NoError(t, err)
+
+	// entrada incompleta no final do manifesto
+	f, err := os.OpenFile(filepath.Join(cdir, db.ManifestFile), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{40, 0, 'A', 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, d.Write("1", tr))
+	bal, err = frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(140), bal)
+
+	chunks, err := db.LoadManifest(cdir)
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	require.False(t, chunks[1].Sealed)
+	require.True(t, chunks[2].Sealed)
+	require.Equal(t, uint64(3), chunks[2].FirstSeq)
+	require.Equal(t, int64(2), chunks[2].Count)
+	require.Equal(t, int64(1), chunks[2].MinTs)
+	require.Equal(t, int64(2), chunks[2].MaxTs)
+}
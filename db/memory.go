@@ -0,0 +1,278 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// MemoryEngine guarda os chunks em memória, com a mesma semântica do engine
+// de arquivos: cada DB.Write gera um chunk com sequência própria, gravado pelo
+// codec do DB, e os registros só ficam visíveis para os leitores depois do
+// Close do writer. Clientes sem chunks retornam fs.ErrNotExist. Serve para
+// testes herméticos:
+//
+//	e := db.NewMemoryEngine()
+//	d := db.NewDB(e, e)
+type MemoryEngine struct {
+	mu      sync.RWMutex
+	clients map[string][]*memChunk
+}
+
+// memChunk é o equivalente de um arquivo de chunk, sem o cabeçalho
+type memChunk struct {
+	info  ChunkInfo
+	codec Codec
+	data  []byte
+}
+
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{clients: make(map[string][]*memChunk)}
+}
+
+func (e *MemoryEngine) NewWriter(id, chunkId string, codec Codec, transactionLen int) (CloseableRegWriter, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	chunks := e.clients[id]
+	info := ChunkInfo{Name: chunkId, FirstSeq: 1}
+	if len(chunks) > 0 {
+		info.FirstSeq = chunks[len(chunks)-1].info.LastSeq + 1
+	}
+	info.LastSeq = info.FirstSeq
+	c := &memChunk{info: info, codec: codec}
+	e.clients[id] = append(chunks, c)
+	return &memWriter{e: e, id: id, c: c, info: info, b: bytes.NewBuffer(make([]byte, 0, transactionLen*64))}, nil
+}
+
+type memWriter struct {
+	e    *MemoryEngine
+	id   string
+	c    *memChunk
+	info ChunkInfo
+	b    *bytes.Buffer
+	buf  []byte
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	return w.b.Write(p)
+}
+
+func (w *memWriter) WriteByte(b byte) error {
+	return w.b.WriteByte(b)
+}
+
+func (w *memWriter) WriteRecord(r Record) error {
+	var err error
+	w.buf, err = w.c.codec.Append(w.buf[:0], r)
+	if err != nil {
+		return err
+	}
+	w.b.Write(w.buf)
+	w.info.observe(r.Timestamp())
+	return nil
+}
+
+// Close sela o chunk, tornando os registros visíveis
+func (w *memWriter) Close() error {
+	w.e.mu.Lock()
+	defer w.e.mu.Unlock()
+	w.info.Sealed = true
+	w.c.data = w.b.Bytes()
+	w.c.info = w.info
+	return nil
+}
+
+// Abort descarta o chunk sem selá-lo
+func (w *memWriter) Abort() error {
+	w.e.mu.Lock()
+	defer w.e.mu.Unlock()
+	chunks := w.e.clients[w.id]
+	for i, c := range chunks {
+		if c == w.c {
+			chunks = append(chunks[:i:i], chunks[i+1:]...)
+			break
+		}
+	}
+	if len(chunks) == 0 {
+		delete(w.e.clients, w.id)
+	} else {
+		w.e.clients[w.id] = chunks
+	}
+	return nil
+}
+
+// sealed retorna uma cópia da lista de chunks selados do cliente. Os dados de
+// um chunk selado não mudam mais, então podem ser lidos sem o lock
+func (e *MemoryEngine) sealed(id string) ([]*memChunk, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	chunks, ok := e.clients[id]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	sealed := make([]*memChunk, 0, len(chunks))
+	for _, c := range chunks {
+		if c.info.Sealed {
+			sealed = append(sealed, c)
+		}
+	}
+	return sealed, nil
+}
+
+func (c *memChunk) reader() *chunkReader {
+	cr := &chunkReader{f: bytes.NewReader(c.data), codec: c.codec, end: int64(len(c.data))}
+	cr.seek(0)
+	return cr
+}
+
+func (e *MemoryEngine) ReadLast(id string, n int) ([]Record, error) {
+	chunks, err := e.sealed(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	b := make([]Record, 0, n)
+	for i := len(chunks) - 1; i >= 0 && len(b) < n; i-- {
+		b, err = chunks[i].reader().appendLast(b, n-len(b))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (e *MemoryEngine) ReadRange(id string, from, to int64) ([]Record, error) {
+	chunks, err := e.sealed(id)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0)
+	for _, c := range chunks {
+		if c.info.Count == 0 || c.info.MaxTs < from || c.info.MinTs > to {
+			continue
+		}
+		records, err = c.reader().appendRange(records, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.info.Name, err)
+		}
+	}
+	return records, nil
+}
+
+// Summary resume os registros de todos os chunks selados
+func (e *MemoryEngine) Summary(id string) (*Summary, error) {
+	chunks, err := e.sealed(id)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Summary{}
+	for _, c := range chunks {
+		cr := c.reader()
+		for {
+			r, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", c.info.Name, err)
+			}
+			if !cp.add(r) {
+				return nil, fmt.Errorf("%s: %w", c.info.Name, ErrOverflow)
+			}
+		}
+	}
+	return cp, nil
+}
+
+func (e *MemoryEngine) GetBalance(id string) (int64, error) {
+	cp, err := e.Summary(id)
+	if err != nil {
+		return -1, err
+	}
+	return cp.Balance, nil
+}
+
+func (e *MemoryEngine) Count(id string) (int64, error) {
+	cp, err := e.Summary(id)
+	if err != nil {
+		return 0, err
+	}
+	return cp.Count, nil
+}
+
+func (e *MemoryEngine) Records(id string) (int64, error) {
+	cp, err := e.Summary(id)
+	if err != nil {
+		return 0, err
+	}
+	return cp.Records, nil
+}
+
+// LastChunk retorna o nome do chunk mais recente do cliente
+func (e *MemoryEngine) LastChunk(id string) (string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	chunks := e.clients[id]
+	if len(chunks) == 0 {
+		return "", fs.ErrNotExist
+	}
+	return chunks[len(chunks)-1].info.Name, nil
+}
+
+// Iterate percorre os chunks selados no momento da chamada
+func (e *MemoryEngine) Iterate(id string) (Iterator, error) {
+	chunks, err := e.sealed(id)
+	if err != nil {
+		return nil, err
+	}
+	return &memIterator{chunks: chunks}, nil
+}
+
+type memIterator struct {
+	chunks []*memChunk
+	cur    *memChunk
+	cr     *chunkReader
+	r      Record
+	err    error
+}
+
+func (it *memIterator) Next() bool {
+	for it.err == nil {
+		if it.cr == nil {
+			if len(it.chunks) == 0 {
+				return false
+			}
+			it.cur, it.chunks = it.chunks[0], it.chunks[1:]
+			it.cr = it.cur.reader()
+		}
+		r, err := it.cr.Next()
+		if err == nil {
+			it.r = r
+			return true
+		}
+		if err != io.EOF {
+			it.err = fmt.Errorf("%s: %w", it.cur.info.Name, err)
+			return false
+		}
+		it.cr = nil
+	}
+	return false
+}
+
+func (it *memIterator) Record() Record {
+	return it.r
+}
+
+func (it *memIterator) Err() error {
+	return it.err
+}
+
+func (it *memIterator) Close() error {
+	it.chunks = nil
+	it.cr = nil
+	return nil
+}
@@ -0,0 +1,60 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+// o engine em memória deve responder igual ao de arquivos
+func TestMemoryEngine(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := db.NewMemoryEngine()
+	frr := db.NewFileRegReader(dir)
+	engines := []*db.DB{
+		db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr),
+		db.NewDB(e, e),
+	}
+	readers := []db.RegReader{frr, e}
+
+	for i := 0; i < 10; i++ {
+		tr := []*model.Transaction{
+			{Timestamp: int64(i * 3), Value: int64(i + 1), Type: "c", Description: "crédito"},
+			{Timestamp: int64(i*3 + 1), Value: 2, Type: "d", Description: "débito", Metadata: map[string]string{"i": "x"}},
+			{Timestamp: int64(i*3 + 2), Value: 1, Type: "c", Description: "c"},
+		}
+		for _, d := range engines {
+			require.NoError(t, d.Write("1", tr))
+		}
+	}
+
+	results := make([][]any, len(readers))
+	for i, r := range readers {
+		last, err := r.ReadLast("1", 7)
+		require.NoError(t, err)
+		rng, err := r.ReadRange("1", 5, 12)
+		require.NoError(t, err)
+		bal, err := r.GetBalance("1")
+		require.NoError(t, err)
+		count, err := r.Count("1")
+		require.NoError(t, err)
+
+		it, err := r.Iterate("1")
+		require.NoError(t, err)
+		all := make([]db.Record, 0)
+		for it.Next() {
+			all = append(all, it.Record())
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+
+		_, err = r.GetBalance("2")
+		results[i] = []any{last, rng, bal, count, all, err != nil}
+	}
+	require.Equal(t, results[0], results[1])
+	require.Equal(t, int64(45), results[1][2])
+	require.Len(t, results[1][4], 30)
+}
@@ -1,120 +1,558 @@
 package db
 
 import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+
+	"github.com/ricardovhz/rinha2/model"
 )
 
+// Summary é o estado do cliente calculado a partir do histórico: o saldo, as
+// quantidades de transações e de registros e o limite e o estado da última
+// alteração de cada um (HasLimit falso e State vazio quando não houve)
+type Summary struct {
+	Balance  int64
+	Count    int64
+	Records  int64
+	Limit    int64
+	HasLimit bool
+	State    string
+}
+
+// add acumula o registro no resumo. Retorna falso se o saldo não cabe em 64
+// bits
+func (s *Summary) add(r Record) bool {
+	var ok bool
+	if s.Balance, ok = model.AddAmount(s.Balance, r.Value()); !ok {
+		return false
+	}
+	s.Count += r.Transactions()
+	s.Records += r.Records()
+	if limit, ok := r.LimitChange(); ok {
+		s.Limit, s.HasLimit = limit, true
+	}
+	if state, ok := r.StateChange(); ok {
+		s.State = state
+	}
+	return true
+}
+
+// merge acumula o resumo dos registros posteriores aos de s
+func (s *Summary) merge(next *Summary) bool {
+	var ok bool
+	if s.Balance, ok = model.AddAmount(s.Balance, next.Balance); !ok {
+		return false
+	}
+	s.Count += next.Count
+	s.Records += next.Records
+	if next.HasLimit {
+		s.Limit, s.HasLimit = next.Limit, true
+	}
+	if next.State != "" {
+		s.State = next.State
+	}
+	return true
+}
+
 type RegReader interface {
+	// ReadLast retorna os últimos n registros do cliente, do mais recente
+	// para o mais antigo
 	ReadLast(id string, n int) ([]Record, error)
-	GetBalance(id string) (int32, error)
+	GetBalance(id string) (int64, error)
+	// Count retorna a quantidade de transações do cliente
+	Count(id string) (int64, error)
+	// Records retorna a quantidade de registros do cliente, incluindo as
+	// alterações de limite e de estado
+	Records(id string) (int64, error)
+	// Summary retorna saldo e quantidades em uma única leitura
+	Summary(id string) (*Summary, error)
+	// ReadRange retorna, em ordem de gravação, os registros com timestamp
+	// entre from e to (inclusive)
+	ReadRange(id string, from, to int64) ([]Record, error)
+	// Iterate percorre todo o histórico do cliente em ordem de gravação
+	Iterate(id string) (Iterator, error)
 }
 
-type fileRegReader struct {
-	path string
+// chunkReader lê sequencialmente os registros de um chunk ou segmento,
+// convertendo registros de versões antigas para o formato atual
+type chunkReader struct {
+	f      io.ReaderAt
+	b      *bufio.Reader
+	codec  Codec
+	offset int64
+	end    int64
+	index  []segmentEntry
+
+	// arquivos comprimidos: stream do bloco atual e último timestamp lido
+	compressed bool
+	z          io.ReadCloser
+	prev       int64
+
+	// arquivo cifrado: f é o conteúdo em claro
+	encrypted bool
 }
 
-func (frr *fileRegReader) ReadLast(id string, n int) ([]Record, error) {
-	dbf, err := os.Readlink(filepath.Join(frr.path, id, "LAST"))
+func openChunk(path string) (*chunkReader, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.Open(filepath.Join(frr.path, id, dbf))
+	cr, err := newChunkReader(f, strings.HasSuffix(path, SegmentSuffix))
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	defer f.Close()
-	_, err = f.Seek(int64(-n*RecordSize), io.SeekEnd)
+	return cr, nil
+}
+
+func newChunkReader(f *os.File, segment bool) (*chunkReader, error) {
+	// arquivos cifrados são lidos pelo conteúdo em claro (ver crypto.go)
+	content, size, keyID, err := openContent(f)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, HeaderSize)
+	n, _ := content.ReadAt(h, 0)
+	version, hlen, err := ParseHeader(h[:n])
 	if err != nil {
-		_, err = f.Seek(0, io.SeekStart)
+		return nil, err
+	}
+	codec, err := CodecFor(version)
+	if err != nil {
+		return nil, err
+	}
+	cr := &chunkReader{
+		f:         content,
+		codec:     codec,
+		offset:    int64(hlen),
+		end:       size,
+		encrypted: keyID != "",
+	}
+	if hlen == HeaderSize && h[headerFlagsOffset]&headerCompressed != 0 {
+		if version != FormatV5 {
+			return nil, ErrUnknownFormat
+		}
+		cr.compressed = true
+	}
+	if segment {
+		cr.index, cr.end, err = readSegmentIndex(content, size)
 		if err != nil {
 			return nil, err
 		}
 	}
-	b := make([]Record, 0)
+	if cr.end < cr.offset {
+		cr.end = cr.offset
+	}
+	cr.seek(cr.offset)
+	return cr, nil
+}
 
-	for i := 0; i < n; i++ {
-		r := Record{}
-		_, err = f.Read(r[:])
-		if err != nil && err != io.EOF {
-			return nil, err
-		} else if err == io.EOF {
+// seek posiciona a leitura no offset informado, limitada à área de registros
+func (cr *chunkReader) seek(off int64) {
+	sr := io.NewSectionReader(cr.f, off, cr.end-off)
+	if cr.b == nil {
+		cr.b = bufio.NewReader(sr)
+	} else {
+		cr.b.Reset(sr)
+	}
+	if cr.compressed {
+		// cada offset do índice é o início de um bloco
+		if cr.z == nil {
+			cr.z = flate.NewReader(cr.b)
+		} else {
+			cr.z.(flate.Resetter).Reset(cr.b, nil)
+		}
+		cr.prev = 0
+	}
+}
+
+// skipThrough posiciona a leitura de um segmento iniciado na sequência first
+// no primeiro chunk de origem com sequência maior que seq. Para chunks
+// simples não há o que pular
+func (cr *chunkReader) skipThrough(first, seq uint64) {
+	for i, e := range cr.index {
+		if first+uint64(i) > seq {
+			cr.seek(e.offset)
+			return
+		}
+	}
+	if len(cr.index) > 0 {
+		cr.seek(cr.end)
+	}
+}
+
+// Next retorna o próximo registro do chunk. Um registro incompleto no final
+// do arquivo é tratado como fim do chunk
+func (cr *chunkReader) Next() (Record, error) {
+	r, err := cr.read()
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return r, err
+}
+
+// read lê o próximo registro, retornando io.ErrUnexpectedEOF para um
+// registro incompleto
+func (cr *chunkReader) read() (Record, error) {
+	if cr.compressed {
+		return cr.readCompressed()
+	}
+	return cr.codec.Read(cr.b)
+}
+
+// appendRange acrescenta a out os registros do chunk com timestamp entre from
+// e to. Em segmentos, os chunks de origem fora do intervalo não são lidos
+func (cr *chunkReader) appendRange(out []Record, from, to int64) ([]Record, error) {
+	if len(cr.index) == 0 {
+		return cr.appendN(out, -1, from, to)
+	}
+	var err error
+	for _, e := range cr.index {
+		if e.count == 0 || e.maxTs < from || e.minTs > to {
+			continue
+		}
+		cr.seek(e.offset)
+		out, err = cr.appendN(out, int64(e.count), from, to)
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// appendN lê até n registros (todos, se n < 0) a partir da posição atual.
+// Registros de saldo transportado não fazem parte do histórico e são
+// ignorados, assim como em appendTail
+func (cr *chunkReader) appendN(out []Record, n int64, from, to int64) ([]Record, error) {
+	for ; n != 0; n-- {
+		r, err := cr.Next()
+		if err == io.EOF {
 			break
 		}
-		b = append(b, r)
+		if err != nil {
+			return out, err
+		}
+		if ts := r.Timestamp(); ts >= from && ts <= to && r.IsTransaction() {
+			out = append(out, r)
+		}
 	}
+	return out, nil
+}
 
-	return b, nil
+// appendLast acrescenta a out os últimos n registros do chunk, do mais
+// recente para o mais antigo. Em segmentos, os chunks de origem são lidos do
+// mais recente para o mais antigo até completar n
+func (cr *chunkReader) appendLast(out []Record, n int) ([]Record, error) {
+	if len(cr.index) == 0 {
+		return cr.appendTail(out, n, -1)
+	}
+	var err error
+	for i := len(cr.index) - 1; i >= 0 && n > 0; i-- {
+		cr.seek(cr.index[i].offset)
+		l := len(out)
+		out, err = cr.appendTail(out, n, int64(cr.index[i].count))
+		if err != nil {
+			return out, err
+		}
+		n -= len(out) - l
+	}
+	return out, nil
 }
 
-func (frr *fileRegReader) GetBalance(id string) (int32, error) {
-	d, err := os.ReadDir(filepath.Join(frr.path, id))
-	if err != nil {
-		return -1, err
+// appendTail lê até max registros (todos, se max < 0) a partir da posição
+// atual e acrescenta a out os n últimos, do mais recente para o mais antigo
+func (cr *chunkReader) appendTail(out []Record, n int, max int64) ([]Record, error) {
+	if n <= 0 {
+		return out, nil
+	}
+	ring := make([]Record, 0, n)
+	total := 0
+	for ; max != 0; max-- {
+		r, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return out, err
+		}
+		if !r.IsTransaction() {
+			continue
+		}
+		if len(ring) < n {
+			ring = append(ring, r)
+		} else {
+			ring[total%n] = r
+		}
+		total++
+	}
+	for i := 1; i <= len(ring); i++ {
+		out = append(out, ring[(total-i)%n])
 	}
+	return out, nil
+}
 
-	c := make(chan int32)
+func (cr *chunkReader) Close() error {
+	if c, ok := cr.f.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
 
-	wg := sync.WaitGroup{}
+type fileRegReader struct {
+	path string
+	// diretório do histórico arquivado (ver archive.go)
+	archive string
+}
 
-	go func() {
-		wg.Wait()
-		close(c)
-	}()
+// ReadLast percorre os chunks do mais recente para o mais antigo até reunir
+// n registros. Se um arquivo sumir durante a leitura (compactação
+// concluída), a listagem é refeita
+func (frr *fileRegReader) ReadLast(id string, n int) ([]Record, error) {
+	for attempt := 0; ; attempt++ {
+		records, err := frr.tryReadLast(id, n)
+		if errors.Is(err, fs.ErrNotExist) && attempt < 3 {
+			continue
+		}
+		return records, err
+	}
+}
 
-	for _, de := range d {
-		if de.Name() == "LAST" {
+func (frr *fileRegReader) tryReadLast(id string, n int) ([]Record, error) {
+	dir := filepath.Join(frr.path, id)
+	chunks, err := listChunks(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	b := make([]Record, 0, n)
+	for i := len(chunks) - 1; i >= 0 && len(b) < n; i-- {
+		cr, err := openChunk(filepath.Join(dir, chunks[i].Name))
+		if err != nil {
+			return nil, err
+		}
+		b, err = cr.appendLast(b, n-len(b))
+		cr.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// summary calcula saldo e quantidade de registros do cliente, partindo do
+// checkpoint (quando existir) e lendo apenas os chunks posteriores a ele.
+// Se um arquivo sumir durante a leitura (compactação concluída), a
+// listagem é refeita
+func (frr *fileRegReader) summary(id string) (*Checkpoint, error) {
+	for attempt := 0; ; attempt++ {
+		cp, err := frr.trySummary(id)
+		if errors.Is(err, fs.ErrNotExist) && attempt < 3 {
 			continue
 		}
+		return cp, err
+	}
+}
+
+func (frr *fileRegReader) trySummary(id string) (*Checkpoint, error) {
+	dir := filepath.Join(frr.path, id)
+	refs, err := listChunks(dir)
+	if err != nil {
+		return nil, err
+	}
+	cp, err := ReadCheckpoint(dir)
+	if err != nil {
+		// sem checkpoint válido, lê todo o histórico
+		cp = &Checkpoint{}
+	}
+	refs = chunksAfter(refs, cp.LastSeq)
+
+	// cada chunk é lido em paralelo e os resumos são somados na ordem do
+	// histórico, que decide a última alteração de limite e de estado
+	type chunkSummary struct {
+		sum Summary
+		err error
+	}
+	results := make([]chunkSummary, len(refs))
+
+	wg := sync.WaitGroup{}
+
+	for i, ref := range refs {
 		wg.Add(1)
 
-		go func(en os.DirEntry, ch chan<- int32) {
+		go func(ref ChunkInfo, s *chunkSummary) {
 			defer wg.Done()
-			f, err := os.Open(filepath.Join(frr.path, id, en.Name()))
-			if err != nil {
-				return
-			}
-			defer f.Close()
-
-			// posiciona no primeiro registro de valor (1 (id) + 1 (type) + 8 (timestamp))
-			_, err = f.Seek(1, io.SeekStart)
+			name := ref.Name
+			cr, err := openChunk(filepath.Join(dir, name))
 			if err != nil {
+				// chunk ilegível (chave ausente, autenticação, versão) não
+				// pode sumir do saldo
+				s.err = fmt.Errorf("%s: %w", name, err)
 				return
 			}
+			defer cr.Close()
+			cr.skipThrough(ref.FirstSeq, cp.LastSeq)
 
 			for {
-				bn := make([]byte, 13)
-				_, err = f.Read(bn)
+				r, err := cr.Next()
 				if err != nil {
-					return
+					if err != io.EOF {
+						s.err = fmt.Errorf("%s: %w", name, err)
+					}
+					break
 				}
-
-				bal := int32(int(bn[9]) | int(bn[10])<<8 | int(bn[11])<<16 | int(bn[12])<<24)
-				if bn[0] == 'd' {
-					bal *= -1
-				}
-				c <- bal
-
-				// posiciona no valor do proximo registro (10 (descr) + 1 (id) + 1 (type) + 8 (timestamp))
-				_, err = f.Seek(11, io.SeekCurrent)
-				if err != nil {
-					return
+				if !s.sum.add(r) {
+					s.err = fmt.Errorf("%s: %w", name, ErrOverflow)
+					break
 				}
 			}
+		}(ref, &results[i])
+	}
+	wg.Wait()
+
+	for _, e := range results {
+		if e.err != nil {
+			return nil, e.err
+		}
+		if !cp.Summary.merge(&e.sum) {
+			return nil, ErrOverflow
+		}
+	}
+	if len(refs) > 0 {
+		cp.LastSeq = refs[len(refs)-1].LastSeq
+		cp.LastChunk = refs[len(refs)-1].Name
+	}
+
+	return cp, nil
+}
+
+// ReadRange usa os timestamps mínimo e máximo de cada chunk, gravados no
+// manifesto, para ler apenas os arquivos que podem ter registros no intervalo
+func (frr *fileRegReader) ReadRange(id string, from, to int64) ([]Record, error) {
+	for attempt := 0; ; attempt++ {
+		records, err := frr.tryReadRange(id, from, to)
+		if errors.Is(err, fs.ErrNotExist) && attempt < 3 {
+			continue
+		}
+		return records, err
+	}
+}
 
-		}(de, c)
+func (frr *fileRegReader) tryReadRange(id string, from, to int64) ([]Record, error) {
+	dir := filepath.Join(frr.path, id)
+	chunks, err := listChunks(dir)
+	if err != nil {
+		return nil, err
+	}
+	return appendChunksRange(make([]Record, 0), dir, chunks, from, to)
+}
+
+// appendChunksRange acrescenta a out os registros dos chunks com timestamp
+// entre from e to
+func appendChunksRange(out []Record, dir string, chunks []ChunkInfo, from, to int64) ([]Record, error) {
+	for _, c := range chunks {
+		if c.Count == 0 || c.MaxTs < from || c.MinTs > to {
+			continue
+		}
+		cr, err := openChunk(filepath.Join(dir, c.Name))
+		if err != nil {
+			return nil, err
+		}
+		out, err = cr.appendRange(out, from, to)
+		cr.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Name, err)
+		}
+	}
+	return out, nil
+}
+
+func (frr *fileRegReader) Iterate(id string) (Iterator, error) {
+	dir := filepath.Join(frr.path, id)
+	chunks, err := listChunks(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &fileIterator{dir: dir, chunks: chunks}, nil
+}
+
+func (frr *fileRegReader) GetBalance(id string) (int64, error) {
+	cp, err := frr.summary(id)
+	if err != nil {
+		return -1, err
+	}
+	return cp.Balance, nil
+}
+
+func (frr *fileRegReader) Count(id string) (int64, error) {
+	cp, err := frr.summary(id)
+	if err != nil {
+		return 0, err
 	}
+	return cp.Count, nil
+}
 
-	var total int32
-	for e := range c {
-		total += e
+func (frr *fileRegReader) Records(id string) (int64, error) {
+	cp, err := frr.summary(id)
+	if err != nil {
+		return 0, err
 	}
+	return cp.Records, nil
+}
 
-	return total, nil
+func (frr *fileRegReader) Summary(id string) (*Summary, error) {
+	cp, err := frr.summary(id)
+	if err != nil {
+		return nil, err
+	}
+	return &cp.Summary, nil
+}
+
+// Checkpoint grava um novo checkpoint com o estado atual dos chunks do cliente
+func (frr *fileRegReader) Checkpoint(id string) error {
+	cp, err := frr.summary(id)
+	if err != nil {
+		return err
+	}
+	return WriteCheckpoint(filepath.Join(frr.path, id), cp)
+}
+
+// LastChunk retorna o nome do chunk mais recente do cliente
+func (frr *fileRegReader) LastChunk(id string) (string, error) {
+	entries, err := LoadManifest(filepath.Join(frr.path, id))
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fs.ErrNotExist
+	}
+	return entries[len(entries)-1].Name, nil
+}
+
+// Quarantine move os arquivos fora do manifesto do cliente para a quarentena
+func (frr *fileRegReader) Quarantine(id string) ([]string, error) {
+	return Quarantine(filepath.Join(frr.path, id))
 }
 
 func NewFileRegReader(path string) RegReader {
-	return &fileRegReader{path: path}
+	return NewFileRegReaderWithArchive(path, "")
+}
+
+// NewFileRegReaderWithArchive cria o leitor com o histórico arquivado em
+// archive. Sem archive, o arquivo fica em path/archive
+func NewFileRegReaderWithArchive(path, archive string) RegReader {
+	if archive == "" {
+		archive = filepath.Join(path, ArchiveDir)
+	}
+	return &fileRegReader{path: path, archive: archive}
 }
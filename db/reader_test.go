@@ -1,58 +1,187 @@
 package db_test
 
 import (
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
 )
 
 func TestReader(t *testing.T) {
-	frr := db.NewFileRegReader(".")
+	t.Parallel()
+	e := db.NewMemoryEngine()
+	d := db.NewDB(e, e)
+	require.NoError(t, d.Write("1", []*model.Transaction{
+		{Timestamp: 1, Value: 100, Type: "c", Description: "a"},
+		{Timestamp: 2, Value: 30, Type: "d", Description: "b"},
+	}))
+	require.NoError(t, d.Write("2", []*model.Transaction{{Timestamp: 3, Value: 5, Type: "c", Description: "c"}}))
 
-	records, err := frr.ReadLast("1", 5)
-	if err != nil {
-		log.Printf("error reading records: %v", err)
-		t.Fail()
-	}
-	log.Printf("records: %v", records)
+	records, err := e.ReadLast("1", 5)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
 	for i, r := range records {
 		id, tr := db.ToTransaction(r)
-		if err != nil {
-			t.Fail()
-		}
+		require.Equal(t, "1", id)
 		log.Printf("%d record client %s: %v", i, id, tr)
 	}
+	require.Equal(t, int64(2), records[0].Timestamp())
+
+	records, err = e.ReadLast("2", 5)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	_, err = e.ReadLast("3", 5)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
 
-	records, err = frr.ReadLast("2", 5)
-	if err != nil {
-		log.Printf("error reading records: %v", err)
-		t.Fail()
+func TestBalance(t *testing.T) {
+	t.Parallel()
+	e := db.NewMemoryEngine()
+	d := db.NewDB(e, e)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: 1, Value: 100, Type: "c", Description: "a"},
+			{Timestamp: 2, Value: 30, Type: "d", Description: "b"},
+		}))
 	}
-	log.Printf("records: %v", records)
+	require.NoError(t, d.Write("2", []*model.Transaction{{Timestamp: 3, Value: 5, Type: "d", Description: "c"}}))
+
+	balance, err := e.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(210), balance)
+
+	balance, err = e.GetBalance("2")
+	require.NoError(t, err)
+	require.Equal(t, int64(-5), balance)
+
+	// chunk em escrita não é visível
+	codec, err := db.CodecFor(db.CurrentFormat)
+	require.NoError(t, err)
+	w, err := e.NewWriter("2", "2zzzzzzzzzzzzzzzzzzzzzzzzzz", codec, 1)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteRecord(record(t, "2", &model.Transaction{Timestamp: 4, Value: 50, Type: "c", Description: "d"})))
+	balance, err = e.GetBalance("2")
+	require.NoError(t, err)
+	require.Equal(t, int64(-5), balance)
+	require.NoError(t, w.Close())
+	balance, err = e.GetBalance("2")
+	require.NoError(t, err)
+	require.Equal(t, int64(45), balance)
+}
+
+func TestReaderV1(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "1"), 0755))
+
+	// chunk v1, sem cabeçalho
+	v1 := []byte{
+		49, 99, 150, 115, 216, 182, 141, 1, 0, 0, 100, 0, 0, 0, 116, 101, 115, 116, 0, 0, 0, 0, 0, 0,
+		49, 100, 33, 221, 97, 186, 141, 1, 0, 0, 30, 0, 0, 0, 116, 101, 115, 116, 0, 0, 0, 0, 0, 0,
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1", "2ChunkV1"), v1, 0644))
+
+	// diretório anterior ao manifesto, catalogado na primeira leitura
+	frr := db.NewFileRegReader(dir)
+	records, err := frr.ReadLast("1", 5)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	id, tr := db.ToTransaction(records[0])
+	require.Equal(t, "1", id)
+	require.Equal(t, "d", tr.Type)
+	require.Equal(t, int64(30), tr.Value)
+
+	// chunk gravado pelo writer atual
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+	require.NoError(t, d.Write("1", []*model.Transaction{
+		{Timestamp: 1708228992300, Value: 5, Type: "c", Description: "v3"},
+	}))
+
+	bal, err := frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(75), bal)
+
+	chunks, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, "2ChunkV1", chunks[0].Name)
+	require.Equal(t, uint64(2), chunks[1].FirstSeq)
+}
+
+func TestReadLastAcrossChunks(t *testing.T) {
+	dir := t.TempDir()
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+
+	require.NoError(t, d.Write("1", []*model.Transaction{
+		{Timestamp: 1, Value: 1, Type: "c"},
+		{Timestamp: 2, Value: 2, Type: "c"},
+		{Timestamp: 3, Value: 3, Type: "c"},
+	}))
+	require.NoError(t, d.Write("1", []*model.Transaction{
+		{Timestamp: 4, Value: 4, Type: "c"},
+		{Timestamp: 5, Value: 5, Type: "c"},
+	}))
+	require.NoError(t, d.Write("1", []*model.Transaction{
+		{Timestamp: 6, Value: 6, Type: "c"},
+	}))
+
+	records, err := frr.ReadLast("1", 5)
+	require.NoError(t, err)
+	ts := make([]int64, len(records))
 	for i, r := range records {
-		id, tr := db.ToTransaction(r)
-		if err != nil {
-			t.Fail()
-		}
-		log.Printf("%d record client %s: %v", i, id, tr)
+		ts[i] = r.Timestamp()
 	}
+	require.Equal(t, []int64{6, 5, 4, 3, 2}, ts)
+
+	records, err = frr.ReadLast("1", 10)
+	require.NoError(t, err)
+	require.Len(t, records, 6)
+	require.Equal(t, int64(1), records[5].Timestamp())
+
+	_, err = frr.ReadLast("2", 5)
+	require.ErrorIs(t, err, os.ErrNotExist)
 }
 
-func TestBalance(t *testing.T) {
-	frr := db.NewFileRegReader(".")
+func TestReadRange(t *testing.T) {
+	dir := t.TempDir()
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), db.NewFileRegReader(dir))
 
-	balance, err := frr.GetBalance("1")
-	if err != nil {
-		log.Printf("error reading balance: %v", err)
-		t.Fail()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: int64(i * 10), Value: int64(i), Type: "c", Description: "a"},
+			{Timestamp: int64(i*10 + 5), Value: int64(i), Type: "d", Description: "b"},
+		}))
 	}
-	log.Printf("balance 1: %d", balance)
+	c := db.NewCompactor(dir)
+	c.MinChunks = 4
+	_, err := c.Compact("1")
+	require.NoError(t, err)
 
-	balance, err = frr.GetBalance("2")
-	if err != nil {
-		log.Printf("error reading balance: %v", err)
-		t.Fail()
+	tr, err := d.ReadRange("1", 25, 60)
+	require.NoError(t, err)
+	ts := make([]int64, len(tr))
+	for i, t := range tr {
+		ts[i] = t.Timestamp
 	}
-	log.Printf("balance 2: %d", balance)
+	require.Equal(t, []int64{25, 30, 35, 40, 45, 50, 55, 60}, ts)
+
+	// chunks fora do intervalo não são abertos
+	chunks, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	last := chunks[len(chunks)-1]
+	require.Equal(t, int64(90), last.MinTs)
+	require.NoError(t, os.Remove(filepath.Join(dir, "1", last.Name)))
+	tr, err = d.ReadRange("1", 0, 85)
+	require.NoError(t, err)
+	require.Len(t, tr, 18)
+
+	tr, err = d.ReadRange("1", 1000, 2000)
+	require.NoError(t, err)
+	require.Empty(t, tr)
 }
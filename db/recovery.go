@@ -0,0 +1,211 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RecoveryReport descreve o que a recuperação descartou de um chunk
+type RecoveryReport struct {
+	Chunk string
+	// Kept é a quantidade de registros válidos mantidos
+	Kept int64
+	// Dropped são os registros completos descartados a partir do primeiro inválido
+	Dropped []Record
+	// Trailing é a quantidade de bytes de um registro incompleto no final do chunk
+	Trailing int64
+	// Err é o motivo pelo qual o arquivo não pôde ser recuperado
+	Err error
+}
+
+// Recover verifica os chunks de um cliente e trunca cada chunk corrompido no
+// último registro válido. Se algum chunk for alterado o checkpoint é
+// descartado, já que o saldo gravado nele deixa de valer.
+//
+// Segmentos são gravados de forma atômica e não são truncados: um segmento
+// corrompido é apenas reportado, assim como um arquivo cifrado
+func Recover(dir string) ([]RecoveryReport, error) {
+	refs, err := listChunks(dir)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]RecoveryReport, 0)
+	changed := false
+	for _, ref := range refs {
+		rep, err := recoverChunk(filepath.Join(dir, ref.Name), ref.IsSegment())
+		if err != nil {
+			return reports, err
+		}
+		rep.Chunk = ref.Name
+		if rep.Err == nil && len(rep.Dropped) == 0 && rep.Trailing == 0 {
+			continue
+		}
+		if rep.Err == nil {
+			changed = true
+			err = resealChunk(dir, ref)
+			if err != nil {
+				return reports, err
+			}
+		}
+		reports = append(reports, rep)
+	}
+	if changed {
+		err = os.Remove(filepath.Join(dir, CheckpointFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return reports, err
+		}
+		err = syncDir(dir)
+	}
+	return reports, err
+}
+
+// RecoverAll executa a recuperação de todos os clientes do diretório de dados
+func RecoverAll(path string) (map[string][]RecoveryReport, error) {
+	d, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]RecoveryReport)
+	for _, de := range d {
+		if !de.IsDir() {
+			continue
+		}
+		if _, err := ParseClientID(de.Name()); err != nil {
+			continue
+		}
+		reports, err := Recover(filepath.Join(path, de.Name()))
+		if err != nil {
+			return res, err
+		}
+		if len(reports) > 0 {
+			res[de.Name()] = reports
+		}
+	}
+	return res, nil
+}
+
+func recoverChunk(path string, segment bool) (RecoveryReport, error) {
+	rep := RecoveryReport{}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return rep, err
+	}
+	defer f.Close()
+
+	cr, err := newChunkReader(f, segment)
+	if errors.Is(err, ErrInvalidHeader) && !segment {
+		// escrita interrompida antes do fim do cabeçalho
+		st, err := f.Stat()
+		if err != nil {
+			return rep, err
+		}
+		rep.Trailing = st.Size()
+		return rep, truncate(f, 0)
+	}
+	if err != nil {
+		rep.Err = err
+		return rep, nil
+	}
+
+	if cr.compressed || cr.encrypted {
+		// segmento comprimido ou arquivo cifrado: os registros não têm offset
+		// no arquivo e um frame cifrado não pode ser truncado, então o
+		// arquivo é apenas conferido
+		for {
+			_, err := cr.read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rep.Err = err
+				break
+			}
+			rep.Kept++
+		}
+		return rep, nil
+	}
+
+	valid := cr.offset
+	cnt := &countingReader{r: bufio.NewReader(io.NewSectionReader(f, cr.offset, cr.end-cr.offset))}
+	for {
+		start := cnt.n
+		r, err := cr.codec.Read(cnt)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || errors.Is(err, ErrInvalidRecord) {
+			// sem o tamanho do registro não há como continuar lendo
+			rep.Trailing = cr.end - cr.offset - start
+			break
+		}
+		if err != nil && !errors.Is(err, ErrChecksum) {
+			return rep, err
+		}
+		if err != nil || len(rep.Dropped) > 0 {
+			// a partir do primeiro registro inválido, tudo é descartado
+			rep.Dropped = append(rep.Dropped, r)
+			continue
+		}
+		rep.Kept++
+		valid = cr.offset + cnt.n
+	}
+
+	if segment {
+		if len(rep.Dropped) > 0 || rep.Trailing > 0 {
+			rep.Err = ErrChecksum
+		}
+		return rep, nil
+	}
+	if len(rep.Dropped) == 0 && rep.Trailing == 0 {
+		return rep, nil
+	}
+	return rep, truncate(f, valid)
+}
+
+// resealChunk atualiza no manifesto as estatísticas de um chunk truncado
+func resealChunk(dir string, ref ChunkInfo) error {
+	cr, err := openChunk(filepath.Join(dir, ref.Name))
+	if err != nil && !errors.Is(err, ErrInvalidHeader) {
+		return err
+	}
+	info := ChunkInfo{Name: ref.Name, FirstSeq: ref.FirstSeq, LastSeq: ref.LastSeq}
+	if err == nil {
+		for {
+			r, err := cr.Next()
+			if err != nil {
+				break
+			}
+			info.observe(r.Timestamp())
+		}
+		cr.Close()
+	}
+
+	l := manifestLock(dir)
+	l.Lock()
+	defer l.Unlock()
+	return appendManifest(dir, manifestOp{op: opSeal, info: info})
+}
+
+// countingReader conta os bytes lidos, para localizar o fim do último
+// registro válido
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func truncate(f *os.File, size int64) error {
+	err := f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,58 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	frr := db.NewFileRegReader(dir)
+	d := db.NewDB(db.NewFileWriterFactoryFromPath(dir), frr)
+
+	tr := make([]*model.Transaction, 5)
+	for i := range tr {
+		tr[i] = &model.Transaction{Timestamp: int64(i), Value: int64(10 * (i + 1)), Type: "c", Description: "rec"}
+	}
+	require.NoError(t, d.Write("1", tr))
+	require.NoError(t, d.Checkpoint("1"))
+
+	chunks, err := db.LoadManifest(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	chunk := chunks[len(chunks)-1].Name
+	path := filepath.Join(dir, "1", chunk)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// corrompe o valor do quarto registro e simula uma escrita interrompida
+	size := len(record(t, "1", tr[0]))
+	b[db.HeaderSize+3*size+15]++
+	b = append(b, 1, 2, 3)
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "1", db.CheckpointFile)))
+
+	_, err = frr.GetBalance("1")
+	require.ErrorIs(t, err, db.ErrChecksum)
+
+	reports, err := db.Recover(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, chunk, reports[0].Chunk)
+	require.Equal(t, int64(3), reports[0].Kept)
+	require.Len(t, reports[0].Dropped, 2)
+	require.Equal(t, int64(3), reports[0].Trailing)
+
+	bal, err := frr.GetBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(60), bal)
+
+	// nada mais a recuperar
+	reports, err = db.Recover(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Empty(t, reports)
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// registro de clientes
+//
+//	<path>/CLIENTS         clientes do store e seus limites (JSON)
+//
+// o arquivo é reescrito por inteiro (tmp + rename) a cada alteração. Sem ele
+// o store usa os clientes padrão
+const ClientsFile = "CLIENTS"
+
+var ErrInvalidClients = errors.New("invalid client registry")
+
+// ClientConfig é um cliente registrado no store. State é o estado da conta,
+// vazio para contas ativas
+type ClientConfig struct {
+	ID      string    `json:"id"`
+	Limit   int64     `json:"limit"`
+	State   string    `json:"state,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type clientRegistry struct {
+	Clients []ClientConfig `json:"clients"`
+}
+
+// ReadClients lê o registro de clientes do diretório de dados. Retorna
+// fs.ErrNotExist se o registro não existir
+func ReadClients(path string) ([]ClientConfig, error) {
+	b, err := os.ReadFile(filepath.Join(path, ClientsFile))
+	if err != nil {
+		return nil, err
+	}
+	reg := &clientRegistry{}
+	err = json.Unmarshal(b, reg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidClients, err)
+	}
+	err = validateClients(reg.Clients)
+	if err != nil {
+		return nil, err
+	}
+	return reg.Clients, nil
+}
+
+// WriteClients grava o registro de clientes, ordenado pelo id
+func WriteClients(path string, clients []ClientConfig) error {
+	err := validateClients(clients)
+	if err != nil {
+		return err
+	}
+	reg := &clientRegistry{Clients: append([]ClientConfig(nil), clients...)}
+	sort.Slice(reg.Clients, func(i, j int) bool {
+		a, _ := ParseClientID(reg.Clients[i].ID)
+		b, _ := ParseClientID(reg.Clients[j].ID)
+		return a < b
+	})
+	b, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(path, ClientsFile+".tmp")
+	err = os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(path, ClientsFile))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(path)
+}
+
+func validateClients(clients []ClientConfig) error {
+	seen := make(map[string]bool, len(clients))
+	for _, c := range clients {
+		if _, err := ParseClientID(c.ID); err != nil {
+			return fmt.Errorf("%w: client %q", ErrInvalidClients, c.ID)
+		}
+		if c.Limit < 0 {
+			return fmt.Errorf("%w: client %s: negative limit", ErrInvalidClients, c.ID)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("%w: client %s: duplicated", ErrInvalidClients, c.ID)
+		}
+		seen[c.ID] = true
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
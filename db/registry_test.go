@@ -0,0 +1,38 @@
+package db_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClients(t *testing.T) {
+	dir := t.TempDir()
+	_, err := db.ReadClients(dir)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	created := time.UnixMilli(1700000000000).UTC()
+	require.NoError(t, db.WriteClients(dir, []db.ClientConfig{
+		{ID: "10", Limit: 5, State: "frozen", Created: created},
+		{ID: "2", Limit: 0, Created: created},
+	}))
+	clients, err := db.ReadClients(dir)
+	require.NoError(t, err)
+	require.Equal(t, []db.ClientConfig{{ID: "2", Created: created}, {ID: "10", Limit: 5, State: "frozen", Created: created}}, clients)
+
+	for _, c := range [][]db.ClientConfig{
+		{{ID: "a"}},
+		{{ID: "1", Limit: -1}},
+		{{ID: "1"}, {ID: "1"}},
+	} {
+		require.ErrorIs(t, db.WriteClients(dir, c), db.ErrInvalidClients)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, db.ClientsFile), []byte(`{"clients":[{"id":"x"}]}`), 0644))
+	_, err = db.ReadClients(dir)
+	require.ErrorIs(t, err, db.ErrInvalidClients)
+}
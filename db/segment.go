@@ -0,0 +1,179 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// estrutura do segmento
+//
+// um segmento é o resultado da compactação de vários chunks consecutivos de um
+// cliente. o nome do arquivo é <primeiro chunk>-<último chunk>.seg e ele
+// substitui, no manifesto, todos os chunks nesse intervalo. A entrada i do
+// índice corresponde à sequência first+i do manifesto
+//
+//	+--------+-----------+-----------+-----+-----------+---------+
+//	| header | registros | índice #1 | ... | índice #n | trailer |
+//	+--------+-----------+-----------+-----+-----------+---------+
+//
+// cada entrada do índice descreve um chunk de origem
+//
+//	  tamanho    chunk id     offset (uint64)   count (uint32)  min ts (int64)  max ts (int64)
+//	|---|   |-----------|   |-------------|   |-----------|   |-----------|   |-----------|
+//
+// trailer
+//
+//	index offset (uint64)   entries (uint32)   magic
+//	|-------------------|   |--------------|   |---------------|
+//	+---+...+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	| x |   | x | x | x | x | x | x | x | 0 | S | E | G |
+//	+---+...+---+---+---+---+---+---+---+---+---+---+---+---+---+
+const (
+	SegmentSuffix = ".seg"
+
+	segmentTrailerSize = 16
+)
+
+var segmentMagic = [4]byte{0, 'S', 'E', 'G'}
+
+var ErrInvalidSegment = errors.New("invalid segment")
+
+// segmentEntry descreve um chunk de origem dentro do segmento
+type segmentEntry struct {
+	chunk  string
+	offset int64
+	count  uint32
+	minTs  int64
+	maxTs  int64
+}
+
+func appendSegmentIndex(b []byte, index []segmentEntry) []byte {
+	for _, e := range index {
+		b = append(b, byte(len(e.chunk)))
+		b = append(b, e.chunk...)
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.offset))
+		b = binary.LittleEndian.AppendUint32(b, e.count)
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.minTs))
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.maxTs))
+	}
+	return b
+}
+
+func appendSegmentTrailer(b []byte, indexOffset int64, entries int) []byte {
+	b = binary.LittleEndian.AppendUint64(b, uint64(indexOffset))
+	b = binary.LittleEndian.AppendUint32(b, uint32(entries))
+	return append(b, segmentMagic[:]...)
+}
+
+// readSegmentIndex lê o índice do final do segmento e retorna o offset onde
+// terminam os registros
+func readSegmentIndex(f io.ReaderAt, size int64) ([]segmentEntry, int64, error) {
+	if size < HeaderSize+segmentTrailerSize {
+		return nil, 0, ErrInvalidSegment
+	}
+	t := make([]byte, segmentTrailerSize)
+	_, err := f.ReadAt(t, size-segmentTrailerSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(t[12:], segmentMagic[:]) {
+		return nil, 0, ErrInvalidSegment
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(t[0:8]))
+	n := int(binary.LittleEndian.Uint32(t[8:12]))
+	if indexOffset < HeaderSize || indexOffset > size-segmentTrailerSize {
+		return nil, 0, ErrInvalidSegment
+	}
+
+	b := make([]byte, size-segmentTrailerSize-indexOffset)
+	_, err = f.ReadAt(b, indexOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	index := make([]segmentEntry, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 1 || len(b) < 1+int(b[0])+28 {
+			return nil, 0, ErrInvalidSegment
+		}
+		l := int(b[0])
+		e := segmentEntry{chunk: string(b[1 : 1+l])}
+		b = b[1+l:]
+		e.offset = int64(binary.LittleEndian.Uint64(b[0:8]))
+		e.count = binary.LittleEndian.Uint32(b[8:12])
+		e.minTs = int64(binary.LittleEndian.Uint64(b[12:20]))
+		e.maxTs = int64(binary.LittleEndian.Uint64(b[20:28]))
+		b = b[28:]
+		index = append(index, e)
+	}
+	return index, indexOffset, nil
+}
+
+// chunkRef é um arquivo de dados de um diretório anterior ao manifesto,
+// chunk ou segmento, e o intervalo de chunks que ele contém
+type chunkRef struct {
+	name  string
+	first string
+	last  string
+}
+
+func segmentRef(name string) (chunkRef, bool) {
+	first, last, ok := strings.Cut(strings.TrimSuffix(name, SegmentSuffix), "-")
+	if !ok || first == "" || last == "" {
+		return chunkRef{}, false
+	}
+	return chunkRef{name: name, first: first, last: last}, true
+}
+
+// scanChunks lista os arquivos de dados de um diretório anterior ao
+// manifesto, em ordem de criação (ksuid), e os chunks que já foram
+// incorporados a algum segmento
+func scanChunks(dir string) ([]chunkRef, []string, error) {
+	d, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	segments := make([]chunkRef, 0)
+	chunks := make([]chunkRef, 0, len(d))
+	for _, de := range d {
+		name := de.Name()
+		if de.IsDir() || name == "LAST" || name == CheckpointFile || name == ManifestFile {
+			continue
+		}
+		if strings.HasSuffix(name, SegmentSuffix) {
+			if ref, ok := segmentRef(name); ok {
+				segments = append(segments, ref)
+			}
+			continue
+		}
+		if strings.Contains(name, ".") {
+			continue
+		}
+		chunks = append(chunks, chunkRef{name: name, first: name, last: name})
+	}
+
+	refs := segments
+	covered := make([]string, 0)
+	for _, c := range chunks {
+		inSegment := false
+		for _, s := range segments {
+			if c.name >= s.first && c.name <= s.last {
+				inSegment = true
+				break
+			}
+		}
+		if inSegment {
+			covered = append(covered, c.name)
+		} else {
+			refs = append(refs, c)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].first < refs[j].first
+	})
+	return refs, covered, nil
+}
@@ -0,0 +1,324 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// tabela do engine SQLite. Cada lote gravado pelo DB.Write é uma transação
+// SQL e o chunk guarda o id do lote, para facilitar consultas manuais:
+//
+//	SELECT chunk, count(*), sum(value) FROM ledger WHERE client_id = 1 GROUP BY chunk
+//
+// seq define a ordem de gravação. O driver exige CGO; sem ele OpenSQLite
+// falha ao abrir o banco
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS ledger (
+	seq         INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id   INTEGER NOT NULL,
+	chunk       TEXT    NOT NULL,
+	type        TEXT    NOT NULL,
+	ts          INTEGER NOT NULL,
+	value       INTEGER NOT NULL,
+	description TEXT    NOT NULL,
+	metadata    TEXT
+);
+CREATE INDEX IF NOT EXISTS ledger_client_seq ON ledger (client_id, seq);
+CREATE INDEX IF NOT EXISTS ledger_client_ts ON ledger (client_id, ts);
+`
+
+const sqliteColumns = "client_id, type, ts, value, description, metadata"
+
+// SQLiteEngine grava o histórico dos clientes em um banco SQLite. Implementa
+// tanto a fábrica de writers quanto o RegReader do DB:
+//
+//	e, err := db.OpenSQLite("ledger.db")
+//	...
+//	d := db.NewDB(e, e)
+type SQLiteEngine struct {
+	db *sql.DB
+}
+
+// OpenSQLite abre (ou cria) o banco no caminho informado
+func OpenSQLite(path string) (*SQLiteEngine, error) {
+	d, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.Exec(sqliteSchema)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return &SQLiteEngine{db: d}, nil
+}
+
+func (e *SQLiteEngine) Close() error {
+	return e.db.Close()
+}
+
+// NewWriter inicia uma transação SQL para o lote. Os registros são gravados
+// em colunas, então o codec não é usado
+func (e *SQLiteEngine) NewWriter(id, chunkId string, codec Codec, transactionLen int) (CloseableRegWriter, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.Prepare("INSERT INTO ledger (chunk, " + sqliteColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &sqliteWriter{tx: tx, stmt: stmt, cid: cid, chunk: chunkId}, nil
+}
+
+// sqliteWriter só grava registros completos. Os registros ficam visíveis
+// para os leitores no commit, feito pelo Close
+type sqliteWriter struct {
+	tx    *sql.Tx
+	stmt  *sql.Stmt
+	cid   uint32
+	chunk string
+	err   error
+}
+
+func (w *sqliteWriter) Write(p []byte) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (w *sqliteWriter) WriteByte(b byte) error {
+	return errors.ErrUnsupported
+}
+
+func (w *sqliteWriter) WriteRecord(r Record) error {
+	if w.err != nil {
+		return w.err
+	}
+	if r.ClientID() != w.cid {
+		return ErrInvalidClientID
+	}
+	var meta sql.NullString
+	if m := r.Metadata(); m != nil {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		meta = sql.NullString{String: string(b), Valid: true}
+	}
+	value := int64(binary.LittleEndian.Uint64(r[recordValueOffset:]))
+	_, w.err = w.stmt.Exec(w.chunk, w.cid, string(r.Type()), r.Timestamp(), value, r.Description(), meta)
+	return w.err
+}
+
+// Close confirma o lote, ou o descarta se alguma gravação falhou
+func (w *sqliteWriter) Close() error {
+	w.stmt.Close()
+	if w.err != nil {
+		w.tx.Rollback()
+		return w.err
+	}
+	return w.tx.Commit()
+}
+
+// Abort descarta o lote
+func (w *sqliteWriter) Abort() error {
+	w.stmt.Close()
+	return w.tx.Rollback()
+}
+
+// scanRecord converte a linha atual para o formato atual de registro
+func scanRecord(rows *sql.Rows) (Record, error) {
+	var (
+		cid   uint32
+		typ   string
+		ts    int64
+		value int64
+		desc  string
+		meta  sql.NullString
+	)
+	err := rows.Scan(&cid, &typ, &ts, &value, &desc, &meta)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if meta.Valid {
+		err = json.Unmarshal([]byte(meta.String), &m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var t byte
+	if len(typ) > 0 {
+		t = typ[0]
+	}
+	return appendRecord(nil, cid, t, ts, value, desc, m)
+}
+
+func (e *SQLiteEngine) query(id, where string, args ...any) ([]Record, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := e.db.Query("SELECT "+sqliteColumns+" FROM ledger WHERE client_id = ? "+where, append([]any{cid}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]Record, 0)
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// ReadLast retorna fs.ErrNotExist quando o cliente não possui registros,
+// como o engine de arquivos
+func (e *SQLiteEngine) ReadLast(id string, n int) ([]Record, error) {
+	records, err := e.query(id, "AND type NOT IN ('b', 'l', 's') ORDER BY seq DESC LIMIT ?", n)
+	if err == nil && len(records) == 0 {
+		// só alterações de limite ou de estado
+		if count, cerr := e.Records(id); cerr != nil || count == 0 {
+			err = fs.ErrNotExist
+		}
+	}
+	return records, err
+}
+
+func (e *SQLiteEngine) ReadRange(id string, from, to int64) ([]Record, error) {
+	return e.query(id, "AND ts BETWEEN ? AND ? AND type NOT IN ('b', 'l', 's') ORDER BY seq", from, to)
+}
+
+func (e *SQLiteEngine) GetBalance(id string) (int64, error) {
+	return e.sum(id, "")
+}
+
+// BalanceAt usa o índice por timestamp
+func (e *SQLiteEngine) BalanceAt(id string, ts int64) (int64, error) {
+	return e.sum(id, "AND ts <= ?", ts)
+}
+
+// sum soma os valores, com sinal, dos registros do cliente
+func (e *SQLiteEngine) sum(id, where string, args ...any) (int64, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return -1, err
+	}
+	var bal int64
+	err = e.db.QueryRow("SELECT COALESCE(SUM(CASE type WHEN 'd' THEN -value WHEN 'l' THEN 0 WHEN 's' THEN 0 ELSE value END), 0) FROM ledger WHERE client_id = ? "+where, append([]any{cid}, args...)...).Scan(&bal)
+	if err != nil {
+		// o SQLite falha a soma quando ela não cabe em 64 bits
+		if strings.Contains(err.Error(), "integer overflow") {
+			err = ErrOverflow
+		}
+		return -1, err
+	}
+	return bal, nil
+}
+
+// Count não conta as alterações de limite e de estado
+func (e *SQLiteEngine) Count(id string) (int64, error) {
+	return e.count(id, "AND type NOT IN ('l', 's')")
+}
+
+func (e *SQLiteEngine) Records(id string) (int64, error) {
+	return e.count(id, "")
+}
+
+func (e *SQLiteEngine) Summary(id string) (*Summary, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return nil, err
+	}
+	sum := &Summary{}
+	err = e.db.QueryRow("SELECT COALESCE(SUM(CASE type WHEN 'd' THEN -value WHEN 'l' THEN 0 WHEN 's' THEN 0 ELSE value END), 0), "+
+		"COALESCE(SUM(CASE WHEN type IN ('l', 's') THEN 0 ELSE 1 END), 0), COUNT(*) FROM ledger WHERE client_id = ?", cid).Scan(&sum.Balance, &sum.Count, &sum.Records)
+	if err != nil {
+		if strings.Contains(err.Error(), "integer overflow") {
+			err = ErrOverflow
+		}
+		return nil, err
+	}
+	// últimas alterações de limite e de estado
+	for _, typ := range []string{"l", "s"} {
+		records, err := e.query(id, "AND type = ? ORDER BY seq DESC LIMIT 1", typ)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if limit, ok := r.LimitChange(); ok {
+				sum.Limit, sum.HasLimit = limit, true
+			}
+			if state, ok := r.StateChange(); ok {
+				sum.State = state
+			}
+		}
+	}
+	return sum, nil
+}
+
+func (e *SQLiteEngine) count(id, where string) (int64, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = e.db.QueryRow("SELECT COUNT(*) FROM ledger WHERE client_id = ? "+where, cid).Scan(&n)
+	return n, err
+}
+
+// Iterate mantém a consulta aberta durante a iteração. Com o journal em modo
+// WAL, gravações concorrentes não são vistas pelo iterador
+func (e *SQLiteEngine) Iterate(id string) (Iterator, error) {
+	cid, err := ParseClientID(id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := e.db.Query("SELECT "+sqliteColumns+" FROM ledger WHERE client_id = ? ORDER BY seq", cid)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteIterator{rows: rows}, nil
+}
+
+type sqliteIterator struct {
+	rows *sql.Rows
+	r    Record
+	err  error
+}
+
+func (it *sqliteIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+	it.r, it.err = scanRecord(it.rows)
+	return it.err == nil
+}
+
+func (it *sqliteIterator) Record() Record {
+	return it.r
+}
+
+func (it *sqliteIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+func (it *sqliteIterator) Close() error {
+	return it.rows.Close()
+}
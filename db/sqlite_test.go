@@ -0,0 +1,66 @@
+package db_test
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLite(t *testing.T) {
+	e, err := db.OpenSQLite(filepath.Join(t.TempDir(), "ledger.db"))
+	require.NoError(t, err)
+	defer e.Close()
+	d := db.NewDB(e, e)
+
+	_, err = d.ReadLast("1")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, d.Write("1", []*model.Transaction{
+			{Timestamp: int64(i * 2), Value: 10, Type: "c", Description: "crédito"},
+			{Timestamp: int64(i*2 + 1), Value: 3, Type: "d", Description: "débito", Metadata: map[string]string{"loja": "x"}},
+		}))
+	}
+	require.NoError(t, d.Write("2", []*model.Transaction{{Timestamp: 1, Value: 1, Type: "d", Description: "outro"}}))
+
+	bal, err := d.ReadBalance("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(28), bal)
+	count, err := d.ReadCount("1")
+	require.NoError(t, err)
+	require.Equal(t, int64(8), count)
+	bal, err = d.ReadBalance("2")
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), bal)
+	bal, err = d.BalanceAt("1", 4)
+	require.NoError(t, err)
+	require.Equal(t, int64(24), bal)
+
+	trs, err := d.ReadLast("1")
+	require.NoError(t, err)
+	require.Len(t, trs, 5)
+	require.Equal(t, int64(7), trs[0].Timestamp)
+	require.Equal(t, "débito", trs[0].Description)
+	require.Equal(t, map[string]string{"loja": "x"}, trs[0].Metadata)
+	require.Equal(t, int64(3), trs[4].Timestamp)
+
+	trs, err = d.ReadRange("1", 2, 4)
+	require.NoError(t, err)
+	require.Len(t, trs, 3)
+	require.Equal(t, int64(2), trs[0].Timestamp)
+
+	it, err := d.Iterate("1")
+	require.NoError(t, err)
+	var ts int64
+	for it.Next() {
+		require.Equal(t, ts, it.Record().Timestamp())
+		ts++
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+	require.Equal(t, int64(8), ts)
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// VerifyReport descreve os problemas encontrados em um arquivo do cliente
+type VerifyReport struct {
+	// Chunk é o nome do arquivo, ou vazio para problemas do diretório
+	Chunk    string
+	Problems []string
+}
+
+// Verify confere, sem alterar nada, os chunks de um cliente: checksums, id do
+// cliente nos registros, registros incompletos, estatísticas do manifesto,
+// ordem das sequências e dos nomes, arquivos fora do manifesto e o
+// checkpoint. Só os arquivos com problemas são reportados
+func Verify(dir string) ([]VerifyReport, error) {
+	cid, err := ParseClientID(filepath.Base(dir))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]VerifyReport, 0)
+	known := map[string]bool{ManifestFile: true, CheckpointFile: true}
+	var prev *ChunkInfo
+	for i := range entries {
+		e := entries[i]
+		known[e.Name] = true
+		rep := VerifyReport{Chunk: e.Name}
+		if !e.Sealed {
+			rep.Problems = append(rep.Problems, "chunk not sealed")
+		} else {
+			rep.Problems = verifyChunk(filepath.Join(dir, e.Name), e, cid)
+		}
+		if prev != nil {
+			if e.FirstSeq != prev.LastSeq+1 {
+				rep.Problems = append(rep.Problems, fmt.Sprintf("sequence %d does not follow %d", e.FirstSeq, prev.LastSeq))
+			}
+			if e.Name <= prev.Name {
+				rep.Problems = append(rep.Problems, fmt.Sprintf("name out of order after %s", prev.Name))
+			}
+		}
+		prev = &entries[i]
+		if len(rep.Problems) > 0 {
+			reports = append(reports, rep)
+		}
+	}
+
+	d, err := os.ReadDir(dir)
+	if err != nil {
+		return reports, err
+	}
+	for _, de := range d {
+		if de.IsDir() || known[de.Name()] {
+			continue
+		}
+		reports = append(reports, VerifyReport{Chunk: de.Name(), Problems: []string{"file not in manifest"}})
+	}
+
+	if _, err := ReadCheckpoint(dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		reports = append(reports, VerifyReport{Chunk: CheckpointFile, Problems: []string{err.Error()}})
+	}
+	return reports, nil
+}
+
+func verifyChunk(path string, e ChunkInfo, cid uint32) []string {
+	cr, err := openChunk(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer cr.Close()
+
+	problems := make([]string, 0)
+	info := ChunkInfo{}
+	for {
+		r, err := cr.read()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			problems = append(problems, "incomplete record at end of chunk")
+			break
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("record %d: %v", info.Count+1, err))
+			// sem o registro (stream corrompido) não há como continuar
+			if !errors.Is(err, ErrChecksum) || r == nil {
+				break
+			}
+		} else if r.ClientID() != cid {
+			problems = append(problems, fmt.Sprintf("record %d: client id %d", info.Count+1, r.ClientID()))
+		}
+		if r != nil {
+			info.observe(r.Timestamp())
+		}
+	}
+
+	if info.Count != e.Count {
+		problems = append(problems, fmt.Sprintf("%d records, manifest has %d", info.Count, e.Count))
+	} else if info.Count > 0 && (info.MinTs != e.MinTs || info.MaxTs != e.MaxTs) {
+		problems = append(problems, fmt.Sprintf("timestamps %d..%d, manifest has %d..%d", info.MinTs, info.MaxTs, e.MinTs, e.MaxTs))
+	}
+	return problems
+}
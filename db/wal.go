@@ -0,0 +1,364 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// estrutura da entrada do WAL
+//
+//	   seq (uint64)           record            crc32 (seq + record)
+//	|---------------|   |--------------|   |--------------|
+//	+---+---+...+---+---+---+...+---+---+---+---+---+---+
+//	| 0 | 0 |   | 1 | x | x |   | x | x | 0 | 0 | 0 | 0 |
+//	+---+---+...+---+---+---+...+---+---+---+---+---+---+
+//
+// seq é o número de sequência da transação dentro do cliente (1, 2, 3...), o
+// mesmo que a posição do registro no histórico do cliente. O registro é
+// gravado pelo codec da versão do segmento
+const walEntryOverhead = 8 + 4
+
+// tamanho a partir do qual um novo segmento é iniciado
+const walSegmentSize = 4 << 20
+
+var ErrWALClosed = errors.New("wal closed")
+
+type walRequest struct {
+	seq  uint64
+	r    Record
+	done chan error
+}
+
+type walSegment struct {
+	name   string
+	maxSeq map[uint32]uint64
+}
+
+// WAL é o log de escrita antecipada compartilhado por todos os clientes.
+// As entradas enfileiradas são gravadas em grupo (group commit) e só são
+// confirmadas depois do fsync do segmento
+type WAL struct {
+	dir string
+
+	mu       sync.Mutex
+	pending  []*walRequest
+	notify   chan struct{}
+	closed   bool
+	err      error
+	segments []*walSegment
+	flushed  map[uint32]uint64
+
+	current *walSegment
+	f       *os.File
+	size    int64
+	next    int
+
+	wg sync.WaitGroup
+}
+
+func segmentName(n int) string {
+	return fmt.Sprintf("%016d.wal", n)
+}
+
+func walSegments(dir string) ([]string, error) {
+	d, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(d))
+	for _, de := range d {
+		if strings.HasSuffix(de.Name(), ".wal") {
+			names = append(names, de.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// OpenWAL abre (ou cria) o WAL no diretório informado. Os segmentos existentes
+// são mantidos para replay e um novo segmento é iniciado para as próximas escritas
+func OpenWAL(dir string) (*WAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:     dir,
+		notify:  make(chan struct{}, 1),
+		flushed: make(map[uint32]uint64),
+	}
+
+	names, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		seg := &walSegment{name: name, maxSeq: make(map[uint32]uint64)}
+		err = w.scan(name, func(seq uint64, r Record) error {
+			seg.maxSeq[r.ClientID()] = seq
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.segments = append(w.segments, seg)
+		fmt.Sscanf(name, "%d.wal", &w.next)
+	}
+	w.next++
+
+	err = w.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// rotate fecha o segmento atual e inicia um novo
+func (w *WAL) rotate() error {
+	if w.f != nil {
+		err := w.f.Close()
+		if err != nil {
+			return err
+		}
+		w.segments = append(w.segments, w.current)
+	}
+	name := segmentName(w.next)
+	f, err := os.OpenFile(filepath.Join(w.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = WriteHeader(f, CurrentFormat)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = syncDir(w.dir)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.next++
+	w.f = f
+	w.size = HeaderSize
+	w.current = &walSegment{name: name, maxSeq: make(map[uint32]uint64)}
+	return nil
+}
+
+// Append enfileira o registro no WAL. O canal retornado recebe o resultado
+// da gravação assim que o registro estiver sincronizado em disco.
+// A ordem das chamadas é a ordem em que as entradas são gravadas
+func (w *WAL) Append(seq uint64, r Record) <-chan error {
+	req := &walRequest{seq: seq, r: r, done: make(chan error, 1)}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		req.done <- ErrWALClosed
+		return req.done
+	}
+	if w.err != nil {
+		w.mu.Unlock()
+		req.done <- w.err
+		return req.done
+	}
+	w.pending = append(w.pending, req)
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	w.mu.Unlock()
+	return req.done
+}
+
+func (w *WAL) run() {
+	defer w.wg.Done()
+	codec, _ := CodecFor(CurrentFormat)
+	buf := make([]byte, 0, 100*(walEntryOverhead+64))
+	for range w.notify {
+		w.mu.Lock()
+		batch := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		if len(batch) == 0 {
+			continue
+		}
+
+		var err error
+		buf = buf[:0]
+		for _, req := range batch {
+			buf, err = appendWALEntry(buf, codec, req.seq, req.r)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = w.f.Write(buf)
+		}
+		if err == nil {
+			err = w.f.Sync()
+		}
+
+		w.mu.Lock()
+		if err != nil {
+			// um fsync com falha deixa o estado do arquivo indefinido,
+			// nenhuma escrita posterior é aceita
+			w.err = err
+		} else {
+			w.size += int64(len(buf))
+			for _, req := range batch {
+				w.current.maxSeq[req.r.ClientID()] = req.seq
+			}
+			if w.size >= walSegmentSize {
+				err = w.rotate()
+				if err != nil {
+					w.err = err
+				}
+				w.release()
+			}
+		}
+		w.mu.Unlock()
+
+		for _, req := range batch {
+			req.done <- err
+		}
+	}
+}
+
+func appendWALEntry(b []byte, codec Codec, seq uint64, r Record) ([]byte, error) {
+	start := len(b)
+	b = binary.LittleEndian.AppendUint64(b, seq)
+	b, err := codec.Append(b, r)
+	if err != nil {
+		return b[:start], err
+	}
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:])), nil
+}
+
+// MarkFlushed informa que os registros do cliente até seq já estão gravados
+// nos chunks. Segmentos fechados sem nenhuma entrada pendente são removidos
+func (w *WAL) MarkFlushed(cid uint32, seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq > w.flushed[cid] {
+		w.flushed[cid] = seq
+	}
+	w.release()
+}
+
+func (w *WAL) release() {
+	keep := w.segments[:0]
+	for _, seg := range w.segments {
+		done := true
+		for cid, seq := range seg.maxSeq {
+			if w.flushed[cid] < seq {
+				done = false
+				break
+			}
+		}
+		if done && os.Remove(filepath.Join(w.dir, seg.name)) == nil {
+			continue
+		}
+		keep = append(keep, seg)
+	}
+	w.segments = keep
+}
+
+// Replay percorre, em ordem, as entradas do cliente com sequência maior que after
+func (w *WAL) Replay(cid uint32, after uint64, fn func(seq uint64, r Record) error) error {
+	w.mu.Lock()
+	names := make([]string, 0, len(w.segments))
+	for _, seg := range w.segments {
+		if seg.maxSeq[cid] > after {
+			names = append(names, seg.name)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, name := range names {
+		err := w.scan(name, func(seq uint64, r Record) error {
+			if r.ClientID() != cid || seq <= after {
+				return nil
+			}
+			return fn(seq, r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan lê as entradas válidas de um segmento. A leitura para na primeira
+// entrada incompleta ou com checksum inválido (escrita interrompida)
+func (w *WAL) scan(name string, fn func(seq uint64, r Record) error) error {
+	f, err := os.Open(filepath.Join(w.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := bufio.NewReader(f)
+	h := make([]byte, HeaderSize)
+	_, err = io.ReadFull(b, h)
+	if err != nil {
+		return nil
+	}
+	version, _, err := ParseHeader(h)
+	if err != nil {
+		return err
+	}
+
+	// segmentos antigos guardam os registros no formato da sua versão
+	codec, err := CodecFor(version)
+	if err != nil {
+		return err
+	}
+	h = h[:4]
+	for {
+		sum := crc32.NewIEEE()
+		tr := io.TeeReader(b, sum)
+		seq := make([]byte, 8)
+		_, err = io.ReadFull(tr, seq)
+		if err != nil {
+			return nil
+		}
+		r, err := codec.Read(tr)
+		if err != nil {
+			return nil
+		}
+		_, err = io.ReadFull(b, h)
+		if err != nil || binary.LittleEndian.Uint32(h) != sum.Sum32() {
+			return nil
+		}
+		err = fn(binary.LittleEndian.Uint64(seq), r)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close grava as entradas pendentes e fecha o segmento atual
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.notify)
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	return w.f.Close()
+}
@@ -0,0 +1,57 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/ricardovhz/rinha2/db"
+	"github.com/ricardovhz/rinha2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	w, err := db.OpenWAL(dir)
+	require.NoError(t, err)
+
+	done := make([]<-chan error, 0)
+	for i := 1; i <= 10; i++ {
+		for _, id := range []string{"1", "2"} {
+			r := record(t, id, &model.Transaction{
+				Timestamp:   int64(i),
+				Value:       int64(i),
+				Type:        "c",
+				Description: "wal",
+			})
+			done = append(done, w.Append(uint64(i), r))
+		}
+	}
+	for _, c := range done {
+		require.NoError(t, <-c)
+	}
+	require.NoError(t, w.Close())
+
+	w, err = db.OpenWAL(dir)
+	require.NoError(t, err)
+	defer w.Close()
+
+	seqs := make([]uint64, 0)
+	var total int64
+	err = w.Replay(2, 6, func(seq uint64, r db.Record) error {
+		require.Equal(t, uint32(2), r.ClientID())
+		seqs = append(seqs, seq)
+		total += r.Value()
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{7, 8, 9, 10}, seqs)
+	require.Equal(t, int64(7+8+9+10), total)
+
+	// depois de liberado, o segmento antigo não é mais lido
+	w.MarkFlushed(1, 10)
+	w.MarkFlushed(2, 10)
+	err = w.Replay(1, 0, func(seq uint64, r db.Record) error {
+		t.Fatalf("unexpected entry %d", seq)
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -2,34 +2,114 @@ package db
 
 import (
 	"bufio"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 )
 
 type CloseableRegWriter interface {
 	RegWriter
+	// WriteRecord grava o registro no formato do codec do chunk
+	WriteRecord(r Record) error
 	io.Closer
 }
 
 type writerFactory interface {
-	NewWriter(id, chunkId string, transactionLen int) (CloseableRegWriter, error)
+	NewWriter(id, chunkId string, codec Codec, transactionLen int) (CloseableRegWriter, error)
 }
 
 type flushableRegWriter struct {
-	b *bufio.Writer
-	w io.WriteCloser
+	b     *bufio.Writer
+	w     *os.File
+	enc   *encryptWriter
+	dir   string
+	info  ChunkInfo
+	codec Codec
+	buf   []byte
 }
 
 func (frw *flushableRegWriter) Write(p []byte) (int, error) {
 	return frw.b.Write(p)
 }
+
+func (frw *flushableRegWriter) WriteRecord(r Record) error {
+	var err error
+	frw.buf, err = frw.codec.Append(frw.buf[:0], r)
+	if err != nil {
+		return err
+	}
+	_, err = frw.b.Write(frw.buf)
+	if err != nil {
+		return err
+	}
+	frw.info.observe(r.Timestamp())
+	return nil
+}
 func (frw *flushableRegWriter) WriteByte(b byte) error {
 	return frw.b.WriteByte(b)
 }
+
+// Close grava o buffer, sincroniza o chunk em disco e o sela no manifesto.
+// Só depois disso os registros ficam visíveis para os leitores
 func (frw *flushableRegWriter) Close() error {
-	frw.b.Flush()
-	return frw.w.Close()
+	err := frw.b.Flush()
+	if err == nil && frw.enc != nil {
+		err = frw.enc.Close()
+	}
+	if err == nil {
+		err = frw.w.Sync()
+	}
+	if cerr := frw.w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncDir(frw.dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	l := manifestLock(frw.dir)
+	l.Lock()
+	defer l.Unlock()
+	return appendManifest(frw.dir, manifestOp{op: opSeal, info: frw.info})
+}
+
+// Abort descarta o chunk sem selá-lo: o arquivo é removido e a entrada sai do
+// manifesto
+func (frw *flushableRegWriter) Abort() error {
+	frw.w.Close()
+	err := os.Remove(frw.w.Name())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	l := manifestLock(frw.dir)
+	l.Lock()
+	defer l.Unlock()
+	entries, err := readManifest(frw.dir)
+	if err != nil {
+		return err
+	}
+	keep := entries[:0]
+	for _, e := range entries {
+		if e.Name != frw.info.Name {
+			keep = append(keep, e)
+		}
+	}
+	return rewriteManifest(frw.dir, keep)
+}
+
+// syncDir sincroniza as entradas de um diretório, garantindo que arquivos
+// criados ou renomeados sobrevivam a uma queda
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 // fileWriterFactory criar arquivos para escrita
@@ -37,22 +117,46 @@ type fileWriterFactory struct {
 	path string
 }
 
-func (fwf *fileWriterFactory) NewWriter(id, chunkId string, transactionLen int) (CloseableRegWriter, error) {
+func (fwf *fileWriterFactory) NewWriter(id, chunkId string, codec Codec, transactionLen int) (CloseableRegWriter, error) {
 	dir := filepath.Join(fwf.path, id)
 	os.Mkdir(dir, os.ModeDir|0755)
+	_, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// registra o chunk no manifesto antes de criar o arquivo, assim um
+	// arquivo nunca existe sem estar catalogado
+	l := manifestLock(dir)
+	l.Lock()
+	info, err := nextChunkInfo(dir, chunkId)
+	if err == nil {
+		err = appendManifest(dir, manifestOp{op: opAdd, info: info})
+	}
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
 	filename := filepath.Join(dir, chunkId)
 	f, err := os.Create(filename)
 	if err != nil {
 		return nil, err
 	}
-
-	lastPath := filepath.Join(dir, "LAST")
-	os.Remove(lastPath)
-	err = os.Symlink(chunkId, lastPath)
+	frw := &flushableRegWriter{w: f, dir: dir, info: info, codec: codec}
+	w, enc, err := contentWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	frw.enc = enc
+	frw.b = bufio.NewWriterSize(w, HeaderSize+transactionLen*64)
+	err = WriteHeader(frw.b, codec.Version())
 	if err != nil {
+		frw.Abort()
 		return nil, err
 	}
-	return &flushableRegWriter{b: bufio.NewWriterSize(f, transactionLen), w: f}, nil
+	return frw, nil
 }
 
 func NewFileWriterFactoryFromPath(p string) writerFactory {
@@ -6,3 +6,4 @@ rm -rf /data/store/2
 rm -rf /data/store/3
 rm -rf /data/store/4
 rm -rf /data/store/5
+rm -rf /data/store/wal
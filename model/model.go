@@ -1,16 +1,32 @@
 package model
 
-import "fmt"
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// limites dos metadados de uma transação (em bytes)
+const (
+	MaxMetadataEntries = 16
+	MaxMetadataKey     = 64
+	MaxMetadataValue   = 256
+)
+
+// IdempotencyKey é o metadado com a chave de idempotência da transação
+// (header Idempotency-Key da API). O store responde a uma chave repetida com
+// o limite e o saldo da transação original
+const IdempotencyKey = "idempotency_key"
 
 type Transaction struct {
-	Date        string `json:"realizada_em"`
-	Value       int    `json:"valor" binding:"required"`
-	Type        string `json:"tipo" binding:"required"`
-	Description string `json:"descricao" binding:"required"`
+	Date        string            `json:"realizada_em"`
+	Value       int64             `json:"valor" binding:"required"`
+	Type        string            `json:"tipo" binding:"required"`
+	Description string            `json:"descricao" binding:"required"`
+	Metadata    map[string]string `json:"metadados,omitempty"`
 	Timestamp   int64
 }
 
-func (t *Transaction) GetValue() int {
+func (t *Transaction) GetValue() int64 {
 	if t.Type == "d" {
 		return t.Value * -1
 	}
@@ -24,14 +40,31 @@ func (t *Transaction) Validate() error {
 	if t.Value < 0 {
 		return fmt.Errorf("invalid value %d", t.Value)
 	}
-	if len(t.Description) < 1 || len(t.Description) > 10 {
+	if n := utf8.RuneCountInString(t.Description); n < 1 || n > 10 || !utf8.ValidString(t.Description) {
 		return fmt.Errorf("invalid description %s", t.Description)
 	}
+	if len(t.Metadata) > MaxMetadataEntries {
+		return fmt.Errorf("too many metadata entries %d", len(t.Metadata))
+	}
+	for k, v := range t.Metadata {
+		if len(k) < 1 || len(k) > MaxMetadataKey || len(v) > MaxMetadataValue || !utf8.ValidString(k) || !utf8.ValidString(v) {
+			return fmt.Errorf("invalid metadata %s", k)
+		}
+	}
 	return nil
 }
 
+// AddAmount soma dois valores e indica se o resultado coube em um int64
+func AddAmount(a, b int64) (int64, bool) {
+	s := a + b
+	if (b > 0 && s < a) || (b < 0 && s > a) {
+		return s, false
+	}
+	return s, true
+}
+
 type Resume struct {
-	Balance      int
-	Limit        int
+	Balance      int64
+	Limit        int64
 	Transactions []*Transaction
 }
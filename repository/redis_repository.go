@@ -22,12 +22,12 @@ func (r *redisRepository) ShutDown() {
 	r.redisClient.Close()
 }
 
-func (r *redisRepository) GetLimitAndBalance(ctx context.Context, id string) (int, int, error) {
+func (r *redisRepository) GetLimitAndBalance(ctx context.Context, id string) (int64, int64, error) {
 
 	var (
 		rl      string
-		limit   int
-		balance int
+		limit   int64
+		balance int64
 	)
 	for {
 		cmds, err := r.redisClient.Pipelined(ctx, func(p redis.Pipeliner) error {
@@ -41,8 +41,8 @@ func (r *redisRepository) GetLimitAndBalance(ctx context.Context, id string) (in
 			return -1, -1, ErrClientNotInitialized
 		}
 		rl, _ = cmds[0].(*redis.StringCmd).Result()
-		limit, _ = cmds[1].(*redis.StringCmd).Int()
-		balance, _ = cmds[2].(*redis.StringCmd).Int()
+		limit, _ = cmds[1].(*redis.StringCmd).Int64()
+		balance, _ = cmds[2].(*redis.StringCmd).Int64()
 		if rl == "1" || balance < limit*-1 {
 
 			// transacao em andamento, aguardando liberação
@@ -54,10 +54,10 @@ func (r *redisRepository) GetLimitAndBalance(ctx context.Context, id string) (in
 	return limit, balance, nil
 }
 
-func (r *redisRepository) SaveTransaction(ctx context.Context, id string, t *model.Transaction) (int, int, error) {
+func (r *redisRepository) SaveTransaction(ctx context.Context, id string, t *model.Transaction) (int64, int64, error) {
 	var (
 		err   error
-		limit int
+		limit int64
 		total int64
 		index int64 = -1
 	)
@@ -73,14 +73,20 @@ func (r *redisRepository) SaveTransaction(ctx context.Context, id string, t *mod
 		slog.Error("Error getting limit and balance", "error", err, "description", t.Description, "client", id, "cmds", cmds[0])
 		return -1, -1, err
 	} else {
-		limit, _ = cmds[0].(*redis.StringCmd).Int()
+		limit, _ = cmds[0].(*redis.StringCmd).Int64()
 		index, _ = cmds[1].(*redis.IntCmd).Result()
 		total, _ = cmds[3].(*redis.StringCmd).Int64()
 	}
 
 	for {
+		next, ok := model.AddAmount(total, t.GetValue())
+		if !ok {
+			slog.Info("Balance overflow", "balance", total, "value", t.Value, "client", id)
+			return -1, -1, ErrOverflow
+		}
+
 		// se valor a debitar for excedido do limite
-		if t.Type == "d" && int(total)+t.GetValue() < limit*-1 {
+		if t.Type == "d" && next < limit*-1 {
 			slog.Info("Limit exceeded", "limit", limit, "balance", total, "description", t.Description, "client", id)
 			return -1, -1, ErrLimitExceeded
 		}
@@ -119,7 +125,7 @@ func (r *redisRepository) SaveTransaction(ctx context.Context, id string, t *mod
 				validated = false
 				break
 			}
-			total, err = c.IncrBy(ctx, "balance:"+id, int64(t.GetValue())).Result()
+			total, err = c.IncrBy(ctx, "balance:"+id, t.GetValue()).Result()
 			if err != nil {
 				slog.Error("Error incrementing balance", "error", err, "description", t.Description, "client", id)
 				time.Sleep(time.Duration(rand.Intn(1000)) * time.Nanosecond)
@@ -136,10 +142,10 @@ func (r *redisRepository) SaveTransaction(ctx context.Context, id string, t *mod
 			continue
 		}
 
-		if int(total) < limit*-1 {
+		if total < limit*-1 {
 			slog.Warn("[inconsistency] Limit exceeded", "limit", limit, "balance", total, "description", t.Description, "client", id)
 			for {
-				total, err = c.IncrBy(ctx, "balance:"+id, int64(t.GetValue()*-1)).Result()
+				total, err = c.IncrBy(ctx, "balance:"+id, t.GetValue()*-1).Result()
 				if err != nil {
 					slog.Error("Error returning back balance", "error", err, "description", t.Description, "client", id)
 					time.Sleep(time.Duration(rand.Intn(80)) * time.Microsecond)
@@ -153,7 +159,7 @@ func (r *redisRepository) SaveTransaction(ctx context.Context, id string, t *mod
 
 		// tudo ok
 		c.Set(ctx, "readlock:"+id, "0", 0)
-		return limit, int(total), nil
+		return limit, total, nil
 	}
 }
 
@@ -184,7 +190,7 @@ func (r *redisRepository) GetResume(ctx context.Context, id string) (*model.Resu
 		t.Date = spl[0]
 		t.Type = spl[1]
 		t.Description = spl[2]
-		t.Value, _ = strconv.Atoi(spl[3])
+		t.Value, _ = strconv.ParseInt(spl[3], 10, 64)
 		res.Transactions = append(res.Transactions, &t)
 	}
 	sort.SliceStable(res.Transactions, func(i, j int) bool {
@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/ricardovhz/rinha2/model"
 )
@@ -10,11 +11,120 @@ import (
 var (
 	ErrClientNotInitialized = errors.New("client not initialized")
 	ErrLimitExceeded        = errors.New("limit exceeded")
+	ErrStoreFailure         = errors.New("store failure")
+	ErrOverflow             = errors.New("amount overflow")
+	ErrClientExists         = errors.New("client already exists")
+	ErrInvalidLimit         = errors.New("invalid limit")
+	ErrLimitBelowBalance    = errors.New("limit below balance")
+	ErrDebitFrozen          = errors.New("account debit frozen")
+	ErrAccountFrozen        = errors.New("account frozen")
+	ErrAccountClosed        = errors.New("account closed")
+	ErrInvalidState         = errors.New("invalid account state")
+	ErrInvalidBackupPath    = errors.New("invalid backup path")
 )
 
+// ClientState é o estado da conta do cliente. O valor é o código do estado
+// no protocolo do store
+type ClientState byte
+
+const (
+	StateActive ClientState = 'a'
+	// StateDebitFrozen aceita só créditos
+	StateDebitFrozen ClientState = 'd'
+	// StateFrozen não aceita transações
+	StateFrozen ClientState = 'f'
+	// StateClosed não aceita transações nem outra alteração de estado
+	StateClosed ClientState = 'c'
+)
+
+var stateNames = map[ClientState]string{
+	StateActive:      "active",
+	StateDebitFrozen: "debit_frozen",
+	StateFrozen:      "frozen",
+	StateClosed:      "closed",
+}
+
+func (s ClientState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Valid indica se o estado é conhecido
+func (s ClientState) Valid() bool {
+	_, ok := stateNames[s]
+	return ok
+}
+
+// TransactionError retorna o erro de uma transação do tipo typ ('c' ou 'd')
+// em uma conta no estado s, ou nil se ela é aceita
+func (s ClientState) TransactionError(typ string) error {
+	switch s {
+	case StateDebitFrozen:
+		if typ == "d" {
+			return ErrDebitFrozen
+		}
+	case StateFrozen:
+		return ErrAccountFrozen
+	case StateClosed:
+		return ErrAccountClosed
+	}
+	return nil
+}
+
+// ParseClientState converte o nome do estado; vazio é StateActive
+func ParseClientState(name string) (ClientState, error) {
+	if name == "" {
+		return StateActive, nil
+	}
+	for s, n := range stateNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, ErrInvalidState
+}
+
 type Repository interface {
-	GetLimitAndBalance(ctx context.Context, id string) (int, int, error)
-	SaveTransaction(ctx context.Context, id string, t *model.Transaction) (int, int, error)
+	GetLimitAndBalance(ctx context.Context, id string) (int64, int64, error)
+	SaveTransaction(ctx context.Context, id string, t *model.Transaction) (int64, int64, error)
 	GetResume(ctx context.Context, id string) (*model.Resume, error)
 	ShutDown()
 }
+
+// Backuper é implementado pelos repositórios que podem pedir um backup
+// consistente ao store
+type Backuper interface {
+	Backup(ctx context.Context, dst string) error
+}
+
+// BalanceAtReader é implementado pelos repositórios que reconstroem o saldo de
+// um cliente em um instante (unix millis)
+type BalanceAtReader interface {
+	BalanceAt(ctx context.Context, id string, ts int64) (int64, error)
+}
+
+// Client descreve um cliente registrado no store
+type Client struct {
+	ID      string
+	Limit   int64
+	Balance int64
+	// Count é a quantidade de transações
+	Count   int64
+	State   ClientState
+	Created time.Time
+}
+
+// ClientManager é implementado pelos repositórios que criam e consultam os
+// clientes do store em execução
+type ClientManager interface {
+	CreateClient(ctx context.Context, id string, limit int64) error
+	ListClients(ctx context.Context) ([]Client, error)
+	DescribeClient(ctx context.Context, id string) (*Client, error)
+	// SetLimit altera o limite do cliente e retorna o saldo atual. Com
+	// allowBelowBalance o limite pode ficar abaixo do saldo negativo
+	SetLimit(ctx context.Context, id string, limit int64, allowBelowBalance bool, reason string) (int64, error)
+	// SetState altera o estado da conta do cliente
+	SetState(ctx context.Context, id string, state ClientState, reason string) error
+}
@@ -1,13 +1,16 @@
 package repository
 
 import (
-	"bytes"
 	"context"
+	"encoding/binary"
+	"io"
 	"log/slog"
+	"math"
 	"net"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/ricardovhz/rinha2/db"
 	"github.com/ricardovhz/rinha2/model"
@@ -38,106 +41,379 @@ func (t *tcpRepository) validateResponse(resp []byte) error {
 		if resp[1] == 'l' {
 			return ErrLimitExceeded
 		}
+		if resp[1] == 'o' {
+			return ErrOverflow
+		}
+		if resp[1] == 'x' {
+			return ErrClientExists
+		}
+		if resp[1] == 'i' {
+			return ErrInvalidLimit
+		}
+		if resp[1] == 'u' {
+			return ErrLimitBelowBalance
+		}
+		if resp[1] == 'd' {
+			return ErrDebitFrozen
+		}
+		if resp[1] == 'f' {
+			return ErrAccountFrozen
+		}
+		if resp[1] == 'c' {
+			return ErrAccountClosed
+		}
+		if resp[1] == 's' {
+			return ErrInvalidState
+		}
+		if resp[1] == 'p' {
+			return ErrInvalidBackupPath
+		}
+		return ErrStoreFailure
 	}
 	return nil
 }
 
-func (t *tcpRepository) toIntLittleEndian(resp []byte) int {
-	return int(resp[0]) | int(resp[1])<<8 | int(resp[2])<<16 | int(resp[3])<<24
+// release devolve a conexão ao pool, descartando-a se houve erro de comunicação
+func (t *tcpRepository) release(d net.Conn, err error) {
+	switch err {
+	case nil, ErrClientNotInitialized, ErrLimitExceeded, ErrOverflow, ErrStoreFailure, ErrClientExists, ErrInvalidLimit, ErrLimitBelowBalance,
+		ErrDebitFrozen, ErrAccountFrozen, ErrAccountClosed, ErrInvalidState, ErrInvalidBackupPath:
+		t.pool.Put(d)
+	default:
+		d.Close()
+	}
+}
+
+// tamanho do cabeçalho da resposta: status, limite (int64) e saldo (int64)
+const responseHeaderSize = 17
+
+// readHeader lê o status da resposta e, em caso de sucesso, o limite e o saldo (resp[1:17])
+func (t *tcpRepository) readHeader(r io.Reader, resp []byte) error {
+	_, err := io.ReadFull(r, resp[:2])
+	if err != nil {
+		return err
+	}
+	if err = t.validateResponse(resp); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r, resp[2:responseHeaderSize])
+	return err
 }
 
-func (t *tcpRepository) GetLimitAndBalance(ctx context.Context, id string) (int, int, error) {
+// limitAndBalance decodifica o limite e o saldo do cabeçalho da resposta
+func (t *tcpRepository) limitAndBalance(resp []byte) (int64, int64) {
+	return int64(binary.LittleEndian.Uint64(resp[1:9])), int64(binary.LittleEndian.Uint64(resp[9:17]))
+}
+
+func (t *tcpRepository) GetLimitAndBalance(ctx context.Context, id string) (int64, int64, error) {
 	return -1, -1, nil
 }
 
-func (t *tcpRepository) SaveTransaction(ctx context.Context, id string, tr *model.Transaction) (int, int, error) {
+// SaveTransaction envia a transação ao store. A chave de idempotência, se
+// houver, vai no metadado model.IdempotencyKey do registro
+func (t *tcpRepository) SaveTransaction(ctx context.Context, id string, tr *model.Transaction) (int64, int64, error) {
+	if _, err := db.ParseClientID(id); err != nil {
+		return -1, -1, ErrClientNotInitialized
+	}
 	bh := t.requestBytePool.Get().(*ByteHolder)
 	defer t.requestBytePool.Put(bh)
-	msg := bh.b
-	msg[0] = '1'
-	r := db.ToRecord(id, tr)
-	copy(msg[1:], r[:])
+	msg, err := db.AppendRecord(append(bh.b[:0], '1'), id, tr)
+	if err != nil {
+		return -1, -1, err
+	}
+	bh.b = msg
 
 	d, err := t.pool.Get()
 	if err != nil {
 		slog.Info("error dialing", "err", ErrClientNotInitialized)
 		return -1, -1, ErrClientNotInitialized
 	}
-	defer t.pool.Put(d)
 
 	_, err = d.Write(msg)
 	if err != nil {
+		d.Close()
 		return -1, -1, err
 	}
 
 	bhr := t.responseBytePool.Get().(*ByteHolder)
 	defer t.responseBytePool.Put(bhr)
 	resp := bhr.b
-	i, err := d.Read(resp)
+	err = t.readHeader(d, resp)
+	t.release(d, err)
 	if err != nil {
 		return -1, -1, err
 	}
 
-	if err = t.validateResponse(resp); err != nil {
-		return -1, -1, err
-	} else if i != 9 {
-		slog.Error("invalid response: " + string(resp))
-		return -1, -1, nil
-	}
-
-	lim := t.toIntLittleEndian(resp[1:5])
-	bal := int(int32(t.toIntLittleEndian(resp[5:9])))
-
+	lim, bal := t.limitAndBalance(resp)
 	return lim, bal, nil
 }
 
 func (t *tcpRepository) GetResume(ctx context.Context, id string) (*model.Resume, error) {
-	msg := [2]byte{'0', id[0]}
+	cid, err := db.ParseClientID(id)
+	if err != nil {
+		return nil, ErrClientNotInitialized
+	}
+	msg := [5]byte{'0'}
+	binary.LittleEndian.PutUint32(msg[1:], cid)
 
 	d, err := t.pool.Get()
 	if err != nil {
 		slog.Info("error dialing", "err", ErrClientNotInitialized)
 		return nil, ErrClientNotInitialized
 	}
-	defer t.pool.Put(d)
 
 	_, err = d.Write(msg[:])
 	if err != nil {
+		d.Close()
 		return nil, err
 	}
 
-	resp := make([]byte, 9+db.RecordSize*5)
+	resp := make([]byte, responseHeaderSize+1)
+	err = t.readHeader(d, resp)
+	if err == nil {
+		_, err = io.ReadFull(d, resp[responseHeaderSize:])
+	}
 
-	i, err := d.Read(resp)
+	// os registros têm tamanho variável e são lidos um a um
+	var trs []*model.Transaction
+	if err == nil {
+		n := int(resp[responseHeaderSize])
+		trs = make([]*model.Transaction, 0, n)
+		for j := 0; j < n; j++ {
+			var r db.Record
+			r, err = db.ReadRecord(d)
+			if err != nil {
+				break
+			}
+			_, tr := db.ToTransaction(r)
+			trs = append(trs, tr)
+		}
+	}
+	t.release(d, err)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = t.validateResponse(resp); err != nil {
+	lim, bal := t.limitAndBalance(resp)
+
+	return &model.Resume{
+		Limit:        lim,
+		Balance:      bal,
+		Transactions: trs,
+	}, nil
+}
+
+// Backup pede ao store um backup consistente dos dados no diretório dst,
+// relativo ao BACKUP_PATH do store
+func (t *tcpRepository) Backup(ctx context.Context, dst string) error {
+	if len(dst) > math.MaxUint16 {
+		return ErrStoreFailure
+	}
+	msg := append([]byte{'2'}, binary.LittleEndian.AppendUint16(nil, uint16(len(dst)))...)
+	msg = append(msg, dst...)
+	d, err := t.pool.Get()
+	if err != nil {
+		return err
+	}
+	_, err = d.Write(msg)
+	if err == nil {
+		err = t.readHeader(d, make([]byte, responseHeaderSize))
+	}
+	t.release(d, err)
+	return err
+}
+
+// BalanceAt pede ao store o saldo do cliente no instante ts
+func (t *tcpRepository) BalanceAt(ctx context.Context, id string, ts int64) (int64, error) {
+	cid, err := db.ParseClientID(id)
+	if err != nil {
+		return -1, ErrClientNotInitialized
+	}
+	msg := [13]byte{'3'}
+	binary.LittleEndian.PutUint32(msg[1:], cid)
+	binary.LittleEndian.PutUint64(msg[5:], uint64(ts))
+
+	d, err := t.pool.Get()
+	if err != nil {
+		return -1, err
+	}
+	resp := make([]byte, responseHeaderSize)
+	_, err = d.Write(msg[:])
+	if err == nil {
+		err = t.readHeader(d, resp)
+	}
+	t.release(d, err)
+	if err != nil {
+		return -1, err
+	}
+	_, bal := t.limitAndBalance(resp)
+	return bal, nil
+}
+
+// tamanho de um cliente na listagem: id (uint32), limite, saldo, quantidade
+// de transações e criação (int64, unix millis) e estado (1 byte)
+const clientEntrySize = 4 + 8 + 8 + 8 + 8 + 1
+
+func decodeClient(b []byte) Client {
+	return Client{
+		ID:      strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b)), 10),
+		Limit:   int64(binary.LittleEndian.Uint64(b[4:])),
+		Balance: int64(binary.LittleEndian.Uint64(b[12:])),
+		Count:   int64(binary.LittleEndian.Uint64(b[20:])),
+		Created: time.UnixMilli(int64(binary.LittleEndian.Uint64(b[28:]))),
+		State:   ClientState(b[36]),
+	}
+}
+
+// CreateClient pede ao store a criação do cliente com o limite informado
+func (t *tcpRepository) CreateClient(ctx context.Context, id string, limit int64) error {
+	cid, err := db.ParseClientID(id)
+	if err != nil {
+		return ErrClientNotInitialized
+	}
+	msg := [13]byte{'4'}
+	binary.LittleEndian.PutUint32(msg[1:], cid)
+	binary.LittleEndian.PutUint64(msg[5:], uint64(limit))
+
+	d, err := t.pool.Get()
+	if err != nil {
+		return err
+	}
+	_, err = d.Write(msg[:])
+	if err == nil {
+		err = t.readHeader(d, make([]byte, responseHeaderSize))
+	}
+	t.release(d, err)
+	return err
+}
+
+// ListClients lista os clientes em operação no store
+func (t *tcpRepository) ListClients(ctx context.Context) ([]Client, error) {
+	d, err := t.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, responseHeaderSize+4)
+	_, err = d.Write([]byte{'5'})
+	if err == nil {
+		err = t.readHeader(d, resp)
+	}
+	if err == nil {
+		_, err = io.ReadFull(d, resp[responseHeaderSize:])
+	}
+	var clients []Client
+	if err == nil {
+		n := binary.LittleEndian.Uint32(resp[responseHeaderSize:])
+		clients = make([]Client, 0, n)
+		b := make([]byte, clientEntrySize)
+		for i := uint32(0); i < n; i++ {
+			_, err = io.ReadFull(d, b)
+			if err != nil {
+				break
+			}
+			clients = append(clients, decodeClient(b))
+		}
+	}
+	t.release(d, err)
+	if err != nil {
 		return nil, err
-	} else if i < 9 {
-		slog.Error("invalid response: " + string(resp))
+	}
+	return clients, nil
+}
+
+// DescribeClient retorna o limite, o saldo e a quantidade de transações do cliente
+func (t *tcpRepository) DescribeClient(ctx context.Context, id string) (*Client, error) {
+	cid, err := db.ParseClientID(id)
+	if err != nil {
 		return nil, ErrClientNotInitialized
 	}
+	msg := [5]byte{'6'}
+	binary.LittleEndian.PutUint32(msg[1:], cid)
+
+	d, err := t.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, responseHeaderSize+clientEntrySize)
+	_, err = d.Write(msg[:])
+	if err == nil {
+		err = t.readHeader(d, resp)
+	}
+	if err == nil {
+		_, err = io.ReadFull(d, resp[responseHeaderSize:])
+	}
+	t.release(d, err)
+	if err != nil {
+		return nil, err
+	}
+	c := decodeClient(resp[responseHeaderSize:])
+	return &c, nil
+}
 
-	lim := t.toIntLittleEndian(resp[1:5])
-	bal := int(int32(t.toIntLittleEndian(resp[5:9])))
+// SetLimit pede ao store a alteração do limite do cliente
+func (t *tcpRepository) SetLimit(ctx context.Context, id string, limit int64, allowBelowBalance bool, reason string) (int64, error) {
+	cid, err := db.ParseClientID(id)
+	if err != nil {
+		return -1, ErrClientNotInitialized
+	}
+	if len(reason) > math.MaxUint8 {
+		reason = reason[:math.MaxUint8]
+	}
+	policy := byte('r')
+	if allowBelowBalance {
+		policy = 'a'
+	}
+	msg := make([]byte, 15, 15+len(reason))
+	msg[0] = '7'
+	binary.LittleEndian.PutUint32(msg[1:], cid)
+	binary.LittleEndian.PutUint64(msg[5:], uint64(limit))
+	msg[13] = policy
+	msg[14] = byte(len(reason))
+	msg = append(msg, reason...)
 
-	trs := make([]*model.Transaction, 0)
-	for j := 9; j < i; j += db.RecordSize {
-		r, err := db.ReadRecord(bytes.NewReader(resp[j : j+db.RecordSize]))
-		if err != nil {
-			panic(err)
-		}
-		_, tr := db.ToTransaction(r)
-		trs = append(trs, tr)
+	d, err := t.pool.Get()
+	if err != nil {
+		return -1, err
+	}
+	resp := make([]byte, responseHeaderSize)
+	_, err = d.Write(msg)
+	if err == nil {
+		err = t.readHeader(d, resp)
+	}
+	t.release(d, err)
+	if err != nil {
+		return -1, err
 	}
+	_, bal := t.limitAndBalance(resp)
+	return bal, nil
+}
 
-	return &model.Resume{
-		Limit:        lim,
-		Balance:      bal,
-		Transactions: trs,
-	}, nil
+// SetState pede ao store a alteração do estado da conta do cliente
+func (t *tcpRepository) SetState(ctx context.Context, id string, state ClientState, reason string) error {
+	cid, err := db.ParseClientID(id)
+	if err != nil {
+		return ErrClientNotInitialized
+	}
+	if len(reason) > math.MaxUint8 {
+		reason = reason[:math.MaxUint8]
+	}
+	msg := make([]byte, 7, 7+len(reason))
+	msg[0] = '8'
+	binary.LittleEndian.PutUint32(msg[1:], cid)
+	msg[5] = byte(state)
+	msg[6] = byte(len(reason))
+	msg = append(msg, reason...)
+
+	d, err := t.pool.Get()
+	if err != nil {
+		return err
+	}
+	_, err = d.Write(msg)
+	if err == nil {
+		err = t.readHeader(d, make([]byte, responseHeaderSize))
+	}
+	t.release(d, err)
+	return err
 }
 
 func (t *tcpRepository) ShutDown() {
@@ -157,12 +433,12 @@ func NewTcpRepository(addr string) Repository {
 		}),
 		requestBytePool: &sync.Pool{
 			New: func() any {
-				return NewByteHolder(25)
+				return NewByteHolder(1 + 64)
 			},
 		},
 		responseBytePool: &sync.Pool{
 			New: func() any {
-				return NewByteHolder(9)
+				return NewByteHolder(responseHeaderSize)
 			},
 		},
 	}